@@ -0,0 +1,181 @@
+// Written by Xu Chen Hao
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+	"strings"
+)
+
+// Blind indexes make encrypted POs searchable by selected fields. For every
+// field a tag HMAC-SHA256(index key, field, value) is stored as composite key
+// blindIndex~field~tag~poNo, the index key is passed in transient IDXKEY and
+// never stored. blindIndexKeys~poNo lists the index entries of a PO, so that
+// they can be replaced when the PO is uploaded again, or removed if it is
+// uploaded without index key.
+const blindIndexIndex = "blindIndex"
+const blindIndexKeysIndex = "blindIndexKeys"
+
+const IDXKEY = "IDXKEY"
+
+// configuration name of the indexed PO fields, e.g. "buyer,seller"
+const ConfigBlindIndexFields = "blindIndexFields.po"
+
+var defaultBlindIndexFields = []string{"buyer", "seller"}
+
+type BlindIndexResult struct {
+	Field string   `json:"field"`
+	Keys  []string `json:"keys"`
+}
+
+func blindIndexTag(idxKey []byte, field, value string) string {
+	mac := hmac.New(sha256.New, idxKey)
+	mac.Write([]byte(field + "\x00" + value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *SmartContract) blindIndexFields(stub shim.ChaincodeStubInterface) ([]string, error) {
+	configured, err := s.getConfig(stub, ConfigBlindIndexFields)
+	if err != nil {
+		return nil, err
+	}
+	if configured == "" {
+		return defaultBlindIndexFields, nil
+	}
+	var fields []string
+	for _, field := range strings.Split(configured, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields, nil
+}
+
+// deleteBlindIndex removes the blind index entries of a PO and returns the
+// key of its entry list
+func (s *SmartContract) deleteBlindIndex(stub shim.ChaincodeStubInterface, poNo string) (string, error) {
+	keysKey, err := stub.CreateCompositeKey(blindIndexKeysIndex, []string{poNo})
+	if err != nil {
+		return "", err
+	}
+	oldKeysAsBytes, err := stub.GetState(keysKey)
+	if err != nil {
+		return "", err
+	}
+	if oldKeysAsBytes == nil {
+		return keysKey, nil
+	}
+	var oldKeys []string
+	err = json.Unmarshal(oldKeysAsBytes, &oldKeys)
+	if err != nil {
+		return "", err
+	}
+	for _, oldKey := range oldKeys {
+		err = stub.DelState(oldKey)
+		if err != nil {
+			return "", err
+		}
+	}
+	return keysKey, stub.DelState(keysKey)
+}
+
+// writeBlindIndex replaces the blind index entries of a PO with tags of the
+// clear text field values
+func (s *SmartContract) writeBlindIndex(stub shim.ChaincodeStubInterface, idxKey []byte, po POEncrypt) error {
+	if len(idxKey) < 16 {
+		return errors.New("need index key of at least 128 bit")
+	}
+	fields, err := s.blindIndexFields(stub)
+	if err != nil {
+		return err
+	}
+	poAsBytes, err := json.Marshal(po)
+	if err != nil {
+		return err
+	}
+	doc, err := decodeJSON(poAsBytes)
+	if err != nil {
+		return err
+	}
+
+	keysKey, err := s.deleteBlindIndex(stub, po.PoNo)
+	if err != nil {
+		return err
+	}
+
+	indexKeys := []string{}
+	for _, field := range fields {
+		value, err := pointerGet(doc, strings.Split(field, "."))
+		if err != nil {
+			logger.Debugf("Skip blind index of missing field %s", field)
+			continue
+		}
+		text, ok := value.(string)
+		if !ok {
+			text = fmt.Sprintf("%v", value)
+		}
+		indexKey, err := stub.CreateCompositeKey(blindIndexIndex,
+			[]string{field, blindIndexTag(idxKey, field, text), po.PoNo})
+		if err != nil {
+			return err
+		}
+		// the composite key holds everything, the value only marks presence
+		err = stub.PutState(indexKey, []byte{0x00})
+		if err != nil {
+			return err
+		}
+		indexKeys = append(indexKeys, indexKey)
+	}
+
+	keysAsBytes, err := json.Marshal(indexKeys)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(keysKey, keysAsBytes)
+}
+
+// queryPOByBlindIndex returns the numbers of the encrypted POs whose field
+// has the given value
+func (s *SmartContract) queryPOByBlindIndex(APIstub shim.ChaincodeStubInterface, args []string,
+	idxKey []byte) sc.Response {
+
+	if len(args) != 2 {
+		return s.returnError("Wrong number of parameters, need field & value")
+	}
+
+	field, value := args[0], args[1]
+	tag := blindIndexTag(idxKey, field, value)
+
+	logger.Debugf("Query blind index: [field] %s, [tag] %s", field, tag)
+
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(blindIndexIndex, []string{field, tag})
+	if err != nil {
+		return s.returnError("Query failed: " + err.Error())
+	}
+	defer resultsIterator.Close()
+
+	result := BlindIndexResult{Field: field, Keys: []string{}}
+	for resultsIterator.HasNext() {
+		item, err := resultsIterator.Next()
+		if err != nil {
+			return s.returnError("Fetch next result failed: " + err.Error())
+		}
+		_, attributes, err := APIstub.SplitCompositeKey(item.Key)
+		if err != nil {
+			return s.returnError("Split composite key failed: " + err.Error())
+		}
+		result.Keys = append(result.Keys, attributes[2])
+	}
+
+	resultAsBytes, err := json.Marshal(result)
+	if err != nil {
+		return s.returnError("Marshal query result failed: " + err.Error())
+	}
+	return shim.Success(resultAsBytes)
+}
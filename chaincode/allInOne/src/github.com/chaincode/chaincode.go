@@ -14,9 +14,20 @@ var logger = shim.NewLogger("chaincode")
 
 // Define the Smart Contract structure
 type SmartContract struct {
-	bccspInst bccsp.BCCSP
+	bccspInst   bccsp.BCCSP
+	keyProvider KeyProvider
 }
 
+// document types stored by the modules
+const (
+	DocTypePO        = "po"
+	DocTypeManifest  = "manifest"
+	DocTypeCommon    = "common"
+	DocTypeEncrypted = "encrypted"
+	// PO with Pedersen commitments instead of amounts
+	DocTypeConfidentialPO = "confidentialPO"
+)
+
 type R_Err struct {
 	Reason string `json:"reason"`
 }
@@ -32,6 +43,15 @@ func (s *SmartContract) returnError(reason string) sc.Response {
 	return shim.Success(reAsBytes)
 }
 
+// CONFLICT is the response status of a conditional write whose condition does
+// not hold. The caller can re-read the key and retry.
+const CONFLICT = 409
+
+func (s *SmartContract) returnConflict(reason string) sc.Response {
+	logger.Warning(reason)
+	return sc.Response{Status: CONFLICT, Message: reason}
+}
+
 func (s *SmartContract) Init(APIstub shim.ChaincodeStubInterface) sc.Response {
 	return shim.Success(nil)
 }
@@ -51,6 +71,21 @@ func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response
 		return s.queryPOHistory(APIstub, args)
 	} else if function == "richQueryPO" {
 		return s.richQueryPO(APIstub, args)
+	} else if function == "patchPO" {
+		return s.patchPO(APIstub, args)
+	} else if function == "uploadConfidentialPO" {
+		return s.uploadConfidentialPO(APIstub, args)
+	} else if function == "queryConfidentialPO" {
+		return s.queryConfidentialPO(APIstub, args)
+	} else if function == "openConfidentialPO" {
+		tMap, err := s.keyProvider.GetTransient(APIstub)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("Could not retrieve transient, err %s", err))
+		}
+		if _, in := tMap[OPENING]; !in {
+			return shim.Error(fmt.Sprintf("Expected transient commitment opening %s", OPENING))
+		}
+		return s.openConfidentialPO(APIstub, args, tMap[OPENING])
 	} else
 
 	// chaincode B - upload manifest
@@ -62,6 +97,8 @@ func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response
 		return s.queryManifestHistory(APIstub, args)
 	} else if function == "richQueryManifest" {
 		return s.richQueryManifest(APIstub, args)
+	} else if function == "patchManifest" {
+		return s.patchManifest(APIstub, args)
 	} else
 
 	// chaincode Common - upload common data
@@ -79,21 +116,47 @@ func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response
 		return s.batchQueryCommon(APIstub, args)
 	} else if function == "queryCommonByRange" {
 		return s.queryCommonByRange(APIstub, args)
+	} else if function == "uploadCommonIfAbsent" {
+		return s.uploadCommonIfAbsent(APIstub, args)
+	} else if function == "uploadCommonIfMatch" {
+		return s.uploadCommonIfMatch(APIstub, args)
+	} else if function == "deleteCommonIfMatch" {
+		return s.deleteCommonIfMatch(APIstub, args)
+	} else if function == "patchCommon" {
+		return s.patchCommon(APIstub, args)
+	} else if function == "uploadCommonChunked" {
+		return s.uploadCommonChunked(APIstub, args)
+	} else if function == "queryCommonChunked" {
+		return s.queryCommonChunked(APIstub, args)
+	} else if function == "queryCommonChunkManifest" {
+		return s.queryCommonChunkManifest(APIstub, args)
+	} else if function == "deleteCommonChunked" {
+		return s.deleteCommonChunked(APIstub, args)
+	} else if function == "getBatchProof" {
+		return s.getBatchProof(APIstub, args)
+	} else if function == "verifyBatchProof" {
+		return s.verifyBatchProof(APIstub, args)
+	} else if function == "setCommonExpiry" {
+		return s.setCommonExpiry(APIstub, args)
+	} else if function == "queryCommonExpiry" {
+		return s.queryCommonExpiry(APIstub, args)
+	} else if function == "purgeExpired" {
+		return s.purgeExpired(APIstub, args)
 	} else
 
 	// chaincode Encrypt
 	if function == "uploadPOEncAll" {
-		tMap, err := APIstub.GetTransient()
+		tMap, err := s.keyProvider.GetTransient(APIstub)
 		if err != nil {
 			return shim.Error(fmt.Sprintf("Could not retrieve transient, err %s", err))
 		}
 		if _, in := tMap[ENCKEY]; !in {
 			return shim.Error(fmt.Sprintf("Expected transient encryption key %s", ENCKEY))
 		}
-		return s.uploadPOEncrypt(APIstub, args, tMap[ENCKEY], tMap[IV], false, false)
+		return s.uploadPOEncrypt(APIstub, args, tMap[ENCKEY], tMap[IV], tMap[IDXKEY], false, false)
 
 	} else if function == "queryPODecAll" {
-		tMap, err := APIstub.GetTransient()
+		tMap, err := s.keyProvider.GetTransient(APIstub)
 		if err != nil {
 			return shim.Error(fmt.Sprintf("Could not retrieve transient, err %s", err))
 		}
@@ -103,17 +166,17 @@ func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response
 		return s.queryPODecrypt(APIstub, args, tMap[DECKEY], tMap[IV], false, false)
 
 	} else if function == "uploadPOEncPart" {
-		tMap, err := APIstub.GetTransient()
+		tMap, err := s.keyProvider.GetTransient(APIstub)
 		if err != nil {
 			return shim.Error(fmt.Sprintf("Could not retrieve transient, err %s", err))
 		}
 		if _, in := tMap[ENCKEY]; !in {
 			return shim.Error(fmt.Sprintf("Expected transient encryption key %s", ENCKEY))
 		}
-		return s.uploadPOEncrypt(APIstub, args, tMap[ENCKEY], tMap[IV], true, false)
+		return s.uploadPOEncrypt(APIstub, args, tMap[ENCKEY], tMap[IV], tMap[IDXKEY], true, false)
 
 	} else if function == "queryPODecPart" {
-		tMap, err := APIstub.GetTransient()
+		tMap, err := s.keyProvider.GetTransient(APIstub)
 		if err != nil {
 			return shim.Error(fmt.Sprintf("Could not retrieve transient, err %s", err))
 		}
@@ -122,7 +185,7 @@ func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response
 		}
 		return s.queryPODecrypt(APIstub, args, tMap[DECKEY], tMap[IV], true, false)
 	} else if function == "uploadPOEncPartSign" {
-		tMap, err := APIstub.GetTransient()
+		tMap, err := s.keyProvider.GetTransient(APIstub)
 		if err != nil {
 			return shim.Error(fmt.Sprintf("Could not retrieve transient, err %s", err))
 		}
@@ -131,10 +194,10 @@ func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response
 		} else if _, in := tMap[SIGKEY]; !in {
 			return shim.Error(fmt.Sprintf("Expected transient key %s", SIGKEY))
 		}
-		return s.uploadPOEncrypt(APIstub, args, tMap[ENCKEY], tMap[SIGKEY], true, true)
+		return s.uploadPOEncrypt(APIstub, args, tMap[ENCKEY], tMap[SIGKEY], tMap[IDXKEY], true, true)
 
 	} else if function == "queryPODecPartVerify" {
-		tMap, err := APIstub.GetTransient()
+		tMap, err := s.keyProvider.GetTransient(APIstub)
 		if err != nil {
 			return shim.Error(fmt.Sprintf("Could not retrieve transient, err %s", err))
 		}
@@ -144,19 +207,28 @@ func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response
 			return shim.Error(fmt.Sprintf("Expected transient key %s", VERKEY))
 		}
 		return s.queryPODecrypt(APIstub, args, tMap[DECKEY], tMap[VERKEY], true, true)
+	} else if function == "queryPOByBlindIndex" {
+		tMap, err := s.keyProvider.GetTransient(APIstub)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("Could not retrieve transient, err %s", err))
+		}
+		if _, in := tMap[IDXKEY]; !in {
+			return shim.Error(fmt.Sprintf("Expected transient index key %s", IDXKEY))
+		}
+		return s.queryPOByBlindIndex(APIstub, args, tMap[IDXKEY])
 	} else
 	// chaincode common Encrypt
 	if function == "uploadEncAll" {
-		tMap, err := APIstub.GetTransient()
+		tMap, err := s.keyProvider.GetTransient(APIstub)
 		if err != nil {
 			return shim.Error(fmt.Sprintf("Could not retrieve transient, err %s", err))
 		}
 		if _, in := tMap[ENCKEY]; !in {
 			return shim.Error(fmt.Sprintf("Expected transient encryption key %s", ENCKEY))
 		}
-		return s.uploadEncrypt(APIstub, args, tMap[ENCKEY], tMap[IV])
+		return s.uploadEncrypt(APIstub, args, tMap[ENCKEY])
 	} else if function == "queryDecAll" {
-		tMap, err := APIstub.GetTransient()
+		tMap, err := s.keyProvider.GetTransient(APIstub)
 		if err != nil {
 			return shim.Error(fmt.Sprintf("Could not retrieve transient, err %s", err))
 		}
@@ -165,18 +237,38 @@ func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response
 		}
 		return s.queryDecrypt(APIstub, args, tMap[DECKEY], tMap[IV])
 	} else
+	// chaincode field level Encrypt
+	if function == "uploadEncFields" {
+		tMap, err := s.keyProvider.GetTransient(APIstub)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("Could not retrieve transient, err %s", err))
+		}
+		if _, in := tMap[ENCKEY]; !in {
+			return shim.Error(fmt.Sprintf("Expected transient encryption key %s", ENCKEY))
+		}
+		return s.uploadEncFields(APIstub, args, tMap[ENCKEY])
+	} else if function == "queryDecFields" {
+		tMap, err := s.keyProvider.GetTransient(APIstub)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("Could not retrieve transient, err %s", err))
+		}
+		if _, in := tMap[DECKEY]; !in {
+			return shim.Error(fmt.Sprintf("Expected transient decryption key %s", DECKEY))
+		}
+		return s.queryDecFields(APIstub, args, tMap[DECKEY], tMap[IV])
+	} else
 	// chaincode common batch Encrypt
 	if function == "uploadEncryptBatch" {
-		tMap, err := APIstub.GetTransient()
+		tMap, err := s.keyProvider.GetTransient(APIstub)
 		if err != nil {
 			return shim.Error(fmt.Sprintf("Could not retrieve transient, err %s", err))
 		}
 		if _, in := tMap[ENCKEY]; !in {
 			return shim.Error(fmt.Sprintf("Expected transient encryption key %s", ENCKEY))
 		}
-		return s.uploadEncryptBatch(APIstub, args, tMap[ENCKEY], tMap[IV])
+		return s.uploadEncryptBatch(APIstub, args, tMap[ENCKEY])
 	} else if function == "queryDecryptBatch" {
-		tMap, err := APIstub.GetTransient()
+		tMap, err := s.keyProvider.GetTransient(APIstub)
 		if err != nil {
 			return shim.Error(fmt.Sprintf("Could not retrieve transient, err %s", err))
 		}
@@ -184,6 +276,174 @@ func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response
 			return shim.Error(fmt.Sprintf("Expected transient decryption key %s", DECKEY))
 		}
 		return s.queryDecryptBatch(APIstub, args, tMap[DECKEY], tMap[IV])
+	} else if function == "queryDecryptHistory" {
+		tMap, err := s.keyProvider.GetTransient(APIstub)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("Could not retrieve transient, err %s", err))
+		}
+		if _, in := tMap[DECKEY]; !in {
+			return shim.Error(fmt.Sprintf("Expected transient decryption key %s", DECKEY))
+		}
+		return s.queryDecryptHistory(APIstub, args, tMap[DECKEY], tMap[IV])
+	} else if function == "queryDecryptByRange" {
+		tMap, err := s.keyProvider.GetTransient(APIstub)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("Could not retrieve transient, err %s", err))
+		}
+		if _, in := tMap[DECKEY]; !in {
+			return shim.Error(fmt.Sprintf("Expected transient decryption key %s", DECKEY))
+		}
+		return s.queryDecryptByRange(APIstub, args, tMap[DECKEY], tMap[IV])
+	} else
+
+	// encryption key rotation
+	if function == "reencrypt" {
+		tMap, err := s.keyProvider.GetTransient(APIstub)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("Could not retrieve transient, err %s", err))
+		}
+		if _, in := tMap[OLDKEY]; !in {
+			return shim.Error(fmt.Sprintf("Expected transient key %s", OLDKEY))
+		} else if _, in := tMap[NEWKEY]; !in {
+			return shim.Error(fmt.Sprintf("Expected transient key %s", NEWKEY))
+		}
+		return s.reencrypt(APIstub, args, tMap[OLDKEY], tMap[NEWKEY], tMap[IV])
+	} else if function == "queryRotation" {
+		return s.queryRotation(APIstub, args)
+	} else if function == "queryKeyIDs" {
+		return s.queryKeyIDs(APIstub, args)
+	} else if function == "queryKeyID" {
+		tMap, err := s.keyProvider.GetTransient(APIstub)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("Could not retrieve transient, err %s", err))
+		}
+		if _, in := tMap[ENCKEY]; !in {
+			return shim.Error(fmt.Sprintf("Expected transient encryption key %s", ENCKEY))
+		}
+		return s.queryKeyID(APIstub, tMap[ENCKEY])
+	} else if function == "setKeyLabelACL" {
+		return s.setKeyLabelACL(APIstub, args)
+	} else if function == "queryKeyLabelACL" {
+		return s.queryKeyLabelACL(APIstub, args)
+	} else
+
+	// multi-recipient encryption
+	if function == "registerRecipientKey" {
+		return s.registerRecipientKey(APIstub, args)
+	} else if function == "queryRecipientKey" {
+		return s.queryRecipientKey(APIstub, args)
+	} else if function == "uploadMultiEncrypt" {
+		tMap, err := s.keyProvider.GetTransient(APIstub)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("Could not retrieve transient, err %s", err))
+		}
+		if _, in := tMap[DATAKEY]; !in {
+			return shim.Error(fmt.Sprintf("Expected transient data key %s", DATAKEY))
+		}
+		return s.uploadMultiEncrypt(APIstub, args, tMap[DATAKEY])
+	} else if function == "queryMultiDecrypt" {
+		tMap, err := s.keyProvider.GetTransient(APIstub)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("Could not retrieve transient, err %s", err))
+		}
+		if _, in := tMap[PRIVKEY]; !in {
+			return shim.Error(fmt.Sprintf("Expected transient private key %s", PRIVKEY))
+		}
+		return s.queryMultiDecrypt(APIstub, args, tMap[PRIVKEY])
+	} else if function == "addRecipients" {
+		tMap, err := s.keyProvider.GetTransient(APIstub)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("Could not retrieve transient, err %s", err))
+		}
+		if _, in := tMap[PRIVKEY]; !in {
+			return shim.Error(fmt.Sprintf("Expected transient private key %s", PRIVKEY))
+		}
+		return s.addRecipients(APIstub, args, tMap[PRIVKEY])
+	} else if function == "revokeRecipients" {
+		return s.revokeRecipients(APIstub, args)
+	} else if function == "queryRecipients" {
+		return s.queryRecipients(APIstub, args)
+	} else
+
+	// key escrow
+	if function == "escrowDocumentKey" {
+		tMap, err := s.keyProvider.GetTransient(APIstub)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("Could not retrieve transient, err %s", err))
+		}
+		if _, in := tMap[ESCROWKEY]; !in {
+			return shim.Error(fmt.Sprintf("Expected transient escrow key %s", ESCROWKEY))
+		}
+		return s.escrowDocumentKey(APIstub, args, tMap[ESCROWKEY])
+	} else if function == "queryEscrow" {
+		return s.queryEscrow(APIstub, args)
+	} else if function == "queryEscrowShare" {
+		tMap, err := s.keyProvider.GetTransient(APIstub)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("Could not retrieve transient, err %s", err))
+		}
+		return s.queryEscrowShare(APIstub, args, tMap[PRIVKEY])
+	} else if function == "recoverEscrowKey" {
+		tMap, err := s.keyProvider.GetTransient(APIstub)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("Could not retrieve transient, err %s", err))
+		}
+		if _, in := tMap[SHARES]; !in {
+			return shim.Error(fmt.Sprintf("Expected transient shares %s", SHARES))
+		}
+		return s.recoverEscrowKey(APIstub, args, tMap[SHARES])
+	} else if function == "releaseEscrowKey" {
+		tMap, err := s.keyProvider.GetTransient(APIstub)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("Could not retrieve transient, err %s", err))
+		}
+		if _, in := tMap[SHARES]; !in {
+			return shim.Error(fmt.Sprintf("Expected transient shares %s", SHARES))
+		}
+		if _, in := tMap[RESPKEY]; !in {
+			return shim.Error(fmt.Sprintf("Expected transient response key %s", RESPKEY))
+		}
+		return s.releaseEscrowKey(APIstub, args, tMap[SHARES], tMap[RESPKEY])
+	} else
+
+	// chaincode configuration
+	if function == "setConfig" {
+		return s.setConfig(APIstub, args)
+	} else if function == "queryConfig" {
+		return s.queryConfig(APIstub, args)
+	} else if function == "queryEnvelope" {
+		return s.queryEnvelope(APIstub, args)
+	} else if function == "exportState" {
+		return s.exportState(APIstub, args)
+	} else if function == "importState" {
+		return s.importState(APIstub, args)
+	} else if function == "approveImport" {
+		return s.approveImport(APIstub, args)
+	} else
+
+	// conflict-free counters
+	if function == "createCounter" {
+		return s.createCounter(APIstub, args)
+	} else if function == "incrementCounter" {
+		return s.incrementCounter(APIstub, args)
+	} else if function == "queryCounter" {
+		return s.queryCounter(APIstub, args)
+	} else if function == "compactCounter" {
+		return s.compactCounter(APIstub, args)
+	} else
+
+	// document signatures
+	if function == "signDocument" {
+		return s.signDocument(APIstub, args)
+	} else if function == "verifyDocumentSignature" {
+		return s.verifyDocumentSignature(APIstub, args)
+	} else
+
+	// notarization of off-chain documents
+	if function == "anchorDocument" {
+		return s.anchorDocument(APIstub, args)
+	} else if function == "verifyDocument" {
+		return s.verifyDocument(APIstub, args)
 	} else
 
 	// key level endorsement policy
@@ -195,6 +455,36 @@ func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response
 		return s.kepListOrgs(APIstub, args)
 	} else if function == "delKEP" {
 		return s.delKEP(APIstub, args)
+	} else if function == "kepAddDocOrgs" {
+		return s.kepAddDocOrgs(APIstub, args)
+	} else if function == "kepDelDocOrgs" {
+		return s.kepDelDocOrgs(APIstub, args)
+	} else if function == "kepListDocOrgs" {
+		return s.kepListDocOrgs(APIstub, args)
+	} else if function == "delDocKEP" {
+		return s.delDocKEP(APIstub, args)
+	} else if function == "kepSetPolicy" {
+		return s.kepSetPolicy(APIstub, args)
+	} else if function == "kepQueryPolicy" {
+		return s.kepQueryPolicy(APIstub, args)
+	} else if function == "kepAddPrivateOrgs" {
+		return s.kepAddPrivateOrgs(APIstub, args)
+	} else if function == "kepDelPrivateOrgs" {
+		return s.kepDelPrivateOrgs(APIstub, args)
+	} else if function == "kepListPrivateOrgs" {
+		return s.kepListPrivateOrgs(APIstub, args)
+	} else if function == "delPrivateKEP" {
+		return s.delPrivateKEP(APIstub, args)
+	} else if function == "registerParty" {
+		return s.registerParty(APIstub, args)
+	} else if function == "removeParty" {
+		return s.removeParty(APIstub, args)
+	} else if function == "approvePartyOverride" {
+		return s.approvePartyOverride(APIstub, args)
+	} else if function == "overrideParty" {
+		return s.overrideParty(APIstub, args)
+	} else if function == "queryParty" {
+		return s.queryParty(APIstub, args)
 	} else
 
 	// private data
@@ -213,8 +503,14 @@ func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response
 func main() {
 	factory.InitFactories(nil)
 
+	keyProvider, err := newKeyProvider()
+	if err != nil {
+		logger.Errorf("Error creating key provider: %s", err)
+		return
+	}
+
 	// Create a new Smart Contract
-	err := shim.Start(&SmartContract{factory.GetDefault()})
+	err = shim.Start(&SmartContract{factory.GetDefault(), keyProvider})
 	if err != nil {
 		logger.Errorf("Error creating new Smart Contract: %s", err)
 	}
@@ -65,9 +65,13 @@ func (s *SmartContract) writeChainPO(APIstub shim.ChaincodeStubInterface, po PO)
 	if err != nil {
 		return err
 	}
-	logger.Debug("Write PO on chain: " + string(poAsBytes))
+	logger.Debugf("Write PO on chain: %s", redactDocument(poAsBytes))
 	poKey := poPrefix + po.PoNo
-	err = APIstub.PutState(poKey, poAsBytes)
+	err = s.setPartyKEP(kepStore{stub: APIstub}, DocTypePO, poKey, po)
+	if err != nil {
+		return err
+	}
+	err = s.putState(APIstub, DocTypePO, poKey, poAsBytes)
 	if err != nil {
 		return err
 	}
@@ -80,7 +84,7 @@ func (s *SmartContract) uploadPO(APIstub shim.ChaincodeStubInterface, args []str
 		return s.returnError("参数数量不正确")
 	}
 
-	logger.Debug("获取请求参数: " + args[0])
+	logger.Debugf("获取请求参数: %s", redactDocument([]byte(args[0])))
 
 	poAsBytes := []byte(args[0])
 	var po PO
@@ -113,7 +117,7 @@ func (s *SmartContract) queryPO(APIstub shim.ChaincodeStubInterface, args []stri
 	po := args[0]
 	logger.Debug("Query PO on chain: " + po)
 	poKey := poPrefix + po
-	result, err := APIstub.GetState(poKey)
+	result, err := s.getState(APIstub, poKey)
 	if err != nil {
 		return s.returnError("po单查询失败" + err.Error())
 	}
@@ -122,14 +126,19 @@ func (s *SmartContract) queryPO(APIstub shim.ChaincodeStubInterface, args []stri
 
 func (s *SmartContract) queryPOHistory(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
 
-	if len(args) != 1 {
+	if len(args) < 1 || len(args) > 6 {
 		return s.returnError("参数数量不正确")
 	}
 
+	opts, err := parseHistoryOptions(args[1:])
+	if err != nil {
+		return s.returnError("历史查询参数错误: " + err.Error())
+	}
+
 	po := args[0]
 	logger.Debug("Query on chain: " + po)
 	poKey := poPrefix + po
-	result, err := s.queryHistoryAsset(APIstub, poKey)
+	result, err := s.queryHistoryAsset(APIstub, poKey, opts)
 	if err != nil {
 		return s.returnError("po单查询失败" + err.Error())
 	}
@@ -143,7 +152,7 @@ func (s *SmartContract) richQueryPO(APIstub shim.ChaincodeStubInterface, args []
 		// rich query without pagination
 		queryString := args[0]
 		logger.Debug("Rich query on chain: " + queryString)
-		result, err := s.richQuery(APIstub, queryString)
+		result, err := s.richQuery(APIstub, queryString, nil)
 		if err != nil {
 			return s.returnError("Rich query failed: " + err.Error())
 		}
@@ -160,7 +169,7 @@ func (s *SmartContract) richQueryPO(APIstub shim.ChaincodeStubInterface, args []
 		bookmark := args[2]
 		logger.Debugf("Rich query %s with pagination ( page size %s, bookmark %s )",
 			queryString, pageSize, bookmark)
-		result, err := s.richQueryWithPagination(APIstub, queryString, int32(pageSize), bookmark)
+		result, err := s.richQueryWithPagination(APIstub, queryString, int32(pageSize), bookmark, nil)
 		if err != nil {
 			return s.returnError("Rich query failed: " + err.Error())
 		}
@@ -171,17 +180,24 @@ func (s *SmartContract) richQueryPO(APIstub shim.ChaincodeStubInterface, args []
 	}
 }
 
-func (s *SmartContract) richQuery(stub shim.ChaincodeStubInterface, queryString string) ([] byte, error) {
+// keyFilter tells whether a query result is left out
+type keyFilter func(key string) (bool, error)
+
+func (s *SmartContract) richQuery(stub shim.ChaincodeStubInterface, queryString string, skip keyFilter) ([] byte, error) {
 
 	logger.Debugf("Get rich query request: \n%s\n", queryString)
 
+	queryString, err := envelopeQuery(queryString)
+	if err != nil {
+		return nil, err
+	}
 	resultsIterator, err := stub.GetQueryResult(queryString)
-	defer resultsIterator.Close()
 	if err != nil {
 		return nil, err
 	}
+	defer resultsIterator.Close()
 
-	buffer, err := constructQueryResponseFromIterator(resultsIterator)
+	buffer, err := constructQueryResponseFromIterator(resultsIterator, skip)
 	if err != nil {
 		return nil, err
 	}
@@ -190,9 +206,9 @@ func (s *SmartContract) richQuery(stub shim.ChaincodeStubInterface, queryString
 }
 
 func (s *SmartContract) richQueryWithPagination(stub shim.ChaincodeStubInterface,
-	queryString string, pageSize int32, bookmark string) ([] byte, error) {
+	queryString string, pageSize int32, bookmark string, skip keyFilter) ([] byte, error) {
 
-	queryResults, err := getQueryResultForQueryStringWithPagination(stub, queryString, int32(pageSize), bookmark)
+	queryResults, err := getQueryResultForQueryStringWithPagination(stub, queryString, int32(pageSize), bookmark, skip)
 	if err != nil {
 		return nil, err
 	}
@@ -200,29 +216,34 @@ func (s *SmartContract) richQueryWithPagination(stub shim.ChaincodeStubInterface
 }
 
 func getQueryResultForQueryStringWithPagination(stub shim.ChaincodeStubInterface,
-	queryString string, pageSize int32, bookmark string) ([]byte, error) {
+	queryString string, pageSize int32, bookmark string, skip keyFilter) ([]byte, error) {
 
 	logger.Debugf("- getQueryResultForQueryString queryString:\n%s\n", queryString)
 
+	queryString, err := envelopeQuery(queryString)
+	if err != nil {
+		return nil, err
+	}
 	resultsIterator, responseMetadata, err := stub.GetQueryResultWithPagination(queryString, pageSize, bookmark)
 	if err != nil {
 		return nil, err
 	}
 	defer resultsIterator.Close()
 
-	buffer, err := constructQueryResponseFromIterator(resultsIterator)
+	buffer, err := constructQueryResponseFromIterator(resultsIterator, skip)
 	if err != nil {
 		return nil, err
 	}
 
 	bufferWithPaginationInfo := addPaginationMetadataToQueryResults(buffer, responseMetadata)
 
-	logger.Debugf("- getQueryResultForQueryString queryResult:\n%s\n", bufferWithPaginationInfo.String())
+	logger.Debugf("- getQueryResultForQueryString queryResult:\n%s\n", redactDocument(bufferWithPaginationInfo.Bytes()))
 
 	return buffer.Bytes(), nil
 }
 
-func constructQueryResponseFromIterator(resultsIterator shim.StateQueryIteratorInterface) (*bytes.Buffer, error) {
+func constructQueryResponseFromIterator(resultsIterator shim.StateQueryIteratorInterface,
+	skip keyFilter) (*bytes.Buffer, error) {
 	// buffer is a JSON array containing QueryResults
 	var buffer bytes.Buffer
 	buffer.WriteString("[")
@@ -233,6 +254,15 @@ func constructQueryResponseFromIterator(resultsIterator shim.StateQueryIteratorI
 		if err != nil {
 			return nil, err
 		}
+		if skip != nil {
+			skipped, err := skip(queryResponse.Key)
+			if err != nil {
+				return nil, err
+			}
+			if skipped {
+				continue
+			}
+		}
 		// Add a comma before array members, suppress it for the first array member
 		if bArrayMemberAlreadyWritten == true {
 			buffer.WriteString(",")
@@ -244,7 +274,8 @@ func constructQueryResponseFromIterator(resultsIterator shim.StateQueryIteratorI
 
 		buffer.WriteString(", \"Record\":")
 		// Record is a JSON object, so we write as-is
-		buffer.WriteString(string(queryResponse.Value))
+		_, value := decodeEnvelope(queryResponse.Value)
+		buffer.WriteString(string(value))
 		buffer.WriteString("}")
 		bArrayMemberAlreadyWritten = true
 	}
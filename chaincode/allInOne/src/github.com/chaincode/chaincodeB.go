@@ -47,9 +47,13 @@ func (s *SmartContract) writeChainManifest(APIstub shim.ChaincodeStubInterface,
 	if err != nil {
 		return err
 	}
-	logger.Debug("Write manifest on chain: " + string(manifestAsBytes))
+	logger.Debugf("Write manifest on chain: %s", redactDocument(manifestAsBytes))
 	manifestKey := manifestPrefix + manifest.MasterBillNo
-	err = APIstub.PutState(manifestKey, manifestAsBytes)
+	err = s.setPartyKEP(kepStore{stub: APIstub}, DocTypeManifest, manifestKey, manifest)
+	if err != nil {
+		return err
+	}
+	err = s.putState(APIstub, DocTypeManifest, manifestKey, manifestAsBytes)
 	if err != nil {
 		return err
 	}
@@ -62,7 +66,7 @@ func (s *SmartContract) uploadManifest(APIstub shim.ChaincodeStubInterface, args
 		return s.returnError("参数数量不正确")
 	}
 
-	logger.Debug("获取请求参数: " + args[0])
+	logger.Debugf("获取请求参数: %s", redactDocument([]byte(args[0])))
 
 	manifestAsBytes := []byte(args[0])
 	var manifest Manifest
@@ -95,7 +99,7 @@ func (s *SmartContract) queryManifest(APIstub shim.ChaincodeStubInterface, args
 	masterBillNo := args[0]
 	logger.Debug("Query manifest on chain: " + masterBillNo)
 	manifestKey := manifestPrefix + masterBillNo
-	result, err := APIstub.GetState(manifestKey)
+	result, err := s.getState(APIstub, manifestKey)
 	if err != nil {
 		return s.returnError("主舱单查询失败" + err.Error())
 	}
@@ -104,14 +108,19 @@ func (s *SmartContract) queryManifest(APIstub shim.ChaincodeStubInterface, args
 
 func (s *SmartContract) queryManifestHistory(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
 
-	if len(args) != 1 {
+	if len(args) < 1 || len(args) > 6 {
 		return s.returnError("参数数量不正确")
 	}
 
+	opts, err := parseHistoryOptions(args[1:])
+	if err != nil {
+		return s.returnError("历史查询参数错误: " + err.Error())
+	}
+
 	masterBillNo := args[0]
 	logger.Debug("Query history on chain: " + masterBillNo)
 	manifestKey := manifestPrefix + masterBillNo
-	result, err := s.queryHistoryAsset(APIstub, manifestKey)
+	result, err := s.queryHistoryAsset(APIstub, manifestKey, opts)
 	if err != nil {
 		return s.returnError("主舱单查询失败" + err.Error())
 	}
@@ -125,7 +134,7 @@ func (s *SmartContract) richQueryManifest(APIstub shim.ChaincodeStubInterface, a
 		// rich query without pagination
 		queryString := args[0]
 		logger.Debug("Rich query on chain: " + queryString)
-		result, err := s.richQuery(APIstub, queryString)
+		result, err := s.richQuery(APIstub, queryString, nil)
 		if err != nil {
 			return s.returnError("Rich query failed: " + err.Error())
 		}
@@ -142,7 +151,7 @@ func (s *SmartContract) richQueryManifest(APIstub shim.ChaincodeStubInterface, a
 		bookmark := args[2]
 		logger.Debugf("Rich query %s with pagination ( page size %s, bookmark %s )",
 			queryString, pageSize, bookmark)
-		result, err := s.richQueryWithPagination(APIstub, queryString, int32(pageSize), bookmark)
+		result, err := s.richQueryWithPagination(APIstub, queryString, int32(pageSize), bookmark, nil)
 		if err != nil {
 			return s.returnError("Rich query failed: " + err.Error())
 		}
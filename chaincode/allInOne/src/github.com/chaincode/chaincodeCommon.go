@@ -2,10 +2,16 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"github.com/golang/protobuf/ptypes"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	sc "github.com/hyperledger/fabric/protos/peer"
 	"strconv"
+	"strings"
+	"time"
 )
 
 var commonPrefix = ""
@@ -16,32 +22,153 @@ type Data struct {
 }
 
 type History struct {
-	TxId      string `json:"txId"`
-	Value     string `json:"value"`
-	Timestamp string `json:"timestamp"`
-	IsDelete  bool   `json:"isDelete"`
+	TxId      string          `json:"txId"`
+	Value     json.RawMessage `json:"value"`
+	Timestamp string          `json:"timestamp"`
+	IsDelete  bool            `json:"isDelete"`
+	// only set for values written with an envelope
+	Meta *EnvelopeMeta `json:"meta,omitempty"`
+	// only set if the value could not be decoded
+	Error string `json:"error,omitempty"`
+	// set if the value expired, it is returned as null
+	Expired bool `json:"expired,omitempty"`
 }
 
+// valueDecoder turns a stored bare value into the value returned to the client
+type valueDecoder func(value []byte) (json.RawMessage, error)
+
 func (s *SmartContract) uploadCommon(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
 
-	if len(args) != 2 {
-		return s.returnError("Wrong number of parameters, need key & value")
+	if len(args) != 2 && len(args) != 3 {
+		return s.returnError("Wrong number of parameters, need key, value & optional expiry timestamp (RFC3339)")
 	}
 
-	logger.Debugf("Got request parameters: [key] %s, [value] %s", args[0], args[1])
+	logger.Debugf("Got request parameters: [key] %s, [value] %s", args[0], redactDocument([]byte(args[1])))
 
 	key := args[0]
 	valueAsByte := []byte(args[1])
+	expiresAt := ""
+	if len(args) == 3 {
+		expiresAt = args[2]
+	}
 
-	logger.Debug("Write value on chain: " + string(valueAsByte))
+	logger.Debugf("Write value on chain: %s", redactDocument(valueAsByte))
 	commonKey := commonPrefix + key
-	err := APIstub.PutState(commonKey, valueAsByte)
+	err := s.putState(APIstub, DocTypeCommon, commonKey, valueAsByte)
+	if err != nil {
+		return s.returnError("Data write to chain failed: " + err.Error())
+	}
+
+	// a value written without expiry replaces an expiring one
+	err = s.writeExpiry(APIstub, commonKey, expiresAt)
+	if err != nil {
+		return s.returnError("Expiry write to chain failed: " + err.Error())
+	}
+
+	return shim.Success(nil)
+
+}
+
+// valueHash returns the hex encoded SHA-256 of the stored bytes, which is the
+// expected hash of the conditional write functions. An envelope is not part
+// of the hashed value.
+func valueHash(value []byte) string {
+	hash := sha256.Sum256(value)
+	return hex.EncodeToString(hash[:])
+}
+
+func (s *SmartContract) uploadCommonIfAbsent(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 {
+		return s.returnError("Wrong number of parameters, need key & value")
+	}
+
+	logger.Debugf("Got request parameters: [key] %s, [value] %s", args[0], redactDocument([]byte(args[1])))
+
+	commonKey := commonPrefix + args[0]
+	current, err := s.getCommonState(APIstub, commonKey)
+	if err != nil {
+		return s.returnError("Query failed: " + err.Error())
+	}
+	if current != nil {
+		return s.returnConflict("Key " + args[0] + " already exists")
+	}
+
+	err = s.putState(APIstub, DocTypeCommon, commonKey, []byte(args[1]))
+	if err != nil {
+		return s.returnError("Data write to chain failed: " + err.Error())
+	}
+	err = s.writeExpiry(APIstub, commonKey, "")
+	if err != nil {
+		return s.returnError("Expiry write to chain failed: " + err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+func (s *SmartContract) uploadCommonIfMatch(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 3 {
+		return s.returnError("Wrong number of parameters, need key, expected value hash & value")
+	}
+
+	logger.Debugf("Got request parameters: [key] %s, [expected hash] %s, [value] %s", args[0], args[1],
+		redactDocument([]byte(args[2])))
+
+	commonKey := commonPrefix + args[0]
+	current, err := s.getCommonState(APIstub, commonKey)
+	if err != nil {
+		return s.returnError("Query failed: " + err.Error())
+	}
+	if current == nil {
+		return s.returnConflict("Key " + args[0] + " does not exist")
+	}
+	if valueHash(current) != strings.ToLower(args[1]) {
+		return s.returnConflict("Value hash of key " + args[0] + " does not match")
+	}
+
+	err = s.putState(APIstub, DocTypeCommon, commonKey, []byte(args[2]))
 	if err != nil {
 		return s.returnError("Data write to chain failed: " + err.Error())
 	}
+	err = s.writeExpiry(APIstub, commonKey, "")
+	if err != nil {
+		return s.returnError("Expiry write to chain failed: " + err.Error())
+	}
 
 	return shim.Success(nil)
+}
+
+func (s *SmartContract) deleteCommonIfMatch(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
 
+	if len(args) != 2 {
+		return s.returnError("Wrong number of parameters, need key & expected value hash")
+	}
+
+	logger.Debugf("Got request parameters: [key] %s, [expected hash] %s", args[0], args[1])
+
+	commonKey := commonPrefix + args[0]
+	current, err := s.getCommonState(APIstub, commonKey)
+	if err != nil {
+		return s.returnError("Query failed: " + err.Error())
+	}
+	if current == nil {
+		return s.returnConflict("Key " + args[0] + " does not exist")
+	}
+	if valueHash(current) != strings.ToLower(args[1]) {
+		return s.returnConflict("Value hash of key " + args[0] + " does not match")
+	}
+
+	err = APIstub.DelState(commonKey)
+	if err != nil {
+		return s.returnError("Data delete failed: " + err.Error())
+	}
+	err = s.writeExpiry(APIstub, commonKey, "")
+	if err != nil {
+		return s.returnError("Expiry delete failed: " + err.Error())
+	}
+
+	return shim.Success(nil)
 }
 
 func (s *SmartContract) queryCommon(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
@@ -53,7 +180,7 @@ func (s *SmartContract) queryCommon(APIstub shim.ChaincodeStubInterface, args []
 	key := args[0]
 	logger.Debug("Query common on chain: " + key)
 	commonKey := commonPrefix + key
-	result, err := APIstub.GetState(commonKey)
+	result, err := s.getCommonState(APIstub, commonKey)
 	if err != nil {
 		return s.returnError("Query failed: " + err.Error())
 	}
@@ -64,19 +191,36 @@ func (s *SmartContract) batchUploadCommon(APIstub shim.ChaincodeStubInterface, a
 
 	logger.Debugf("Got %d args for bach upload.", len(args))
 
+	var keys []string
+	var values [][]byte
 	for _, arg := range args {
 		var batchData Data
 		json.Unmarshal([]byte(arg), &batchData)
 		key := batchData.Key
 		valueAsByte := []byte(batchData.Value)
 
-		logger.Debugf("Write [key] %s [value] %s on chain: ", key, string(valueAsByte))
-		err := APIstub.PutState(key, valueAsByte)
+		logger.Debugf("Write [key] %s [value] %s on chain: ", key, redactDocument(valueAsByte))
+		err := s.putState(APIstub, DocTypeCommon, key, valueAsByte)
 		if err != nil {
 			return shim.Error("Data [key] " + key + " write to chain failed: " + err.Error())
 		}
+		err = s.writeExpiry(APIstub, key, "")
+		if err != nil {
+			return shim.Error("Expiry [key] " + key + " write to chain failed: " + err.Error())
+		}
+		keys = append(keys, key)
+		values = append(values, valueAsByte)
 	}
-	return shim.Success(nil)
+
+	batchRoot, err := s.writeBatchRoot(APIstub, keys, values)
+	if err != nil {
+		return shim.Error("Batch root write to chain failed: " + err.Error())
+	}
+	batchRootAsBytes, err := json.Marshal(batchRoot)
+	if err != nil {
+		return shim.Error("Marshal batch root failed: " + err.Error())
+	}
+	return shim.Success(batchRootAsBytes)
 }
 
 func (s *SmartContract) batchQueryCommon(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
@@ -86,7 +230,7 @@ func (s *SmartContract) batchQueryCommon(APIstub shim.ChaincodeStubInterface, ar
 	var batch []Data
 	for _, key := range args {
 		logger.Debug("Query common on chain: " + key)
-		valueAsByte, err := APIstub.GetState(key)
+		valueAsByte, err := s.getCommonState(APIstub, key)
 		if err != nil {
 			return s.returnError("Query failed: " + err.Error())
 		}
@@ -106,14 +250,20 @@ func (s *SmartContract) batchQueryCommon(APIstub shim.ChaincodeStubInterface, ar
 
 func (s *SmartContract) queryCommonHistory(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
 
-	if len(args) != 1 {
-		return s.returnError("Wrong number of parameters, need query key")
+	if len(args) < 1 || len(args) > 6 {
+		return s.returnError("Wrong number of parameters, need query key and optional from, to, limit, order " +
+			"& bookmark")
+	}
+
+	opts, err := parseHistoryOptions(args[1:])
+	if err != nil {
+		return s.returnError("Wrong history options: " + err.Error())
 	}
 
 	key := args[0]
 	logger.Debug("Query history on chain: " + key)
 	commonKey := commonPrefix + key
-	result, err := s.queryHistoryAsset(APIstub, commonKey)
+	result, err := s.queryHistoryAsset(APIstub, commonKey, opts)
 	if err != nil {
 		return s.returnError("Query failed: " + err.Error())
 	}
@@ -127,7 +277,7 @@ func (s *SmartContract) richQueryCommon(APIstub shim.ChaincodeStubInterface, arg
 		// rich query without pagination
 		queryString := args[0]
 		logger.Debug("Rich query on chain: " + queryString)
-		result, err := s.richQuery(APIstub, queryString)
+		result, err := s.richQuery(APIstub, queryString, s.skipExpired(APIstub))
 		if err != nil {
 			return s.returnError("Rich query failed: " + err.Error())
 		}
@@ -144,7 +294,8 @@ func (s *SmartContract) richQueryCommon(APIstub shim.ChaincodeStubInterface, arg
 		bookmark := args[2]
 		logger.Debugf("Rich query %s with pagination ( page size %s, bookmark %s )",
 			queryString, pageSize, bookmark)
-		result, err := s.richQueryWithPagination(APIstub, queryString, int32(pageSize), bookmark)
+		result, err := s.richQueryWithPagination(APIstub, queryString, int32(pageSize), bookmark,
+			s.skipExpired(APIstub))
 		if err != nil {
 			return s.returnError("Rich query failed: " + err.Error())
 		}
@@ -156,14 +307,109 @@ func (s *SmartContract) richQueryCommon(APIstub shim.ChaincodeStubInterface, arg
 	}
 }
 
-func (s *SmartContract) queryHistoryAsset(stub shim.ChaincodeStubInterface, key string) ([]byte, error) {
+// txTimestamp returns the transaction timestamp of the proposal, which is the
+// same on every endorser unlike the wall clock.
+func txTimestamp(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return ptypes.Timestamp(ts)
+}
+
+// HistoryOptions limits a history query to a time window, a maximum number of
+// records and an order. Zero values mean no bound, no limit and oldest first.
+// A page of a limited query continues after the record with the bookmark
+// txId, pass the txId of the last record returned to get the next page.
+type HistoryOptions struct {
+	From     time.Time
+	To       time.Time
+	Limit    int
+	Desc     bool
+	Bookmark string
+}
+
+// parseHistoryOptions reads the optional history arguments
+// [from, to, limit, order, bookmark] where from & to are RFC3339 timestamps,
+// limit is the maximum record count, order is "asc" or "desc" and bookmark is
+// the txId of the last record of the previous page. Empty strings are treated
+// as not set.
+func parseHistoryOptions(args []string) (HistoryOptions, error) {
+	var opts HistoryOptions
+	if len(args) > 5 {
+		return opts, errors.New("too many history options, need [from, to, limit, order, bookmark]")
+	}
+
+	var err error
+	if len(args) > 0 && args[0] != "" {
+		opts.From, err = time.Parse(time.RFC3339Nano, args[0])
+		if err != nil {
+			return opts, errors.New("invalid from timestamp: " + err.Error())
+		}
+	}
+	if len(args) > 1 && args[1] != "" {
+		opts.To, err = time.Parse(time.RFC3339Nano, args[1])
+		if err != nil {
+			return opts, errors.New("invalid to timestamp: " + err.Error())
+		}
+	}
+	if len(args) > 2 && args[2] != "" {
+		opts.Limit, err = strconv.Atoi(args[2])
+		if err != nil || opts.Limit < 0 {
+			return opts, errors.New("invalid limit: " + args[2])
+		}
+	}
+	if len(args) > 3 && args[3] != "" {
+		switch args[3] {
+		case "asc":
+			opts.Desc = false
+		case "desc":
+			opts.Desc = true
+		default:
+			return opts, errors.New("invalid order (need 'asc' or 'desc'): " + args[3])
+		}
+	}
+	if len(args) > 4 {
+		opts.Bookmark = args[4]
+	}
+	if !opts.From.IsZero() && !opts.To.IsZero() && opts.From.After(opts.To) {
+		return opts, errors.New("from timestamp is after to timestamp")
+	}
+	return opts, nil
+}
+
+// historyValue returns the stored value as embedded JSON if it is valid JSON,
+// otherwise as a JSON string. Deleted values are returned as null.
+func historyValue(value []byte) json.RawMessage {
+	if len(value) == 0 {
+		return json.RawMessage("null")
+	}
+	if json.Valid(value) {
+		return json.RawMessage(value)
+	}
+	valueAsBytes, _ := json.Marshal(string(value))
+	return json.RawMessage(valueAsBytes)
+}
+
+// getHistory returns the history of a key, values are decoded with decode or
+// returned as stored if it is nil. Expired values are returned as null.
+func (s *SmartContract) getHistory(stub shim.ChaincodeStubInterface, key string,
+	opts HistoryOptions, decode valueDecoder) ([]History, error) {
+
+	hidden, err := s.hiddenBefore(stub, key)
+	if err != nil {
+		return nil, err
+	}
+
 	historyIter, err := stub.GetHistoryForKey(key)
 	if err != nil {
 		return nil, err
 	}
 	defer historyIter.Close()
 
-	var historyArray []History
+	historyArray := []History{}
+	// an ascending query skips the records up to the bookmark right away
+	pastBookmark := opts.Desc || opts.Bookmark == ""
 
 	for historyIter.HasNext() {
 		historyItem, err := historyIter.Next()
@@ -171,13 +417,84 @@ func (s *SmartContract) queryHistoryAsset(stub shim.ChaincodeStubInterface, key
 			return nil, err
 		}
 
+		txTime, err := ptypes.Timestamp(historyItem.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+		if !opts.From.IsZero() && txTime.Before(opts.From) {
+			continue
+		}
+		if !opts.To.IsZero() && txTime.After(opts.To) {
+			continue
+		}
+		if !pastBookmark {
+			pastBookmark = historyItem.TxId == opts.Bookmark
+			continue
+		}
+
 		var history History
 		history.TxId = historyItem.TxId
-		history.Timestamp = historyItem.Timestamp.String()
-		history.Value = string(historyItem.Value)
+		history.Timestamp = txTime.UTC().Format(time.RFC3339Nano)
+		envelope, value := decodeEnvelope(historyItem.Value)
+		if !historyItem.IsDelete && txTime.Before(hidden) {
+			history.Value = json.RawMessage("null")
+			history.Expired = true
+		} else if decode != nil && !historyItem.IsDelete {
+			history.Value, err = decode(value)
+			if err != nil {
+				history.Value = json.RawMessage("null")
+				history.Error = err.Error()
+			}
+		} else {
+			history.Value = historyValue(value)
+		}
+		if envelope.Version > 0 {
+			history.Meta = &envelope.EnvelopeMeta
+		}
 		history.IsDelete = historyItem.IsDelete
 
 		historyArray = append(historyArray, history)
+
+		// records come oldest first, so an ascending query can stop early
+		if !opts.Desc && opts.Limit > 0 && len(historyArray) == opts.Limit {
+			break
+		}
+	}
+
+	if !pastBookmark {
+		return nil, errors.New("bookmark " + opts.Bookmark + " not found")
+	}
+	if opts.Desc {
+		for i, j := 0, len(historyArray)-1; i < j; i, j = i+1, j-1 {
+			historyArray[i], historyArray[j] = historyArray[j], historyArray[i]
+		}
+		if opts.Bookmark != "" {
+			found := false
+			for i, history := range historyArray {
+				if history.TxId == opts.Bookmark {
+					historyArray = historyArray[i+1:]
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, errors.New("bookmark " + opts.Bookmark + " not found")
+			}
+		}
+		if opts.Limit > 0 && len(historyArray) > opts.Limit {
+			historyArray = historyArray[:opts.Limit]
+		}
+	}
+
+	return historyArray, nil
+}
+
+func (s *SmartContract) queryHistoryAsset(stub shim.ChaincodeStubInterface, key string,
+	opts HistoryOptions) ([]byte, error) {
+
+	historyArray, err := s.getHistory(stub, key, opts, nil)
+	if err != nil {
+		return nil, err
 	}
 
 	historyAsByte, err := json.Marshal(historyArray)
@@ -185,12 +502,11 @@ func (s *SmartContract) queryHistoryAsset(stub shim.ChaincodeStubInterface, key
 		return nil, err
 	}
 
-	logger.Debugf("getHistory returning:\n%s\n", string(historyAsByte))
+	logger.Debugf("getHistory returning:\n%s\n", redactDocument(historyAsByte))
 
 	return historyAsByte, nil
 }
 
-
 func (s *SmartContract) queryCommonByRange(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
 	if len(args) != 2 {
 		return s.returnError("Wrong number of parameters, need start startKey and end startKey for query")
@@ -213,10 +529,18 @@ func (s *SmartContract) queryCommonByRange(APIstub shim.ChaincodeStubInterface,
 		if err != nil {
 			return s.returnError("Fetch next result failed: " + err.Error())
 		}
+		expired, err := s.isExpired(APIstub, queryResultItem.Key)
+		if err != nil {
+			return s.returnError("Query expiry failed: " + err.Error())
+		}
+		if expired {
+			continue
+		}
 
+		_, value := decodeEnvelope(queryResultItem.Value)
 		var queryResult Data
 		queryResult.Key = queryResultItem.Key
-		queryResult.Value = string(queryResultItem.Value)
+		queryResult.Value = string(value)
 		queryResultArray = append(queryResultArray, queryResult)
 	}
 
@@ -226,7 +550,7 @@ func (s *SmartContract) queryCommonByRange(APIstub shim.ChaincodeStubInterface,
 	}
 
 	logger.Debugf("Data range queried successfully: [start key] %s, [end key] %s, [value] %s",
-		startKey, endKey, string(queryResultBytes))
+		startKey, endKey, redactDocument(queryResultBytes))
 
 	return shim.Success(queryResultBytes)
 }
@@ -0,0 +1,260 @@
+// Written by Xu Chen Hao
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+	"strconv"
+)
+
+const chunkIndex = "chunk"
+const chunkManifestIndex = "chunkManifest"
+
+// default size of one chunk in bytes
+const defaultChunkSize = 64 * 1024
+
+// smallest chunk size in bytes, so that a value can't be spread over a huge
+// number of keys
+const minChunkSize = 1024
+
+type ChunkManifest struct {
+	Key         string   `json:"key"`
+	Size        int      `json:"size"`
+	ChunkSize   int      `json:"chunkSize"`
+	ChunkCount  int      `json:"chunkCount"`
+	ChunkHashes []string `json:"chunkHashes"`
+	Hash        string   `json:"hash"`
+}
+
+func chunkKey(stub shim.ChaincodeStubInterface, key string, index int) (string, error) {
+	return stub.CreateCompositeKey(chunkIndex, []string{key, fmt.Sprintf("%08d", index)})
+}
+
+func (s *SmartContract) readChunkManifest(stub shim.ChaincodeStubInterface, key string) (*ChunkManifest, error) {
+	manifestKey, err := stub.CreateCompositeKey(chunkManifestIndex, []string{key})
+	if err != nil {
+		return nil, err
+	}
+	manifestAsBytes, err := stub.GetState(manifestKey)
+	if err != nil {
+		return nil, err
+	}
+	if manifestAsBytes == nil {
+		return nil, nil
+	}
+	var manifest ChunkManifest
+	err = json.Unmarshal(manifestAsBytes, &manifest)
+	if err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// deleteChunks deletes the chunks of key with index in [from, count)
+func (s *SmartContract) deleteChunks(stub shim.ChaincodeStubInterface, key string, from, count int) error {
+	for i := from; i < count; i++ {
+		ck, err := chunkKey(stub, key, i)
+		if err != nil {
+			return err
+		}
+		err = stub.DelState(ck)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SmartContract) writeChainChunked(stub shim.ChaincodeStubInterface, key string,
+	value []byte, chunkSize int) (*ChunkManifest, error) {
+
+	previous, err := s.readChunkManifest(stub, key)
+	if err != nil {
+		return nil, err
+	}
+
+	// an empty value is stored as a manifest without chunks
+	manifest := ChunkManifest{Key: key, Size: len(value), ChunkSize: chunkSize, ChunkHashes: []string{}}
+	manifest.ChunkCount = (len(value) + chunkSize - 1) / chunkSize
+	for i := 0; i < manifest.ChunkCount; i++ {
+		end := (i + 1) * chunkSize
+		if end > len(value) {
+			end = len(value)
+		}
+		chunk := value[i*chunkSize : end]
+
+		ck, err := chunkKey(stub, key, i)
+		if err != nil {
+			return nil, err
+		}
+		err = stub.PutState(ck, chunk)
+		if err != nil {
+			return nil, err
+		}
+		manifest.ChunkHashes = append(manifest.ChunkHashes, valueHash(chunk))
+	}
+	manifest.Hash = valueHash(value)
+
+	// remove the chunks of a longer previous value
+	if previous != nil && previous.ChunkCount > manifest.ChunkCount {
+		err = s.deleteChunks(stub, key, manifest.ChunkCount, previous.ChunkCount)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	manifestAsBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	manifestKey, err := stub.CreateCompositeKey(chunkManifestIndex, []string{key})
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(manifestKey, manifestAsBytes)
+	if err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+func (s *SmartContract) readChainChunked(stub shim.ChaincodeStubInterface, key string) ([]byte, error) {
+	manifest, err := s.readChunkManifest(stub, key)
+	if err != nil {
+		return nil, err
+	}
+	if manifest == nil {
+		return nil, errors.New("no chunked value for key " + key)
+	}
+	if len(manifest.ChunkHashes) != manifest.ChunkCount {
+		return nil, errors.New("chunk manifest of key " + key + " is corrupted")
+	}
+
+	var buffer bytes.Buffer
+	for i := 0; i < manifest.ChunkCount; i++ {
+		ck, err := chunkKey(stub, key, i)
+		if err != nil {
+			return nil, err
+		}
+		chunk, err := stub.GetState(ck)
+		if err != nil {
+			return nil, err
+		}
+		if chunk == nil {
+			return nil, fmt.Errorf("chunk %d of key %s is missing", i, key)
+		}
+		if valueHash(chunk) != manifest.ChunkHashes[i] {
+			return nil, fmt.Errorf("chunk %d of key %s does not match its hash", i, key)
+		}
+		buffer.Write(chunk)
+	}
+
+	value := buffer.Bytes()
+	if len(value) != manifest.Size {
+		return nil, errors.New("size of reassembled value of key " + key + " does not match")
+	}
+	if valueHash(value) != manifest.Hash {
+		return nil, errors.New("reassembled value of key " + key + " does not match its hash")
+	}
+	return value, nil
+}
+
+func (s *SmartContract) uploadCommonChunked(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 && len(args) != 3 {
+		return s.returnError("Wrong number of parameters, need key, value & optional chunk size")
+	}
+
+	key := args[0]
+	chunkSize := defaultChunkSize
+	if len(args) == 3 {
+		size, err := strconv.Atoi(args[2])
+		if err != nil || size < minChunkSize {
+			return s.returnError("Invalid chunk size, need at least " + strconv.Itoa(minChunkSize) + ": " + args[2])
+		}
+		chunkSize = size
+	}
+
+	logger.Debugf("Got request parameters: [key] %s, [value size] %d, [chunk size] %d",
+		key, len(args[1]), chunkSize)
+
+	manifest, err := s.writeChainChunked(APIstub, key, []byte(args[1]), chunkSize)
+	if err != nil {
+		return s.returnError("Data write to chain failed: " + err.Error())
+	}
+
+	manifestAsBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return s.returnError("Marshal chunk manifest failed: " + err.Error())
+	}
+	return shim.Success(manifestAsBytes)
+}
+
+func (s *SmartContract) queryCommonChunked(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return s.returnError("Wrong number of parameters, need query key")
+	}
+
+	logger.Debug("Query chunked value on chain: " + args[0])
+	value, err := s.readChainChunked(APIstub, args[0])
+	if err != nil {
+		return s.returnError("Query failed: " + err.Error())
+	}
+	return shim.Success(value)
+}
+
+func (s *SmartContract) queryCommonChunkManifest(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return s.returnError("Wrong number of parameters, need query key")
+	}
+
+	manifest, err := s.readChunkManifest(APIstub, args[0])
+	if err != nil {
+		return s.returnError("Query failed: " + err.Error())
+	}
+	if manifest == nil {
+		return shim.Success(nil)
+	}
+	manifestAsBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return s.returnError("Marshal chunk manifest failed: " + err.Error())
+	}
+	return shim.Success(manifestAsBytes)
+}
+
+func (s *SmartContract) deleteCommonChunked(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return s.returnError("Wrong number of parameters, need key")
+	}
+
+	key := args[0]
+	manifest, err := s.readChunkManifest(APIstub, key)
+	if err != nil {
+		return s.returnError("Query failed: " + err.Error())
+	}
+	if manifest == nil {
+		return s.returnError("No chunked value for key " + key)
+	}
+
+	err = s.deleteChunks(APIstub, key, 0, manifest.ChunkCount)
+	if err != nil {
+		return s.returnError("Data delete failed: " + err.Error())
+	}
+	manifestKey, err := APIstub.CreateCompositeKey(chunkManifestIndex, []string{key})
+	if err != nil {
+		return s.returnError("Create composite key failed: " + err.Error())
+	}
+	err = APIstub.DelState(manifestKey)
+	if err != nil {
+		return s.returnError("Data delete failed: " + err.Error())
+	}
+
+	return shim.Success(nil)
+}
@@ -0,0 +1,148 @@
+// Written by Xu Chen Hao
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/entities"
+)
+
+// Values are sealed with AES-256-GCM into a versioned cipher envelope. The
+// nonce is an HMAC of the txId, the state key, a label (e.g. the field path)
+// and the value under a nonce key derived from the encryption key, so that
+// every endorser computes the same cipher text, and a key written twice in one
+// transaction, as a batch may do, never seals two values with the same nonce.
+// Being keyed, the nonce reveals nothing about the value. The state key is
+// bound as additional data.
+// Values written before carry no envelope and are decrypted with the entities
+// AES-256-CBC encrypter and the IV passed by the caller.
+
+const cipherEnvelopeVersion = 1
+
+const CipherAlgAES256GCM = "AES256-GCM"
+
+// every cipher envelope starts with its version
+var cipherEnvelopePrefix = []byte(`{"$cipher":`)
+
+type CipherEnvelope struct {
+	Version    int    `json:"$cipher"`
+	Algorithm  string `json:"alg"`
+	KeyID      string `json:"kid"`
+	Nonce      []byte `json:"nonce"`
+	CipherText []byte `json:"ct"`
+}
+
+// keyID identifies an encryption key without revealing it
+func keyID(key []byte) string {
+	digest := sha256.Sum256(append([]byte("keyID\x00"), key...))
+	return hex.EncodeToString(digest[:8])
+}
+
+// nonceKey derives the HMAC key of the nonces, so that the encryption key is
+// used by AES-GCM only
+func nonceKey(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("gcm-nonce"))
+	return mac.Sum(nil)
+}
+
+func cipherNonce(stub shim.ChaincodeStubInterface, key []byte, stateKey, label string, value []byte,
+	size int) []byte {
+
+	mac := hmac.New(sha256.New, nonceKey(key))
+	mac.Write([]byte("nonce\x00" + stub.GetTxID() + "\x00" + stateKey + "\x00" + label + "\x00"))
+	mac.Write(value)
+	return mac.Sum(nil)[:size]
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, errors.New("need 256 bit encryption key")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func isCipherEnvelope(value []byte) bool {
+	return bytes.HasPrefix(value, cipherEnvelopePrefix)
+}
+
+// sealValue encrypts value for the state key and returns the cipher envelope
+func sealValue(stub shim.ChaincodeStubInterface, key []byte, stateKey, label string,
+	value []byte) ([]byte, error) {
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	envelope := CipherEnvelope{
+		Version:   cipherEnvelopeVersion,
+		Algorithm: CipherAlgAES256GCM,
+		KeyID:     keyID(key),
+		Nonce:     cipherNonce(stub, key, stateKey, label, value, gcm.NonceSize()),
+	}
+	envelope.CipherText = gcm.Seal(nil, envelope.Nonce, value, []byte(stateKey))
+	return json.Marshal(envelope)
+}
+
+func decodeCipherEnvelope(sealed []byte) (*CipherEnvelope, error) {
+	var envelope CipherEnvelope
+	err := json.Unmarshal(sealed, &envelope)
+	if err != nil {
+		return nil, errors.New("cipher envelope format error: " + err.Error())
+	}
+	if envelope.Version != cipherEnvelopeVersion {
+		return nil, errors.New("unsupported cipher envelope version")
+	}
+	if envelope.Algorithm != CipherAlgAES256GCM {
+		return nil, errors.New("unsupported encryption algorithm: " + envelope.Algorithm)
+	}
+	return &envelope, nil
+}
+
+// openValue decrypts a cipher envelope of the state key
+func openValue(key []byte, stateKey string, sealed []byte) ([]byte, error) {
+	envelope, err := decodeCipherEnvelope(sealed)
+	if err != nil {
+		return nil, err
+	}
+	if envelope.KeyID != keyID(key) {
+		return nil, errors.New("value is encrypted with key " + envelope.KeyID + ", not with " + keyID(key))
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(envelope.Nonce) != gcm.NonceSize() {
+		return nil, errors.New("invalid nonce size")
+	}
+	clearText, err := gcm.Open(nil, envelope.Nonce, envelope.CipherText, []byte(stateKey))
+	if err != nil {
+		return nil, errors.New("Decrypt failed: " + err.Error())
+	}
+	return clearText, nil
+}
+
+// openAny decrypts a cipher envelope, or a legacy entities cipher text with IV
+func (s *SmartContract) openAny(stub shim.ChaincodeStubInterface, key, IV []byte, stateKey string,
+	value []byte) ([]byte, error) {
+
+	if isCipherEnvelope(value) {
+		return openValue(key, stateKey, value)
+	}
+	ent, err := entities.NewAES256EncrypterEntity("ID", s.bccspInst, key, IV)
+	if err != nil {
+		return nil, errors.New("entities.NewAES256EncrypterEntity failed, err: " + err.Error())
+	}
+	return s.decrypt(stub, ent, value)
+}
@@ -0,0 +1,251 @@
+// Written by Xu Chen Hao
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+	"math/big"
+)
+
+// A confidential PO stores Pedersen commitments to its amounts instead of the
+// amounts, in the smallest currency unit. The quantity stays public, so
+// endorsers check the arithmetic of validatePO on the commitments:
+// amount = quantity * unitPrice, totalAmount = sum of the line amounts, and
+// range proofs that the unit price and so every amount is positive. The data
+// owners keep value and blinding of each commitment off chain. Confidential
+// POs are kept under confidentialPO~poNo, apart from the plain POs.
+const confidentialPOIndex = "confidentialPO"
+
+// transient name of a commitment opening {"value": "...", "blinding": "<hex>"}
+const OPENING = "OPENING"
+
+type ConfidentialAmount struct {
+	Commitment []byte      `json:"commitment"`
+	RangeProof *RangeProof `json:"rangeProof,omitempty"`
+}
+
+type ConfidentialGoodsInfos struct {
+	UnitPrice        ConfidentialAmount `json:"unitPrice"`
+	Amount           ConfidentialAmount `json:"amount"`
+	Quantity         int64              `json:"quantity"`
+	DelDate          string             `json:"delDate"`
+	QuantityCode     string             `json:"quantityCode"`
+	GoodsModel       string             `json:"goodsModel"`
+	GoodNo           string             `json:"goodNo"`
+	PriceCode        string             `json:"priceCode"`
+	GoodsName        string             `json:"goodsName"`
+	GoodsDescription string             `json:"goodsDescription"`
+}
+
+type ConfidentialPO struct {
+	Seller        string                 `json:"seller"`
+	Consignee     string                 `json:"consignee"`
+	Shipment      string                 `json:"shipment"`
+	Destination   string                 `json:"destination"`
+	InsureInfo    string                 `json:"insureInfo"`
+	TradeTerms    string                 `json:"tradeTerms"`
+	TotalCurrency string                 `json:"totalCurrency"`
+	Buyer         string                 `json:"buyer"`
+	TrafMode      string                 `json:"trafMode"`
+	GoodsInfos    ConfidentialGoodsInfos `json:"goodsInfos"`
+	TotalAmount   ConfidentialAmount     `json:"totalAmount"`
+	Carrier       string                 `json:"carrier"`
+	PoNo          string                 `json:"poNo"`
+	Sender        string                 `json:"sender"`
+	PoDate        string                 `json:"poDate"`
+	TradeCountry  string                 `json:"tradeCountry"`
+}
+
+type CommitmentOpening struct {
+	Value    string `json:"value"`
+	Blinding string `json:"blinding"`
+}
+
+type OpeningResult struct {
+	Field string `json:"field"`
+	Valid bool   `json:"valid"`
+}
+
+// verifyAmount decodes a commitment and checks its range proof, which is
+// optional for amounts whose sign follows from other checks
+func verifyAmount(context string, amount ConfidentialAmount, proofRequired bool) (ecPoint, error) {
+	commitment, err := decodePoint(amount.Commitment)
+	if err != nil {
+		return ecPoint{}, errors.New(context + " commitment: " + err.Error())
+	}
+	if amount.RangeProof != nil || proofRequired {
+		err = verifyRangeProof(context, commitment, amount.RangeProof)
+		if err != nil {
+			return ecPoint{}, errors.New(context + " range proof: " + err.Error())
+		}
+	}
+	return commitment, nil
+}
+
+func (s *SmartContract) validateConfidentialPO(po ConfidentialPO) error {
+	if po.PoNo == "" {
+		return errors.New("missing poNo")
+	}
+	if po.GoodsInfos.Quantity <= 0 {
+		return errors.New("quantity must be positive")
+	}
+
+	context := po.PoNo + "/"
+	unitPrice, err := verifyAmount(context+"goodsInfos.unitPrice", po.GoodsInfos.UnitPrice, true)
+	if err != nil {
+		return err
+	}
+	amount, err := verifyAmount(context+"goodsInfos.amount", po.GoodsInfos.Amount, false)
+	if err != nil {
+		return err
+	}
+	total, err := verifyAmount(context+"totalAmount", po.TotalAmount, false)
+	if err != nil {
+		return err
+	}
+
+	// the blinding of the amount is quantity times the blinding of the unit price
+	if !amount.equal(unitPrice.mul(big.NewInt(po.GoodsInfos.Quantity))) {
+		return errors.New("amount commitment is not quantity times unit price commitment")
+	}
+	// a PO has a single goods line, so the line amounts add up to its amount
+	if !total.equal(amount) {
+		return errors.New("line amount commitments do not add up to the total amount commitment")
+	}
+	return nil
+}
+
+func (s *SmartContract) confidentialPOKey(stub shim.ChaincodeStubInterface, poNo string) (string, error) {
+	return stub.CreateCompositeKey(confidentialPOIndex, []string{poNo})
+}
+
+func (s *SmartContract) uploadConfidentialPO(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return s.returnError("参数数量不正确")
+	}
+
+	logger.Debugf("获取请求参数: %s", redactDocument([]byte(args[0])))
+
+	poAsBytes := []byte(args[0])
+	var po ConfidentialPO
+	err := json.Unmarshal(poAsBytes, &po)
+	if err != nil {
+		return s.returnError("PO单格式错误: " + err.Error())
+	}
+
+	// 验证承诺金额是否合法
+	err = s.validateConfidentialPO(po)
+	if err != nil {
+		return s.returnError("PO单不合法: " + err.Error())
+	}
+
+	// 数据上链
+	poAsBytes, err = json.Marshal(po)
+	if err != nil {
+		return s.returnError("PO单格式错误: " + err.Error())
+	}
+	poKey, err := s.confidentialPOKey(APIstub, po.PoNo)
+	if err != nil {
+		return s.returnError("Create composite key failed: " + err.Error())
+	}
+	err = s.setPartyKEP(kepStore{stub: APIstub}, DocTypePO, poKey, po)
+	if err != nil {
+		return s.returnError("PO单背书策略设置失败: " + err.Error())
+	}
+	err = s.putState(APIstub, DocTypeConfidentialPO, poKey, poAsBytes)
+	if err != nil {
+		return s.returnError("PO单上链失败: " + err.Error())
+	}
+
+	return shim.Success(poAsBytes)
+}
+
+func (s *SmartContract) queryConfidentialPO(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return s.returnError("参数数量不正确")
+	}
+
+	poKey, err := s.confidentialPOKey(APIstub, args[0])
+	if err != nil {
+		return s.returnError("Create composite key failed: " + err.Error())
+	}
+	result, err := s.getState(APIstub, poKey)
+	if err != nil {
+		return s.returnError("po单查询失败" + err.Error())
+	}
+	return shim.Success(result)
+}
+
+// openConfidentialPO checks an opening passed in transient against a
+// commitment of a confidential PO, without writing it anywhere. The peer sees
+// the opening, so only evaluate it as query on a peer of the data owner's own
+// org, never send it to other orgs' peers or submit it.
+func (s *SmartContract) openConfidentialPO(APIstub shim.ChaincodeStubInterface, args []string,
+	openingAsBytes []byte) sc.Response {
+
+	if len(args) != 2 {
+		return s.returnError("参数数量不正确, 需要PO单号和字段 (unitPrice, amount 或 totalAmount)")
+	}
+
+	poKey, err := s.confidentialPOKey(APIstub, args[0])
+	if err != nil {
+		return s.returnError("Create composite key failed: " + err.Error())
+	}
+	poAsBytes, err := s.getState(APIstub, poKey)
+	if err != nil {
+		return s.returnError("po单查询失败" + err.Error())
+	}
+	if poAsBytes == nil {
+		return s.returnError("po单不存在: " + args[0])
+	}
+	var po ConfidentialPO
+	err = json.Unmarshal(poAsBytes, &po)
+	if err != nil {
+		return s.returnError("PO单格式错误: " + err.Error())
+	}
+
+	var amount ConfidentialAmount
+	switch args[1] {
+	case "unitPrice":
+		amount = po.GoodsInfos.UnitPrice
+	case "amount":
+		amount = po.GoodsInfos.Amount
+	case "totalAmount":
+		amount = po.TotalAmount
+	default:
+		return s.returnError("未知字段: " + args[1])
+	}
+
+	var opening CommitmentOpening
+	err = json.Unmarshal(openingAsBytes, &opening)
+	if err != nil {
+		return s.returnError("承诺打开格式错误: " + err.Error())
+	}
+	value, ok := new(big.Int).SetString(opening.Value, 10)
+	if !ok {
+		return s.returnError("承诺金额格式错误: " + opening.Value)
+	}
+	blindingBytes, err := hex.DecodeString(opening.Blinding)
+	if err != nil {
+		return s.returnError("承诺盲因子格式错误: " + err.Error())
+	}
+	commitment, err := decodePoint(amount.Commitment)
+	if err != nil {
+		return s.returnError("承诺格式错误: " + err.Error())
+	}
+
+	result := OpeningResult{
+		Field: args[1],
+		Valid: pedersenCommit(value, new(big.Int).SetBytes(blindingBytes)).equal(commitment),
+	}
+	resultAsBytes, err := json.Marshal(result)
+	if err != nil {
+		return s.returnError(err.Error())
+	}
+	return shim.Success(resultAsBytes)
+}
@@ -0,0 +1,77 @@
+// Written by Xu Chen Hao
+package main
+
+import (
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Chaincode configuration is kept on chain, so that every endorser reads the
+// same values.
+const configIndex = "config"
+
+// configuration names
+const (
+	// "true" to wrap stored document values in an envelope
+	ConfigEnvelope = "envelope"
+)
+
+func (s *SmartContract) getConfig(stub shim.ChaincodeStubInterface, name string) (string, error) {
+	configKey, err := stub.CreateCompositeKey(configIndex, []string{name})
+	if err != nil {
+		return "", err
+	}
+	value, err := stub.GetState(configKey)
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+func (s *SmartContract) setConfig(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 {
+		return s.returnError("Wrong number of parameters, need config name & value (empty to remove)")
+	}
+
+	// the configuration controls envelopes, encryption, indexes and
+	// endorsement policies of every document
+	err := s.assertAdmin(APIstub)
+	if err != nil {
+		return s.returnError("Set config denied: " + err.Error())
+	}
+
+	logger.Debugf("Set config: [name] %s, [value] %s", args[0], args[1])
+
+	configKey, err := APIstub.CreateCompositeKey(configIndex, []string{args[0]})
+	if err != nil {
+		return s.returnError("Create composite key failed: " + err.Error())
+	}
+	if args[1] == "" {
+		err = APIstub.DelState(configKey)
+	} else {
+		err = APIstub.PutState(configKey, []byte(args[1]))
+	}
+	if err != nil {
+		return s.returnError("Config write to chain failed: " + err.Error())
+	}
+	return shim.Success(nil)
+}
+
+func (s *SmartContract) queryConfig(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return s.returnError("Wrong number of parameters, need config name")
+	}
+
+	value, err := s.getConfig(APIstub, args[0])
+	if err != nil {
+		return s.returnError("Query failed: " + err.Error())
+	}
+	result, err := json.Marshal(Data{Key: args[0], Value: value})
+	if err != nil {
+		return s.returnError("Marshal config failed: " + err.Error())
+	}
+	return shim.Success(result)
+}
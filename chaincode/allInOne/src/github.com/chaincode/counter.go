@@ -0,0 +1,332 @@
+// Written by Xu Chen Hao
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Counters are written as delta records counter~name~txId, so concurrent
+// increments of the same counter never write the same key. The current value
+// is the snapshot plus the sum of all deltas, compactCounter folds the deltas
+// into the snapshot. An increment reads only the counter definition, so
+// increments of one counter in the same block do not conflict. The total is
+// only checked for the int64 range where all deltas are read anyway.
+const counterIndex = "counter"
+const counterDefIndex = "counterDef"
+const counterSnapshotIndex = "counterSnapshot"
+
+const (
+	CounterTypeInt64   = "int64"
+	CounterTypeDecimal = "decimal"
+)
+
+// max number of fraction digits of a decimal counter
+const maxCounterScale = 18
+
+// max absolute delta of one increment in units
+const maxCounterDelta = math.MaxInt64 / 2
+
+// CounterDef is written once on creation and only read by increments.
+// Values are stored as int64 units of 10^-Scale.
+type CounterDef struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Scale int    `json:"scale"`
+}
+
+type CounterValue struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Value  string `json:"value"`
+	Deltas int    `json:"deltas"`
+}
+
+// int64Total returns the total if it is in the int64 range
+func int64Total(total *big.Int) (int64, error) {
+	if !total.IsInt64() {
+		return 0, errors.New("counter overflow: " + total.String())
+	}
+	return total.Int64(), nil
+}
+
+// parseUnits parses an integer or decimal string into units of 10^-scale
+func parseUnits(value string, scale int) (int64, error) {
+	value = strings.TrimSpace(value)
+	negative := strings.HasPrefix(value, "-")
+	digits := strings.TrimPrefix(strings.TrimPrefix(value, "-"), "+")
+
+	parts := strings.SplitN(digits, ".", 2)
+	fraction := ""
+	if len(parts) == 2 {
+		fraction = parts[1]
+	}
+	if parts[0] == "" && fraction == "" {
+		return 0, errors.New("invalid number: " + value)
+	}
+	if len(fraction) > scale {
+		return 0, errors.New("too many fraction digits (scale " + strconv.Itoa(scale) + "): " + value)
+	}
+	for _, c := range parts[0] + fraction {
+		if c < '0' || c > '9' {
+			return 0, errors.New("invalid number: " + value)
+		}
+	}
+
+	units, ok := new(big.Int).SetString(parts[0]+fraction+strings.Repeat("0", scale-len(fraction)), 10)
+	if !ok {
+		return 0, errors.New("invalid number: " + value)
+	}
+	if negative {
+		units.Neg(units)
+	}
+	if !units.IsInt64() {
+		return 0, errors.New("counter overflow: " + value)
+	}
+	return units.Int64(), nil
+}
+
+// formatUnits formats units of 10^-scale as a decimal string
+func formatUnits(units int64, scale int) string {
+	if scale == 0 {
+		return strconv.FormatInt(units, 10)
+	}
+	digits := new(big.Int).Abs(big.NewInt(units)).String()
+	if len(digits) <= scale {
+		digits = strings.Repeat("0", scale-len(digits)+1) + digits
+	}
+	result := digits[:len(digits)-scale] + "." + digits[len(digits)-scale:]
+	if units < 0 {
+		result = "-" + result
+	}
+	return result
+}
+
+func (s *SmartContract) readCounterDef(stub shim.ChaincodeStubInterface, name string) (*CounterDef, error) {
+	defKey, err := stub.CreateCompositeKey(counterDefIndex, []string{name})
+	if err != nil {
+		return nil, err
+	}
+	defAsBytes, err := stub.GetState(defKey)
+	if err != nil {
+		return nil, err
+	}
+	if defAsBytes == nil {
+		return nil, errors.New("counter " + name + " does not exist")
+	}
+	var def CounterDef
+	err = json.Unmarshal(defAsBytes, &def)
+	if err != nil {
+		return nil, err
+	}
+	return &def, nil
+}
+
+// readCounter returns the snapshot plus all deltas and the delta keys. The
+// sum may leave the int64 range in between, only the total is checked.
+func (s *SmartContract) readCounter(stub shim.ChaincodeStubInterface, name string) (*big.Int, []string, error) {
+	snapshotKey, err := stub.CreateCompositeKey(counterSnapshotIndex, []string{name})
+	if err != nil {
+		return nil, nil, err
+	}
+	snapshotAsBytes, err := stub.GetState(snapshotKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	total := new(big.Int)
+	if snapshotAsBytes != nil {
+		snapshot, err := strconv.ParseInt(string(snapshotAsBytes), 10, 64)
+		if err != nil {
+			return nil, nil, err
+		}
+		total.SetInt64(snapshot)
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(counterIndex, []string{name})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resultsIterator.Close()
+
+	deltaKeys := []string{}
+	for resultsIterator.HasNext() {
+		item, err := resultsIterator.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		delta, err := strconv.ParseInt(string(item.Value), 10, 64)
+		if err != nil {
+			return nil, nil, err
+		}
+		total.Add(total, big.NewInt(delta))
+		deltaKeys = append(deltaKeys, item.Key)
+	}
+	return total, deltaKeys, nil
+}
+
+func (s *SmartContract) createCounter(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) < 2 || len(args) > 3 {
+		return s.returnError("Wrong number of parameters, need name, type ('int64' or 'decimal') & optional scale")
+	}
+
+	def := CounterDef{Name: args[0], Type: args[1]}
+	switch def.Type {
+	case CounterTypeInt64:
+		if len(args) == 3 {
+			return s.returnError("Scale is only allowed for decimal counters")
+		}
+	case CounterTypeDecimal:
+		if len(args) != 3 {
+			return s.returnError("Need scale for decimal counter")
+		}
+		scale, err := strconv.Atoi(args[2])
+		if err != nil || scale < 0 || scale > maxCounterScale {
+			return s.returnError("Invalid scale, need 0 to " + strconv.Itoa(maxCounterScale) + ": " + args[2])
+		}
+		def.Scale = scale
+	default:
+		return s.returnError("Unknown counter type (need 'int64' or 'decimal'): " + def.Type)
+	}
+
+	logger.Debugf("Create counter: [name] %s, [type] %s, [scale] %d", def.Name, def.Type, def.Scale)
+
+	defKey, err := APIstub.CreateCompositeKey(counterDefIndex, []string{def.Name})
+	if err != nil {
+		return s.returnError("Create composite key failed: " + err.Error())
+	}
+	existing, err := APIstub.GetState(defKey)
+	if err != nil {
+		return s.returnError("Query failed: " + err.Error())
+	}
+	if existing != nil {
+		return s.returnError("Counter " + def.Name + " already exists")
+	}
+
+	defAsBytes, err := json.Marshal(def)
+	if err != nil {
+		return s.returnError("Marshal counter failed: " + err.Error())
+	}
+	err = APIstub.PutState(defKey, defAsBytes)
+	if err != nil {
+		return s.returnError("Data write to chain failed: " + err.Error())
+	}
+	return shim.Success(defAsBytes)
+}
+
+// incrementCounter writes a new delta record without reading the total.
+// Deltas are bounded to half the int64 range, queryCounter and compactCounter
+// report a total that left the int64 range.
+func (s *SmartContract) incrementCounter(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 {
+		return s.returnError("Wrong number of parameters, need name & delta")
+	}
+
+	def, err := s.readCounterDef(APIstub, args[0])
+	if err != nil {
+		return s.returnError("Query counter failed: " + err.Error())
+	}
+	delta, err := parseUnits(args[1], def.Scale)
+	if err != nil {
+		return s.returnError("Invalid delta: " + err.Error())
+	}
+	if delta == 0 {
+		return shim.Success(nil)
+	}
+	if delta > maxCounterDelta || delta < -maxCounterDelta {
+		return s.returnError("Invalid delta: out of range: " + args[1])
+	}
+
+	logger.Debugf("Increment counter: [name] %s, [delta] %s", def.Name, args[1])
+
+	deltaKey, err := APIstub.CreateCompositeKey(counterIndex, []string{def.Name, APIstub.GetTxID()})
+	if err != nil {
+		return s.returnError("Create composite key failed: " + err.Error())
+	}
+	err = APIstub.PutState(deltaKey, []byte(strconv.FormatInt(delta, 10)))
+	if err != nil {
+		return s.returnError("Data write to chain failed: " + err.Error())
+	}
+	return shim.Success(nil)
+}
+
+func (s *SmartContract) queryCounter(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return s.returnError("Wrong number of parameters, need counter name")
+	}
+
+	def, err := s.readCounterDef(APIstub, args[0])
+	if err != nil {
+		return s.returnError("Query counter failed: " + err.Error())
+	}
+	sum, deltaKeys, err := s.readCounter(APIstub, def.Name)
+	if err != nil {
+		return s.returnError("Query counter failed: " + err.Error())
+	}
+	total, err := int64Total(sum)
+	if err != nil {
+		return s.returnError("Query counter failed: " + err.Error())
+	}
+
+	value := CounterValue{Name: def.Name, Type: def.Type, Value: formatUnits(total, def.Scale),
+		Deltas: len(deltaKeys)}
+	valueAsBytes, err := json.Marshal(value)
+	if err != nil {
+		return s.returnError("Marshal counter failed: " + err.Error())
+	}
+	return shim.Success(valueAsBytes)
+}
+
+// compactCounter folds all deltas into the snapshot. It conflicts with
+// increments committed in the same block and can be retried.
+func (s *SmartContract) compactCounter(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return s.returnError("Wrong number of parameters, need counter name")
+	}
+
+	def, err := s.readCounterDef(APIstub, args[0])
+	if err != nil {
+		return s.returnError("Query counter failed: " + err.Error())
+	}
+	sum, deltaKeys, err := s.readCounter(APIstub, def.Name)
+	if err != nil {
+		return s.returnError("Query counter failed: " + err.Error())
+	}
+	total, err := int64Total(sum)
+	if err != nil {
+		return s.returnError("Query counter failed: " + err.Error())
+	}
+
+	logger.Debugf("Compact counter: [name] %s, [deltas] %d", def.Name, len(deltaKeys))
+
+	snapshotKey, err := APIstub.CreateCompositeKey(counterSnapshotIndex, []string{def.Name})
+	if err != nil {
+		return s.returnError("Create composite key failed: " + err.Error())
+	}
+	err = APIstub.PutState(snapshotKey, []byte(strconv.FormatInt(total, 10)))
+	if err != nil {
+		return s.returnError("Data write to chain failed: " + err.Error())
+	}
+	for _, deltaKey := range deltaKeys {
+		err = APIstub.DelState(deltaKey)
+		if err != nil {
+			return s.returnError("Data delete failed: " + err.Error())
+		}
+	}
+
+	value := CounterValue{Name: def.Name, Type: def.Type, Value: formatUnits(total, def.Scale)}
+	valueAsBytes, err := json.Marshal(value)
+	if err != nil {
+		return s.returnError("Marshal counter failed: " + err.Error())
+	}
+	return shim.Success(valueAsBytes)
+}
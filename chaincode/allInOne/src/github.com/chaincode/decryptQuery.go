@@ -0,0 +1,181 @@
+// Written by Xu Chen Hao
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+	"strconv"
+)
+
+// DecryptedData is one result of a decrypting range query, Error is set
+// instead of Value if the value could not be decrypted
+type DecryptedData struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+type DecryptedRange struct {
+	Results          []DecryptedData   `json:"results"`
+	ResponseMetadata map[string]string `json:"ResponseMetadata,omitempty"`
+}
+
+// decryptNode decrypts the encrypted fields and cipher envelopes of a JSON
+// document
+func (s *SmartContract) decryptNode(stub shim.ChaincodeStubInterface, decKey, IV []byte, stateKey string,
+	node interface{}) (interface{}, error) {
+
+	switch value := node.(type) {
+	case map[string]interface{}:
+		for name, child := range value {
+			clear, err := s.decryptNode(stub, decKey, IV, stateKey, child)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", name, err)
+			}
+			value[name] = clear
+		}
+	case []interface{}:
+		for i, child := range value {
+			clear, err := s.decryptNode(stub, decKey, IV, stateKey, child)
+			if err != nil {
+				return nil, fmt.Errorf("%d: %s", i, err)
+			}
+			value[i] = clear
+		}
+	case string:
+		if isEncryptedField(value) {
+			return s.decryptField(stub, decKey, IV, stateKey, value)
+		}
+		if isCipherEnvelope([]byte(value)) {
+			clearText, err := openValue(decKey, stateKey, []byte(value))
+			if err != nil {
+				return nil, err
+			}
+			return string(clearText), nil
+		}
+	}
+	return node, nil
+}
+
+// decryptValue decrypts a fully encrypted value, or the encrypted parts of a
+// JSON document
+func (s *SmartContract) decryptValue(stub shim.ChaincodeStubInterface, decKey, IV []byte, stateKey string,
+	value []byte) (json.RawMessage, error) {
+
+	if isCipherEnvelope(value) {
+		clearText, err := openValue(decKey, stateKey, value)
+		if err != nil {
+			return nil, err
+		}
+		return historyValue(clearText), nil
+	}
+	if json.Valid(value) {
+		doc, err := decodeJSON(value)
+		if err != nil {
+			return nil, err
+		}
+		doc, err = s.decryptNode(stub, decKey, IV, stateKey, doc)
+		if err != nil {
+			return nil, err
+		}
+		docAsBytes, err := json.Marshal(doc)
+		return json.RawMessage(docAsBytes), err
+	}
+	clearText, err := s.openAny(stub, decKey, IV, stateKey, value)
+	if err != nil {
+		return nil, err
+	}
+	return historyValue(clearText), nil
+}
+
+// queryDecryptHistory returns the decrypted history of an encrypted value
+func (s *SmartContract) queryDecryptHistory(APIstub shim.ChaincodeStubInterface, args []string,
+	decKey, IV []byte) sc.Response {
+
+	if len(args) < 1 || len(args) > 6 {
+		return s.returnError("Wrong number of parameters, need query key and optional from, to, limit, order " +
+			"& bookmark")
+	}
+
+	opts, err := parseHistoryOptions(args[1:])
+	if err != nil {
+		return s.returnError("Wrong history options: " + err.Error())
+	}
+
+	key := encryptPrefix + args[0]
+	logger.Debug("Query decrypted history on chain: " + key)
+
+	historyArray, err := s.getHistory(APIstub, key, opts, func(value []byte) (json.RawMessage, error) {
+		return s.decryptValue(APIstub, decKey, IV, key, value)
+	})
+	if err != nil {
+		return s.returnError("Query failed: " + err.Error())
+	}
+	historyAsBytes, err := json.Marshal(historyArray)
+	if err != nil {
+		return s.returnError("Marshal history failed: " + err.Error())
+	}
+	return shim.Success(historyAsBytes)
+}
+
+// queryDecryptByRange returns the decrypted values of a key range, optionally
+// paginated
+func (s *SmartContract) queryDecryptByRange(APIstub shim.ChaincodeStubInterface, args []string,
+	decKey, IV []byte) sc.Response {
+
+	if len(args) != 2 && len(args) != 4 {
+		return s.returnError("Wrong number of parameters, need start key, end key & optional page size and bookmark")
+	}
+
+	startKey, endKey := args[0], args[1]
+	logger.Debugf("Query decrypted range: [start key] %s, [end key] %s", startKey, endKey)
+
+	var resultsIterator shim.StateQueryIteratorInterface
+	var responseMetadata *sc.QueryResponseMetadata
+	var err error
+	if len(args) == 4 {
+		var pageSize int64
+		pageSize, err = strconv.ParseInt(args[2], 10, 32)
+		if err != nil {
+			return s.returnError("Error convert page size to int32: " + err.Error())
+		}
+		resultsIterator, responseMetadata, err = APIstub.GetStateByRangeWithPagination(startKey, endKey,
+			int32(pageSize), args[3])
+	} else {
+		resultsIterator, err = APIstub.GetStateByRange(startKey, endKey)
+	}
+	if err != nil {
+		return s.returnError("Query failed: " + err.Error())
+	}
+	defer resultsIterator.Close()
+
+	result := DecryptedRange{Results: []DecryptedData{}}
+	for resultsIterator.HasNext() {
+		item, err := resultsIterator.Next()
+		if err != nil {
+			return s.returnError("Fetch next result failed: " + err.Error())
+		}
+		_, value := decodeEnvelope(item.Value)
+		data := DecryptedData{Key: item.Key}
+		data.Value, err = s.decryptValue(APIstub, decKey, IV, item.Key, value)
+		if err != nil {
+			data.Value = nil
+			data.Error = err.Error()
+		}
+		result.Results = append(result.Results, data)
+	}
+	if responseMetadata != nil {
+		result.ResponseMetadata = map[string]string{
+			"RecordsCount": fmt.Sprintf("%v", responseMetadata.FetchedRecordsCount),
+			"Bookmark":     responseMetadata.Bookmark,
+		}
+	}
+
+	resultAsBytes, err := json.Marshal(result)
+	if err != nil {
+		return s.returnError("Marshal query result failed: " + err.Error())
+	}
+	return shim.Success(resultAsBytes)
+}
@@ -17,6 +17,9 @@ const DECKEY = "DECKEY"
 const VERKEY = "VERKEY"
 const ENCKEY = "ENCKEY"
 const SIGKEY = "SIGKEY"
+
+// IV of the entities AES-256-CBC encrypter, only needed to decrypt values
+// written before the AES-GCM cipher envelope
 const IV = "IV"
 
 type GoodsInfosEncrypt struct {
@@ -86,18 +89,18 @@ func (s *SmartContract) validatePOEncrypt(po POEncrypt) (bool, error) {
 }
 
 func (s *SmartContract) uploadEncrypt(APIstub shim.ChaincodeStubInterface, args []string,
-	encKey, signOrIV []byte) sc.Response {
+	encKey []byte) sc.Response {
 
 	if len(args) != 2 {
 		return s.returnError("Wrong number of parameters, need key & value")
 	}
 
-	logger.Debugf("Got request parameters: [key] %s, [value] %s", args[0], args[1])
+	logger.Debugf("Got request parameters: [key] %s, [value] %s", args[0], redactDocument([]byte(args[1])))
 
 	key := args[0]
 	valueAsByte := []byte(args[1])
 
-	err := s.writeChainEncryptAll(APIstub, key, valueAsByte, encKey, signOrIV)
+	_, err := s.writeChainEncryptAll(APIstub, key, valueAsByte, encKey)
 	if err != nil {
 		return s.returnError("Data encrypt and write to chain failed: " + err.Error())
 	}
@@ -127,21 +130,36 @@ func (s *SmartContract) queryDecrypt(APIstub shim.ChaincodeStubInterface, args [
 }
 
 func (s *SmartContract) uploadEncryptBatch(APIstub shim.ChaincodeStubInterface, args []string,
-	encKey, signOrIV []byte) sc.Response {
+	encKey []byte) sc.Response {
 
+	var keys []string
+	var values [][]byte
 	for _, arg := range args {
 		var batchData Data
 		json.Unmarshal([]byte(arg), &batchData)
 		key := batchData.Key
 		valueAsByte := []byte(batchData.Value)
 
-		logger.Debugf("Write [key] %s [value] %s on chain: ", key, string(valueAsByte))
-		err := s.writeChainEncryptAll(APIstub, key, valueAsByte, encKey, signOrIV)
+		logger.Debugf("Write [key] %s [value] %s on chain: ", key, redactDocument(valueAsByte))
+		cipherText, err := s.writeChainEncryptAll(APIstub, key, valueAsByte, encKey)
 		if err != nil {
 			return s.returnError("Data encrypt and write to chain failed: " + err.Error())
 		}
+
+		// the Merkle tree is built over the stored cipher text
+		keys = append(keys, key)
+		values = append(values, cipherText)
+	}
+
+	batchRoot, err := s.writeBatchRoot(APIstub, keys, values)
+	if err != nil {
+		return s.returnError("Batch root write to chain failed: " + err.Error())
+	}
+	batchRootAsBytes, err := json.Marshal(batchRoot)
+	if err != nil {
+		return s.returnError("Marshal batch root failed: " + err.Error())
 	}
-	return shim.Success(nil)
+	return shim.Success(batchRootAsBytes)
 }
 
 func (s *SmartContract) queryDecryptBatch(APIstub shim.ChaincodeStubInterface, args []string,
@@ -169,13 +187,13 @@ func (s *SmartContract) queryDecryptBatch(APIstub shim.ChaincodeStubInterface, a
 }
 
 func (s *SmartContract) uploadPOEncrypt(APIstub shim.ChaincodeStubInterface, args []string,
-	encKey, signOrIV []byte, encPart, sign bool) sc.Response {
+	encKey, signOrIV, idxKey []byte, encPart, sign bool) sc.Response {
 
 	if len(args) != 1 {
 		return s.returnError("参数数量不正确")
 	}
 
-	logger.Debug("获取请求参数: " + args[0])
+	logger.Debugf("获取请求参数: %s", redactDocument([]byte(args[0])))
 
 	poAsBytes := []byte(args[0])
 	var po POEncrypt
@@ -197,12 +215,22 @@ func (s *SmartContract) uploadPOEncrypt(APIstub shim.ChaincodeStubInterface, arg
 	if sign {
 		err = s.writeChainSignPOEncrypt(APIstub, po, encKey, signOrIV, encPart)
 	} else {
-		err = s.writeChainPOEncrypt(APIstub, po, encKey, signOrIV, encPart)
+		err = s.writeChainPOEncrypt(APIstub, po, encKey, encPart)
 	}
 	if err != nil {
 		return s.returnError("PO单上链失败: " + err.Error())
 	}
 
+	// 写入盲索引, 没有索引密钥时删除旧索引
+	if idxKey != nil {
+		err = s.writeBlindIndex(APIstub, idxKey, po)
+	} else {
+		_, err = s.deleteBlindIndex(APIstub, po.PoNo)
+	}
+	if err != nil {
+		return s.returnError("PO单盲索引写入失败: " + err.Error())
+	}
+
 	return shim.Success(poAsBytes)
 
 }
@@ -242,47 +270,37 @@ func (s *SmartContract) queryPODecrypt(APIstub shim.ChaincodeStubInterface, args
 
 // Do encrypt & write chain for common data
 func (s *SmartContract) writeChainEncryptAll(APIstub shim.ChaincodeStubInterface,
-	key string, valueAsBytes []byte, encKey, IV []byte) error {
-
-	ent, err := entities.NewAES256EncrypterEntity("ID", s.bccspInst, encKey, IV)
-	if err != nil {
-		return errors.New("entities.NewAES256EncrypterEntity failed, err %s" + err.Error())
-	}
+	key string, valueAsBytes []byte, encKey []byte) ([]byte, error) {
 
 	// Do fully encrypt
-	logger.Debugf("Do fully encrypt: [data] %s", string(valueAsBytes))
-	cipherText, err := s.encrypt(APIstub, ent, valueAsBytes)
+	logger.Debugf("Do fully encrypt: [data] %s", redactDocument(valueAsBytes))
+	cipherText, err := sealValue(APIstub, encKey, key, "", valueAsBytes)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	logger.Debugf("Write chain: [key] %s [data] %s", key, string(cipherText))
 	encryptKey := key
-	err = APIstub.PutState(encryptKey, cipherText)
+	err = s.putState(APIstub, DocTypeEncrypted, encryptKey, cipherText)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return cipherText, nil
 }
 
 // Do read chain & decrypt for common data
 func (s *SmartContract) readChainDecryptAll(APIstub shim.ChaincodeStubInterface,
 	key string, decKey, IV []byte) ([]byte, error) {
 
-	ent, err := entities.NewAES256EncrypterEntity("ID", s.bccspInst, decKey, IV)
-	if err != nil {
-		return nil, errors.New("entities.NewAES256EncrypterEntity failed, err %s" + err.Error())
-	}
-
 	// Do fully decrypt
-	valueAsBytes, err := APIstub.GetState(key)
+	valueAsBytes, err := s.getState(APIstub, key)
 	if err != nil {
 		return nil, err
 	}
 
 	logger.Debug("Do fully decrypt: " + string(valueAsBytes))
-	clearText, err := s.decrypt(APIstub, ent, valueAsBytes)
+	clearText, err := s.openAny(APIstub, decKey, IV, key, valueAsBytes)
 	if err != nil {
 		return nil, err
 	}
@@ -292,13 +310,9 @@ func (s *SmartContract) readChainDecryptAll(APIstub shim.ChaincodeStubInterface,
 
 // Do encrypt & write chain
 func (s *SmartContract) writeChainPOEncrypt(APIstub shim.ChaincodeStubInterface,
-	po POEncrypt, encKey, IV []byte, encPart bool) error {
-
-	ent, err := entities.NewAES256EncrypterEntity("ID", s.bccspInst, encKey, IV)
-	if err != nil {
-		return errors.New("entities.NewAES256EncrypterEntity failed, err %s" + err.Error())
-	}
+	po POEncrypt, encKey []byte, encPart bool) error {
 
+	encryptKey := encryptPrefix + po.PoNo
 	if encPart == false {
 
 		// Do fully encrypt
@@ -306,37 +320,36 @@ func (s *SmartContract) writeChainPOEncrypt(APIstub shim.ChaincodeStubInterface,
 		if err != nil {
 			return err
 		}
-		logger.Debug("Do fully encrypt: " + string(poAsBytes))
-		cipherText, err := s.encrypt(APIstub, ent, poAsBytes)
+		logger.Debugf("Do fully encrypt: %s", redactDocument(poAsBytes))
+		cipherText, err := sealValue(APIstub, encKey, encryptKey, "", poAsBytes)
 		if err != nil {
 			return err
 		}
 
 		logger.Debug("Write chain: " + string(cipherText))
-		encryptKey := encryptPrefix + po.PoNo
-		err = APIstub.PutState(encryptKey, cipherText)
+		err = s.putState(APIstub, DocTypeEncrypted, encryptKey, cipherText)
 		if err != nil {
 			return err
 		}
 	} else {
 
 		// Do partly encrypt
-		logger.Debug("Do partly encrypt: " + po.GoodsInfos.UnitPrice)
-		cipherText, err := s.encrypt(APIstub, ent, []byte(po.GoodsInfos.UnitPrice))
+		logger.Debugf("Do partly encrypt: %s", redact([]byte(po.GoodsInfos.UnitPrice)))
+		cipherText, err := sealValue(APIstub, encKey, encryptKey, "goodsInfos.unitPrice",
+			[]byte(po.GoodsInfos.UnitPrice))
 		if err != nil {
 			return err
 		}
 
-		po.GoodsInfos.UnitPrice = base64.StdEncoding.EncodeToString(cipherText)
+		po.GoodsInfos.UnitPrice = string(cipherText)
 
 		poAsBytes, err := json.Marshal(po)
 		if err != nil {
 			return err
 		}
 
-		logger.Debug("Write chain: " + string(poAsBytes))
-		encryptKey := encryptPrefix + po.PoNo
-		err = APIstub.PutState(encryptKey, poAsBytes)
+		logger.Debugf("Write chain: %s", redactDocument(poAsBytes))
+		err = s.putState(APIstub, DocTypeEncrypted, encryptKey, poAsBytes)
 		if err != nil {
 			return err
 		}
@@ -349,11 +362,6 @@ func (s *SmartContract) writeChainPOEncrypt(APIstub shim.ChaincodeStubInterface,
 func (s *SmartContract) readChainPODecrypt(APIstub shim.ChaincodeStubInterface,
 	poNo string, decKey, IV []byte, encPart bool) (*POEncrypt, error) {
 
-	ent, err := entities.NewAES256EncrypterEntity("ID", s.bccspInst, decKey, IV)
-	if err != nil {
-		return nil, errors.New("entities.NewAES256EncrypterEntity failed, err %s" + err.Error())
-	}
-
 	var po POEncrypt
 
 	logger.Debug("Query on chain: " + poNo)
@@ -361,13 +369,13 @@ func (s *SmartContract) readChainPODecrypt(APIstub shim.ChaincodeStubInterface,
 
 		// Do fully decrypt
 		encryptKey := encryptPrefix + poNo
-		poAsBytes, err := APIstub.GetState(encryptKey)
+		poAsBytes, err := s.getState(APIstub, encryptKey)
 		if err != nil {
 			return nil, err
 		}
 
 		logger.Debug("Do fully decrypt: " + string(poAsBytes))
-		clearText, err := s.decrypt(APIstub, ent, poAsBytes)
+		clearText, err := s.openAny(APIstub, decKey, IV, encryptKey, poAsBytes)
 		if err != nil {
 			return nil, err
 		}
@@ -383,7 +391,7 @@ func (s *SmartContract) readChainPODecrypt(APIstub shim.ChaincodeStubInterface,
 
 		// Do partly decrypt
 		encryptKey := encryptPrefix + poNo
-		poAsBytes, err := APIstub.GetState(encryptKey)
+		poAsBytes, err := s.getState(APIstub, encryptKey)
 		if err != nil {
 			return nil, err
 		}
@@ -394,11 +402,15 @@ func (s *SmartContract) readChainPODecrypt(APIstub shim.ChaincodeStubInterface,
 		}
 
 		logger.Debug("Do partly decrypt: " + po.GoodsInfos.UnitPrice)
-		cipherText, err := base64.StdEncoding.DecodeString(po.GoodsInfos.UnitPrice)
-		if err != nil {
-			return nil, err
+		cipherText := []byte(po.GoodsInfos.UnitPrice)
+		if !isCipherEnvelope(cipherText) {
+			// legacy cipher text is base64 encoded
+			cipherText, err = base64.StdEncoding.DecodeString(po.GoodsInfos.UnitPrice)
+			if err != nil {
+				return nil, err
+			}
 		}
-		unitPriceBytes, err := s.decrypt(APIstub, ent, cipherText)
+		unitPriceBytes, err := s.openAny(APIstub, decKey, IV, encryptKey, cipherText)
 		if err != nil {
 			return nil, err
 		}
@@ -409,15 +421,16 @@ func (s *SmartContract) readChainPODecrypt(APIstub shim.ChaincodeStubInterface,
 	return &po, nil
 }
 
-// Do encrypt & write chain
+// Do sign & encrypt & write chain
 func (s *SmartContract) writeChainSignPOEncrypt(APIstub shim.ChaincodeStubInterface,
 	po POEncrypt, encKey, signKey []byte, encPart bool) error {
 
-	ent, err := entities.NewAES256EncrypterECDSASignerEntity("ID", s.bccspInst, encKey, signKey)
+	signer, err := entities.NewECDSASignerEntity("ID", s.bccspInst, signKey)
 	if err != nil {
-		return errors.New("entities.NewAES256EncrypterEntity failed, err: " + err.Error())
+		return errors.New("entities.NewECDSASignerEntity failed, err: " + err.Error())
 	}
 
+	encryptKey := encryptPrefix + po.PoNo
 	if encPart == false {
 
 		// Do fully encrypt
@@ -425,37 +438,36 @@ func (s *SmartContract) writeChainSignPOEncrypt(APIstub shim.ChaincodeStubInterf
 		if err != nil {
 			return err
 		}
-		logger.Debug("Do fully sign & encrypt: " + string(poAsBytes))
-		cipherText, err := s.signEncrypt(APIstub, ent, poAsBytes)
+		logger.Debugf("Do fully sign & encrypt: %s", redactDocument(poAsBytes))
+		cipherText, err := s.signSeal(APIstub, signer, encKey, encryptKey, "", poAsBytes)
 		if err != nil {
 			return err
 		}
 
 		logger.Debug("Write chain: " + string(cipherText))
-		encryptKey := encryptPrefix + po.PoNo
-		err = APIstub.PutState(encryptKey, cipherText)
+		err = s.putState(APIstub, DocTypeEncrypted, encryptKey, cipherText)
 		if err != nil {
 			return err
 		}
 	} else {
 
 		// Do partly encrypt
-		logger.Debug("Do partly sign & encrypt: " + po.GoodsInfos.UnitPrice)
-		cipherText, err := s.signEncrypt(APIstub, ent, []byte(po.GoodsInfos.UnitPrice))
+		logger.Debugf("Do partly sign & encrypt: %s", redact([]byte(po.GoodsInfos.UnitPrice)))
+		cipherText, err := s.signSeal(APIstub, signer, encKey, encryptKey, "goodsInfos.unitPrice",
+			[]byte(po.GoodsInfos.UnitPrice))
 		if err != nil {
 			return err
 		}
 
-		po.GoodsInfos.UnitPrice = base64.StdEncoding.EncodeToString(cipherText)
+		po.GoodsInfos.UnitPrice = string(cipherText)
 
 		poAsBytes, err := json.Marshal(po)
 		if err != nil {
 			return err
 		}
 
-		logger.Debug("Write chain: " + string(poAsBytes))
-		encryptKey := encryptPrefix + po.PoNo
-		err = APIstub.PutState(encryptKey, poAsBytes)
+		logger.Debugf("Write chain: %s", redactDocument(poAsBytes))
+		err = s.putState(APIstub, DocTypeEncrypted, encryptKey, poAsBytes)
 		if err != nil {
 			return err
 		}
@@ -464,15 +476,10 @@ func (s *SmartContract) writeChainSignPOEncrypt(APIstub shim.ChaincodeStubInterf
 	return nil
 }
 
-// Do read chain & decrypt
+// Do read chain & decrypt & verify
 func (s *SmartContract) readChainVerifyPODecrypt(APIstub shim.ChaincodeStubInterface,
 	poNo string, decKey, verKey []byte, encPart bool) (*POEncrypt, error) {
 
-	ent, err := entities.NewAES256EncrypterECDSASignerEntity("ID", s.bccspInst, decKey, verKey)
-	if err != nil {
-		return nil, errors.New("entities.NewAES256EncrypterEntity failed, err: " + err.Error())
-	}
-
 	var po POEncrypt
 
 	logger.Debug("Query on chain: " + poNo)
@@ -480,13 +487,13 @@ func (s *SmartContract) readChainVerifyPODecrypt(APIstub shim.ChaincodeStubInter
 
 		// Do fully decrypt
 		encryptKey := encryptPrefix + poNo
-		poAsBytes, err := APIstub.GetState(encryptKey)
+		poAsBytes, err := s.getState(APIstub, encryptKey)
 		if err != nil {
 			return nil, err
 		}
 
 		logger.Debug("Do fully decrypt & verify: " + string(poAsBytes))
-		clearText, err := s.decryptVerify(APIstub, ent, poAsBytes)
+		clearText, err := s.openVerify(APIstub, decKey, verKey, encryptKey, poAsBytes)
 		if err != nil {
 			return nil, err
 		}
@@ -502,7 +509,7 @@ func (s *SmartContract) readChainVerifyPODecrypt(APIstub shim.ChaincodeStubInter
 
 		// Do partly decrypt
 		encryptKey := encryptPrefix + poNo
-		poAsBytes, err := APIstub.GetState(encryptKey)
+		poAsBytes, err := s.getState(APIstub, encryptKey)
 		if err != nil {
 			return nil, err
 		}
@@ -513,11 +520,15 @@ func (s *SmartContract) readChainVerifyPODecrypt(APIstub shim.ChaincodeStubInter
 		}
 
 		logger.Debug("Do partly decrypt & verify: " + po.GoodsInfos.UnitPrice)
-		cipherText, err := base64.StdEncoding.DecodeString(po.GoodsInfos.UnitPrice)
-		if err != nil {
-			return nil, err
+		cipherText := []byte(po.GoodsInfos.UnitPrice)
+		if !isCipherEnvelope(cipherText) {
+			// legacy cipher text is base64 encoded
+			cipherText, err = base64.StdEncoding.DecodeString(po.GoodsInfos.UnitPrice)
+			if err != nil {
+				return nil, err
+			}
 		}
-		unitPriceBytes, err := s.decryptVerify(APIstub, ent, cipherText)
+		unitPriceBytes, err := s.openVerify(APIstub, decKey, verKey, encryptKey, cipherText)
 		if err != nil {
 			return nil, err
 		}
@@ -528,12 +539,13 @@ func (s *SmartContract) readChainVerifyPODecrypt(APIstub shim.ChaincodeStubInter
 	return &po, nil
 }
 
-func (s *SmartContract) signEncrypt(stub shim.ChaincodeStubInterface,
-	ent entities.EncrypterSignerEntity, value []byte) ([]byte, error) {
+// signSeal signs value and seals the signed message in a cipher envelope
+func (s *SmartContract) signSeal(stub shim.ChaincodeStubInterface, signer entities.Signer,
+	encKey []byte, stateKey, label string, value []byte) ([]byte, error) {
 
-	logger.Debug("Sign and encrypt: " + string(value))
-	msg := &entities.SignedMessage{Payload: value, ID: []byte(ent.ID())}
-	err := msg.Sign(ent)
+	logger.Debugf("Sign and encrypt: %s", redactDocument(value))
+	msg := &entities.SignedMessage{Payload: value, ID: []byte(signer.ID())}
+	err := msg.Sign(signer)
 	if err != nil {
 		return nil, err
 	}
@@ -544,15 +556,33 @@ func (s *SmartContract) signEncrypt(stub shim.ChaincodeStubInterface,
 		return nil, err
 	}
 
-	logger.Debug("Sign and encrypt successfully: " + string(msgBytes))
-	return s.encrypt(stub, ent, msgBytes)
+	logger.Debugf("Sign and encrypt successfully: %s", redact(msgBytes))
+	return sealValue(stub, encKey, stateKey, label, msgBytes)
 }
 
-func (s *SmartContract) decryptVerify(stub shim.ChaincodeStubInterface,
-	ent entities.EncrypterSignerEntity, value []byte) ([]byte, error) {
+// openVerify decrypts a signed message, sealed in a cipher envelope or
+// written by the legacy entities AES-256-CBC encrypter, and verifies it
+func (s *SmartContract) openVerify(stub shim.ChaincodeStubInterface, decKey, verKey []byte,
+	stateKey string, value []byte) ([]byte, error) {
 
 	logger.Debug("Decrypt and verify: " + string(value))
-	value, err := s.decrypt(stub, ent, value)
+	var verifier entities.Signer
+	var err error
+	if isCipherEnvelope(value) {
+		verifier, err = entities.NewECDSASignerEntity("ID", s.bccspInst, verKey)
+		if err != nil {
+			return nil, errors.New("entities.NewECDSASignerEntity failed, err: " + err.Error())
+		}
+		value, err = openValue(decKey, stateKey, value)
+	} else {
+		var ent entities.EncrypterSignerEntity
+		ent, err = entities.NewAES256EncrypterECDSASignerEntity("ID", s.bccspInst, decKey, verKey)
+		if err != nil {
+			return nil, errors.New("entities.NewAES256EncrypterEntity failed, err: " + err.Error())
+		}
+		verifier = ent
+		value, err = s.decrypt(stub, ent, value)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -564,30 +594,17 @@ func (s *SmartContract) decryptVerify(stub shim.ChaincodeStubInterface,
 	}
 
 	// verify the signature
-	ok, err := msg.Verify(ent)
+	ok, err := msg.Verify(verifier)
 	if err != nil {
 		return nil, err
 	} else if !ok {
 		return nil, errors.New("invalid signature")
 	}
 
-	logger.Debug("Decrypt and verify successfully: " + string(msg.Payload))
+	logger.Debugf("Decrypt and verify successfully: %s", redactDocument(msg.Payload))
 	return msg.Payload, nil
 }
 
-func (s *SmartContract) encrypt(stub shim.ChaincodeStubInterface,
-	ent entities.Encrypter, value []byte) ([]byte, error) {
-
-	logger.Debug("Value to encrypt: " + string(value))
-	cipherText, err := ent.Encrypt(value)
-	if err != nil {
-		return nil, errors.New("Encrypt failed: " + err.Error())
-	}
-
-	logger.Debug("After encrypt: " + string(cipherText))
-	return cipherText, nil
-}
-
 func (s *SmartContract) decrypt(stub shim.ChaincodeStubInterface,
 	ent entities.Encrypter, value []byte) ([]byte, error) {
 
@@ -597,6 +614,6 @@ func (s *SmartContract) decrypt(stub shim.ChaincodeStubInterface,
 		return nil, errors.New("Decrypt failed: " + err.Error())
 	}
 
-	logger.Debug("After decrypt: " + string(clearText))
+	logger.Debugf("After decrypt: %s", redactDocument(clearText))
 	return clearText, nil
 }
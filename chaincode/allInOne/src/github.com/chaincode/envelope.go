@@ -0,0 +1,301 @@
+// Written by Xu Chen Hao
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
+	sc "github.com/hyperledger/fabric/protos/peer"
+	"strings"
+	"time"
+)
+
+// version of the envelope format itself
+const envelopeVersion = 1
+
+// every envelope starts with its version, bare values are never stored so
+var envelopePrefix = []byte(`{"$envelope":`)
+
+// schema version of the value of each document type, raise it when the
+// stored structure of that document changes
+var documentSchemaVersions = map[string]int{
+	DocTypePO:        1,
+	DocTypeManifest:  1,
+	DocTypeCommon:    1,
+	DocTypeEncrypted: 1,
+
+	DocTypeConfidentialPO: 1,
+}
+
+type EnvelopeMeta struct {
+	// 0 for legacy bare values
+	Version                int    `json:"$envelope"`
+	DocType                string `json:"docType,omitempty"`
+	SchemaVersion          int    `json:"schemaVersion,omitempty"`
+	CreatorMSP             string `json:"creatorMSP,omitempty"`
+	CreatorCertFingerprint string `json:"creatorCertFingerprint,omitempty"`
+	TxId                   string `json:"txId,omitempty"`
+	Timestamp              string `json:"timestamp,omitempty"`
+	Function               string `json:"function,omitempty"`
+	// metadata of an imported record as claimed by the importer, not verified
+	ImportedMeta *EnvelopeMeta `json:"importedMeta,omitempty"`
+}
+
+type Envelope struct {
+	EnvelopeMeta
+	// JSON values are embedded as is, so that envelopeQuery can select on
+	// "value.<field>". Other values are kept base64 encoded in data.
+	Value json.RawMessage `json:"value,omitempty"`
+	Data  []byte          `json:"data,omitempty"`
+}
+
+func newEnvelope(stub shim.ChaincodeStubInterface, docType string, value []byte) (*Envelope, error) {
+	envelope := Envelope{}
+	envelope.Version = envelopeVersion
+	envelope.DocType = docType
+	envelope.SchemaVersion = documentSchemaVersions[docType]
+	envelope.TxId = stub.GetTxID()
+	envelope.Function, _ = stub.GetFunctionAndParameters()
+
+	var err error
+	envelope.CreatorMSP, err = cid.GetMSPID(stub)
+	if err != nil {
+		return nil, err
+	}
+	// there is no certificate for idemix identities
+	cert, err := cid.GetX509Certificate(stub)
+	if err != nil {
+		return nil, err
+	}
+	if cert != nil {
+		fingerprint := sha256.Sum256(cert.Raw)
+		envelope.CreatorCertFingerprint = hex.EncodeToString(fingerprint[:])
+	}
+	txTime, err := txTimestamp(stub)
+	if err != nil {
+		return nil, err
+	}
+	envelope.Timestamp = txTime.UTC().Format(time.RFC3339Nano)
+
+	if json.Valid(value) {
+		envelope.Value = json.RawMessage(value)
+	} else {
+		envelope.Data = value
+	}
+	return &envelope, nil
+}
+
+// decodeEnvelope returns the envelope and the bare value of a stored value.
+// Legacy bare values are returned with an envelope of version 0.
+func decodeEnvelope(stored []byte) (*Envelope, []byte) {
+	if bytes.HasPrefix(stored, envelopePrefix) {
+		var envelope Envelope
+		if err := json.Unmarshal(stored, &envelope); err == nil && envelope.Version > 0 {
+			if envelope.Value != nil {
+				return &envelope, []byte(envelope.Value)
+			}
+			return &envelope, envelope.Data
+		}
+	}
+	if json.Valid(stored) {
+		return &Envelope{Value: json.RawMessage(stored)}, stored
+	}
+	return &Envelope{Data: stored}, stored
+}
+
+func (s *SmartContract) envelopeEnabled(stub shim.ChaincodeStubInterface) (bool, error) {
+	enabled, err := s.getConfig(stub, ConfigEnvelope)
+	if err != nil {
+		return false, err
+	}
+	return enabled == "true", nil
+}
+
+// wrapValue puts value into an envelope if envelopes are enabled. A value
+// that starts like an envelope is always wrapped, so that a client can't store
+// forged envelope metadata as bare value.
+func (s *SmartContract) wrapValue(stub shim.ChaincodeStubInterface, docType string, value []byte) ([]byte, error) {
+	enabled, err := s.envelopeEnabled(stub)
+	if err != nil {
+		return nil, err
+	}
+	if !enabled && !bytes.HasPrefix(value, envelopePrefix) {
+		return value, nil
+	}
+	envelope, err := newEnvelope(stub, docType, value)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(envelope)
+}
+
+// envelopeQuery rewrites a rich query so that its selector matches a
+// document both bare and wrapped in an envelope, where its fields are under
+// "value". Enveloped documents stay after envelopes are disabled, so queries
+// are always rewritten. A "fields" projection is extended the same way.
+func envelopeQuery(queryString string) (string, error) {
+	var query map[string]json.RawMessage
+	err := json.Unmarshal([]byte(queryString), &query)
+	if err != nil {
+		return "", err
+	}
+	if selectorAsBytes, ok := query["selector"]; ok {
+		var selector map[string]json.RawMessage
+		err = json.Unmarshal(selectorAsBytes, &selector)
+		if err != nil {
+			return "", err
+		}
+		if len(selector) > 0 {
+			wrapped, err := envelopeSelector(selector)
+			if err != nil {
+				return "", err
+			}
+			query["selector"], err = json.Marshal(map[string]interface{}{
+				"$or": []interface{}{selector, wrapped},
+			})
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	if fieldsAsBytes, ok := query["fields"]; ok {
+		var fields []string
+		err = json.Unmarshal(fieldsAsBytes, &fields)
+		if err != nil {
+			return "", err
+		}
+		wrapped := append(fields, "$envelope")
+		for _, field := range fields {
+			wrapped = append(wrapped, "value."+field)
+		}
+		query["fields"], err = json.Marshal(wrapped)
+		if err != nil {
+			return "", err
+		}
+	}
+	queryAsBytes, err := json.Marshal(query)
+	if err != nil {
+		return "", err
+	}
+	return string(queryAsBytes), nil
+}
+
+// envelopeSelector moves the fields of a selector under "value". Combination
+// operators are rewritten recursively, operators on a field are kept as is.
+func envelopeSelector(selector map[string]json.RawMessage) (map[string]json.RawMessage, error) {
+	wrapped := make(map[string]json.RawMessage, len(selector))
+	for field, condition := range selector {
+		switch field {
+		case "$and", "$or", "$nor":
+			var selectors []map[string]json.RawMessage
+			err := json.Unmarshal(condition, &selectors)
+			if err != nil {
+				return nil, err
+			}
+			for i := range selectors {
+				selectors[i], err = envelopeSelector(selectors[i])
+				if err != nil {
+					return nil, err
+				}
+			}
+			wrapped[field], err = json.Marshal(selectors)
+			if err != nil {
+				return nil, err
+			}
+		case "$not":
+			var not map[string]json.RawMessage
+			err := json.Unmarshal(condition, &not)
+			if err != nil {
+				return nil, err
+			}
+			not, err = envelopeSelector(not)
+			if err != nil {
+				return nil, err
+			}
+			wrapped[field], err = json.Marshal(not)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			if strings.HasPrefix(field, "$") {
+				wrapped[field] = condition
+			} else {
+				wrapped["value."+field] = condition
+			}
+		}
+	}
+	return wrapped, nil
+}
+
+// putState writes a document value, wrapped in an envelope if enabled
+func (s *SmartContract) putState(stub shim.ChaincodeStubInterface, docType, key string, value []byte) error {
+	stored, err := s.wrapValue(stub, docType, value)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, stored)
+}
+
+// getState reads the bare value of a document, with or without envelope
+func (s *SmartContract) getState(stub shim.ChaincodeStubInterface, key string) ([]byte, error) {
+	stored, err := stub.GetState(key)
+	if err != nil || stored == nil {
+		return stored, err
+	}
+	_, value := decodeEnvelope(stored)
+	return value, nil
+}
+
+func (s *SmartContract) putPrivateData(stub shim.ChaincodeStubInterface, docType, collection, key string,
+	value []byte) error {
+
+	stored, err := s.wrapValue(stub, docType, value)
+	if err != nil {
+		return err
+	}
+	return stub.PutPrivateData(collection, key, stored)
+}
+
+func (s *SmartContract) getPrivateData(stub shim.ChaincodeStubInterface, collection, key string) ([]byte, error) {
+	stored, err := stub.GetPrivateData(collection, key)
+	if err != nil || stored == nil {
+		return stored, err
+	}
+	_, value := decodeEnvelope(stored)
+	return value, nil
+}
+
+// queryEnvelope returns the stored value of a state key, or of a private data
+// key if a collection is given, together with its envelope metadata.
+func (s *SmartContract) queryEnvelope(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 && len(args) != 2 {
+		return s.returnError("Wrong number of parameters, need key & optional collection")
+	}
+
+	var stored []byte
+	var err error
+	if len(args) == 2 {
+		logger.Debugf("Query envelope: [collection] %s, [key] %s", args[1], args[0])
+		stored, err = APIstub.GetPrivateData(args[1], args[0])
+	} else {
+		logger.Debug("Query envelope: " + args[0])
+		stored, err = APIstub.GetState(args[0])
+	}
+	if err != nil {
+		return s.returnError("Query failed: " + err.Error())
+	}
+	if stored == nil {
+		return shim.Success(nil)
+	}
+
+	envelope, _ := decodeEnvelope(stored)
+	envelopeAsBytes, err := json.Marshal(envelope)
+	if err != nil {
+		return s.returnError("Marshal envelope failed: " + err.Error())
+	}
+	return shim.Success(envelopeAsBytes)
+}
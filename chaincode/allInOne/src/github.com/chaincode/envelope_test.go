@@ -0,0 +1,155 @@
+// Written by Xu Chen Hao
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+)
+
+// queryStub answers rich queries with equality selectors, "$and" and "$or"
+// over its state, the way CouchDB does for these selectors
+type queryStub struct {
+	*shim.MockStub
+	queries []string
+}
+
+type sliceIterator struct {
+	results []*queryresult.KV
+}
+
+func (it *sliceIterator) HasNext() bool { return len(it.results) > 0 }
+
+func (it *sliceIterator) Next() (*queryresult.KV, error) {
+	result := it.results[0]
+	it.results = it.results[1:]
+	return result, nil
+}
+
+func (it *sliceIterator) Close() error { return nil }
+
+func fieldValue(doc interface{}, path string) (interface{}, bool) {
+	for _, name := range strings.Split(path, ".") {
+		object, ok := doc.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if doc, ok = object[name]; !ok {
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+func matches(doc interface{}, selector map[string]interface{}) bool {
+	for field, condition := range selector {
+		switch field {
+		case "$and", "$or":
+			any := false
+			for _, sub := range condition.([]interface{}) {
+				matched := matches(doc, sub.(map[string]interface{}))
+				if field == "$and" && !matched {
+					return false
+				}
+				any = any || matched
+			}
+			if field == "$or" && !any {
+				return false
+			}
+		default:
+			value, ok := fieldValue(doc, field)
+			if !ok || value != condition {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (stub *queryStub) GetQueryResult(query string) (shim.StateQueryIteratorInterface, error) {
+	stub.queries = append(stub.queries, query)
+	var parsed struct {
+		Selector map[string]interface{} `json:"selector"`
+	}
+	if err := json.Unmarshal([]byte(query), &parsed); err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for key := range stub.State {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	it := &sliceIterator{}
+	for _, key := range keys {
+		var doc interface{}
+		if json.Unmarshal(stub.State[key], &doc) == nil && matches(doc, parsed.Selector) {
+			it.results = append(it.results, &queryresult.KV{Key: key, Value: stub.State[key]})
+		}
+	}
+	return it, nil
+}
+
+func TestRichQueryMatchesEnvelopes(t *testing.T) {
+	stub := &queryStub{MockStub: shim.NewMockStub("envelope", nil)}
+	stub.MockTransactionStart("tx1")
+	stub.PutState("po1", []byte(`{"poNo":"po1","buyer":"Org1","goodsInfos":{"goodNo":"g1"}}`))
+	stub.PutState("po2", []byte(`{"$envelope":1,"docType":"po","txId":"tx1",`+
+		`"value":{"poNo":"po2","buyer":"Org1","goodsInfos":{"goodNo":"g1"}}}`))
+	stub.PutState("po3", []byte(`{"$envelope":1,"docType":"po","txId":"tx1",`+
+		`"value":{"poNo":"po3","buyer":"Org2","goodsInfos":{"goodNo":"g1"}}}`))
+	stub.MockTransactionEnd("tx1")
+
+	s := new(SmartContract)
+	result, err := s.richQuery(stub, `{"selector":{"buyer":"Org1","goodsInfos.goodNo":"g1"}}`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []struct {
+		Key    string
+		Record map[string]interface{}
+	}
+	if err = json.Unmarshal(result, &records); err != nil {
+		t.Fatalf("invalid result %s: %s", result, err)
+	}
+	if len(records) != 2 || records[0].Key != "po1" || records[1].Key != "po2" {
+		t.Fatalf("expected po1 and po2, got %s", result)
+	}
+	// records are returned bare
+	if records[1].Record["poNo"] != "po2" {
+		t.Errorf("enveloped record not unwrapped: %s", result)
+	}
+}
+
+func TestEnvelopeQuery(t *testing.T) {
+	cases := []struct {
+		query, expected string
+	}{
+		{`{"selector":{"buyer":"Org1"}}`,
+			`{"selector":{"$or":[{"buyer":"Org1"},{"value.buyer":"Org1"}]}}`},
+		{`{"selector":{"$or":[{"buyer":"Org1"},{"seller":{"$eq":"Org2"}}]}}`,
+			`{"selector":{"$or":[{"$or":[{"buyer":"Org1"},{"seller":{"$eq":"Org2"}}]},` +
+				`{"$or":[{"value.buyer":"Org1"},{"value.seller":{"$eq":"Org2"}}]}]}}`},
+		{`{"selector":{"$not":{"buyer":"Org1"}},"limit":10}`,
+			`{"limit":10,"selector":{"$or":[{"$not":{"buyer":"Org1"}},{"$not":{"value.buyer":"Org1"}}]}}`},
+		{`{"selector":{"poNo":"po1"},"fields":["poNo"]}`,
+			`{"fields":["poNo","$envelope","value.poNo"],` +
+				`"selector":{"$or":[{"poNo":"po1"},{"value.poNo":"po1"}]}}`},
+		{`{"selector":{}}`, `{"selector":{}}`},
+	}
+	for _, c := range cases {
+		rewritten, err := envelopeQuery(c.query)
+		if err != nil {
+			t.Fatalf("rewrite %s: %s", c.query, err)
+		}
+		if rewritten != c.expected {
+			t.Errorf("rewrite %s: expected %s, got %s", c.query, c.expected, rewritten)
+		}
+	}
+	if _, err := envelopeQuery(`not json`); err == nil {
+		t.Error("expected error for invalid query")
+	}
+}
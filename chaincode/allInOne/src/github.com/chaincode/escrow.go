@@ -0,0 +1,527 @@
+// Written by Xu Chen Hao
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
+	sc "github.com/hyperledger/fabric/protos/peer"
+	"strconv"
+	"time"
+)
+
+// Key escrow splits a document key into Shamir shares over GF(2^8), so that
+// any threshold of the participating orgs can recover it. Each share is
+// wrapped for the public key the org registered for multi-recipient
+// encryption, or stored in a private collection of the org. The escrow is kept
+// under escrow~key, only its creator org or an admin may replace it. Recovery
+// takes the shares in transient and checks the reconstructed key against the
+// escrowed key ID. Recovery takes two steps: recoverEscrowKey records the
+// recovery under escrowRecovery~key~txId and returns no key, then the
+// requester queries releaseEscrowKey with the txId and the same shares, which
+// returns the key sealed with a key of the requester only if that record is
+// committed. So the key is never handed out before its recovery is recorded.
+const escrowIndex = "escrow"
+const escrowShareIndex = "escrowShare"
+const escrowRecoveryIndex = "escrowRecovery"
+
+// transient names of the key to escrow, the shares to recover from and the
+// key to seal the recovered key with
+const ESCROWKEY = "ESCROWKEY"
+const SHARES = "SHARES"
+const RESPKEY = "RESPKEY"
+
+const maxEscrowShares = 255
+
+type EscrowParticipant struct {
+	MSP string `json:"msp"`
+	// the share is stored in this private collection if set, wrapped for
+	// the public key of the org otherwise
+	Collection string `json:"collection,omitempty"`
+}
+
+type EscrowShare struct {
+	MSP        string      `json:"msp"`
+	X          byte        `json:"x"`
+	Collection string      `json:"collection,omitempty"`
+	Wrapped    *WrappedKey `json:"wrapped,omitempty"`
+}
+
+type Escrow struct {
+	Key       string        `json:"key"`
+	KeyID     string        `json:"keyId"`
+	Threshold int           `json:"threshold"`
+	Shares    []EscrowShare `json:"shares"`
+	// MSP ID of the org that created the escrow
+	CreatorMSP string `json:"creatorMSP"`
+	TxId       string `json:"txId"`
+}
+
+type ShamirShare struct {
+	X byte   `json:"x"`
+	Y []byte `json:"y"`
+}
+
+type EscrowRecovery struct {
+	Key          string   `json:"key"`
+	KeyID        string   `json:"keyId"`
+	RequesterMSP string   `json:"requesterMSP"`
+	ShareMSPs    []string `json:"shareMSPs"`
+	TxId         string   `json:"txId"`
+	Timestamp    string   `json:"timestamp"`
+}
+
+// exp and log tables of GF(2^8) with the AES polynomial and generator 3
+var gfExp, gfLog = gfTables()
+
+func gfTables() ([510]byte, [256]byte) {
+	var exp [510]byte
+	var log [256]byte
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		exp[i] = x
+		log[x] = byte(i)
+		// x *= 3
+		high := x & 0x80
+		x2 := x << 1
+		if high != 0 {
+			x2 ^= 0x1b
+		}
+		x ^= x2
+	}
+	for i := 255; i < 510; i++ {
+		exp[i] = exp[i-255]
+	}
+	return exp, log
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
+
+// shamirSplit splits the secret into n shares with x = 1..n. The polynomial
+// coefficients are derived from the secret and the seed, so that every
+// endorser computes the same shares.
+func shamirSplit(secret []byte, n, threshold int, seed []byte) []ShamirShare {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(seed)
+	prk := mac.Sum(nil)
+
+	// coefficients[i] holds the coefficients of degree 1..threshold-1 for
+	// secret byte i
+	coefficients := make([][]byte, len(secret))
+	stream := []byte{}
+	for counter := 0; len(stream) < len(secret)*(threshold-1); counter++ {
+		block := hmac.New(sha256.New, prk)
+		block.Write([]byte(strconv.Itoa(counter)))
+		stream = append(stream, block.Sum(nil)...)
+	}
+	for i := range secret {
+		coefficients[i] = stream[i*(threshold-1) : (i+1)*(threshold-1)]
+	}
+
+	shares := make([]ShamirShare, n)
+	for s := range shares {
+		x := byte(s + 1)
+		y := make([]byte, len(secret))
+		for i, b := range secret {
+			// Horner's scheme from the highest degree
+			value := byte(0)
+			for d := threshold - 2; d >= 0; d-- {
+				value = gfMul(value^coefficients[i][d], x)
+			}
+			y[i] = value ^ b
+		}
+		shares[s] = ShamirShare{X: x, Y: y}
+	}
+	return shares
+}
+
+// shamirCombine interpolates the shares at x = 0
+func shamirCombine(shares []ShamirShare) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("no shares")
+	}
+	size := len(shares[0].Y)
+	seen := map[byte]bool{}
+	for _, share := range shares {
+		if share.X == 0 || seen[share.X] {
+			return nil, errors.New("shares need distinct non-zero x")
+		}
+		if len(share.Y) != size {
+			return nil, errors.New("shares differ in length")
+		}
+		seen[share.X] = true
+	}
+
+	secret := make([]byte, size)
+	for j, share := range shares {
+		// Lagrange basis polynomial of share j at 0
+		basis := byte(1)
+		for m, other := range shares {
+			if m != j {
+				basis = gfMul(basis, gfDiv(other.X, other.X^share.X))
+			}
+		}
+		for i := range secret {
+			secret[i] ^= gfMul(share.Y[i], basis)
+		}
+	}
+	return secret, nil
+}
+
+func (s *SmartContract) readEscrow(stub shim.ChaincodeStubInterface, key string) (string, *Escrow, error) {
+	escrowKey, err := stub.CreateCompositeKey(escrowIndex, []string{key})
+	if err != nil {
+		return "", nil, err
+	}
+	escrowAsBytes, err := stub.GetState(escrowKey)
+	if err != nil {
+		return "", nil, err
+	}
+	if escrowAsBytes == nil {
+		return escrowKey, nil, nil
+	}
+	var escrow Escrow
+	err = json.Unmarshal(escrowAsBytes, &escrow)
+	if err != nil {
+		return "", nil, err
+	}
+	return escrowKey, &escrow, nil
+}
+
+// escrowDocumentKey splits the key passed in transient among the participant
+// orgs. An existing escrow is only replaced by its creator org or an admin.
+func (s *SmartContract) escrowDocumentKey(APIstub shim.ChaincodeStubInterface, args []string,
+	secret []byte) sc.Response {
+
+	if len(args) != 3 {
+		return s.returnError("Wrong number of parameters, need key, threshold & participants " +
+			"(JSON array of {\"msp\", \"collection\"})")
+	}
+
+	key := args[0]
+	threshold, err := strconv.Atoi(args[1])
+	if err != nil {
+		return s.returnError("Invalid threshold: " + args[1])
+	}
+	var participants []EscrowParticipant
+	err = json.Unmarshal([]byte(args[2]), &participants)
+	if err != nil {
+		return s.returnError("Participants format error: " + err.Error())
+	}
+	if threshold < 2 || threshold > len(participants) || len(participants) > maxEscrowShares {
+		return s.returnError("Need 2 <= threshold <= participants <= " + strconv.Itoa(maxEscrowShares))
+	}
+	if len(secret) == 0 {
+		return s.returnError("Empty key to escrow")
+	}
+
+	escrowKey, existing, err := s.readEscrow(APIstub, key)
+	if err != nil {
+		return s.returnError("Query escrow failed: " + err.Error())
+	}
+	msp, err := cid.GetMSPID(APIstub)
+	if err != nil {
+		return s.returnError("Get MSP ID failed: " + err.Error())
+	}
+	if existing != nil && (existing.CreatorMSP == "" || existing.CreatorMSP != msp) {
+		err = s.assertAdmin(APIstub)
+		if err != nil {
+			return s.returnError("Escrow of " + key + " exists, replace denied: " + err.Error())
+		}
+	}
+
+	logger.Debugf("Escrow key: [key] %s, [threshold] %d of %d", key, threshold, len(participants))
+
+	shares := shamirSplit(secret, len(participants), threshold, []byte(APIstub.GetTxID()+"\x00"+key))
+	escrow := Escrow{Key: key, KeyID: keyID(secret), Threshold: threshold, Shares: []EscrowShare{},
+		CreatorMSP: msp, TxId: APIstub.GetTxID()}
+	seen := map[string]bool{}
+	for i, participant := range participants {
+		if seen[participant.MSP] {
+			return s.returnError("Duplicate participant " + participant.MSP)
+		}
+		seen[participant.MSP] = true
+
+		shareBytes := append([]byte{shares[i].X}, shares[i].Y...)
+		escrowShare := EscrowShare{MSP: participant.MSP, X: shares[i].X, Collection: participant.Collection}
+		if participant.Collection != "" {
+			shareKey, err := APIstub.CreateCompositeKey(escrowShareIndex, []string{key, participant.MSP})
+			if err != nil {
+				return s.returnError("Create composite key failed: " + err.Error())
+			}
+			err = APIstub.PutPrivateData(participant.Collection, shareKey, shareBytes)
+			if err != nil {
+				return s.returnError("Private data write to chain failed: " + err.Error())
+			}
+		} else {
+			recipient, err := s.readRecipientKey(APIstub, participant.MSP)
+			if err != nil {
+				return s.returnError(err.Error())
+			}
+			escrowShare.Wrapped, err = wrapDataKey(APIstub, shareBytes, key, recipient)
+			if err != nil {
+				return s.returnError("Wrap share for " + participant.MSP + " failed: " + err.Error())
+			}
+		}
+		escrow.Shares = append(escrow.Shares, escrowShare)
+	}
+
+	escrowAsBytes, err := json.Marshal(escrow)
+	if err != nil {
+		return s.returnError("Marshal escrow failed: " + err.Error())
+	}
+	err = APIstub.PutState(escrowKey, escrowAsBytes)
+	if err != nil {
+		return s.returnError("Data write to chain failed: " + err.Error())
+	}
+	return shim.Success(escrowAsBytes)
+}
+
+func (s *SmartContract) queryEscrow(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return s.returnError("Wrong number of parameters, need key")
+	}
+
+	_, escrow, err := s.readEscrow(APIstub, args[0])
+	if err != nil {
+		return s.returnError("Query escrow failed: " + err.Error())
+	}
+	if escrow == nil {
+		return shim.Success(nil)
+	}
+	escrowAsBytes, err := json.Marshal(escrow)
+	if err != nil {
+		return s.returnError("Marshal escrow failed: " + err.Error())
+	}
+	return shim.Success(escrowAsBytes)
+}
+
+// queryEscrowShare returns the share of the caller's org, unwrapped with the
+// private key in transient or read from its private collection. Only use it
+// as query, the share must not be committed.
+func (s *SmartContract) queryEscrowShare(APIstub shim.ChaincodeStubInterface, args []string,
+	privateKeyPEM []byte) sc.Response {
+
+	if len(args) != 1 {
+		return s.returnError("Wrong number of parameters, need key")
+	}
+
+	_, escrow, err := s.readEscrow(APIstub, args[0])
+	if err != nil {
+		return s.returnError("Query escrow failed: " + err.Error())
+	}
+	if escrow == nil {
+		return s.returnError("No escrow for " + args[0])
+	}
+	msp, err := cid.GetMSPID(APIstub)
+	if err != nil {
+		return s.returnError("Get MSP ID failed: " + err.Error())
+	}
+
+	for _, escrowShare := range escrow.Shares {
+		if escrowShare.MSP != msp {
+			continue
+		}
+		var shareBytes []byte
+		if escrowShare.Collection != "" {
+			shareKey, err := APIstub.CreateCompositeKey(escrowShareIndex, []string{escrow.Key, msp})
+			if err != nil {
+				return s.returnError("Create composite key failed: " + err.Error())
+			}
+			shareBytes, err = APIstub.GetPrivateData(escrowShare.Collection, shareKey)
+			if err != nil {
+				return s.returnError("Query private data failed: " + err.Error())
+			}
+		} else {
+			if privateKeyPEM == nil {
+				return s.returnError(fmt.Sprintf("Expected transient private key %s", PRIVKEY))
+			}
+			priv, err := parsePrivateKey(privateKeyPEM)
+			if err != nil {
+				return s.returnError(err.Error())
+			}
+			shareBytes, err = unwrapDataKey(priv, escrow.Key, *escrowShare.Wrapped)
+			if err != nil {
+				return s.returnError(err.Error())
+			}
+		}
+		if len(shareBytes) < 2 || shareBytes[0] != escrowShare.X {
+			return s.returnError("Invalid share")
+		}
+
+		shareAsBytes, err := json.Marshal(ShamirShare{X: shareBytes[0], Y: shareBytes[1:]})
+		if err != nil {
+			return s.returnError("Marshal share failed: " + err.Error())
+		}
+		return shim.Success(shareAsBytes)
+	}
+	return s.returnError(msp + " holds no share of " + escrow.Key)
+}
+
+// combineEscrowShares reconstructs the escrowed key from the shares and
+// returns it with the orgs holding the shares
+func combineEscrowShares(escrow *Escrow, sharesAsBytes []byte) ([]byte, []string, error) {
+	var shares []ShamirShare
+	err := json.Unmarshal(sharesAsBytes, &shares)
+	if err != nil {
+		return nil, nil, errors.New("Shares format error: " + err.Error())
+	}
+	if len(shares) < escrow.Threshold {
+		return nil, nil, errors.New("Need at least " + strconv.Itoa(escrow.Threshold) + " shares")
+	}
+
+	holders := map[byte]string{}
+	for _, escrowShare := range escrow.Shares {
+		holders[escrowShare.X] = escrowShare.MSP
+	}
+	shareMSPs := []string{}
+	for _, share := range shares {
+		msp, in := holders[share.X]
+		if !in {
+			return nil, nil, errors.New("Unknown share x " + strconv.Itoa(int(share.X)))
+		}
+		shareMSPs = append(shareMSPs, msp)
+	}
+
+	secret, err := shamirCombine(shares)
+	if err != nil {
+		return nil, nil, errors.New("Combine shares failed: " + err.Error())
+	}
+	if keyID(secret) != escrow.KeyID {
+		return nil, nil, errors.New("Shares do not reconstruct the escrowed key")
+	}
+	return secret, shareMSPs, nil
+}
+
+// recoverEscrowKey checks the shares in transient reconstruct the key and
+// records the recovery, step 1 of a recovery. It returns the record but never
+// the key, see releaseEscrowKey.
+func (s *SmartContract) recoverEscrowKey(APIstub shim.ChaincodeStubInterface, args []string,
+	sharesAsBytes []byte) sc.Response {
+
+	if len(args) != 1 {
+		return s.returnError("Wrong number of parameters, need key")
+	}
+
+	_, escrow, err := s.readEscrow(APIstub, args[0])
+	if err != nil {
+		return s.returnError("Query escrow failed: " + err.Error())
+	}
+	if escrow == nil {
+		return s.returnError("No escrow for " + args[0])
+	}
+	_, shareMSPs, err := combineEscrowShares(escrow, sharesAsBytes)
+	if err != nil {
+		return s.returnError(err.Error())
+	}
+
+	recovery := EscrowRecovery{Key: escrow.Key, KeyID: escrow.KeyID, ShareMSPs: shareMSPs,
+		TxId: APIstub.GetTxID()}
+	recovery.RequesterMSP, err = cid.GetMSPID(APIstub)
+	if err != nil {
+		return s.returnError("Get MSP ID failed: " + err.Error())
+	}
+	txTime, err := txTimestamp(APIstub)
+	if err != nil {
+		return s.returnError("Get transaction timestamp failed: " + err.Error())
+	}
+	recovery.Timestamp = txTime.UTC().Format(time.RFC3339Nano)
+
+	logger.Infof("Escrowed key of %s recovered by %s from shares of %v", escrow.Key,
+		recovery.RequesterMSP, recovery.ShareMSPs)
+
+	recoveryAsBytes, err := json.Marshal(recovery)
+	if err != nil {
+		return s.returnError("Marshal recovery failed: " + err.Error())
+	}
+	recoveryKey, err := APIstub.CreateCompositeKey(escrowRecoveryIndex, []string{escrow.Key, recovery.TxId})
+	if err != nil {
+		return s.returnError("Create composite key failed: " + err.Error())
+	}
+	err = APIstub.PutState(recoveryKey, recoveryAsBytes)
+	if err != nil {
+		return s.returnError("Data write to chain failed: " + err.Error())
+	}
+	err = APIstub.SetEvent("escrowRecovery", recoveryAsBytes)
+	if err != nil {
+		return s.returnError("Set event failed: " + err.Error())
+	}
+	return shim.Success(recoveryAsBytes)
+}
+
+// releaseEscrowKey returns the key sealed with the requester key, step 2 of a
+// recovery. The recovery record of the txId must be committed, the caller's
+// org must have requested it and the shares must be those it records. Only
+// use it as query.
+func (s *SmartContract) releaseEscrowKey(APIstub shim.ChaincodeStubInterface, args []string,
+	sharesAsBytes, responseKey []byte) sc.Response {
+
+	if len(args) != 2 {
+		return s.returnError("Wrong number of parameters, need key & txId of the recovery")
+	}
+
+	escrowKey, escrow, err := s.readEscrow(APIstub, args[0])
+	if err != nil {
+		return s.returnError("Query escrow failed: " + err.Error())
+	}
+	if escrow == nil {
+		return s.returnError("No escrow for " + args[0])
+	}
+	recoveryKey, err := APIstub.CreateCompositeKey(escrowRecoveryIndex, []string{escrow.Key, args[1]})
+	if err != nil {
+		return s.returnError("Create composite key failed: " + err.Error())
+	}
+	recoveryAsBytes, err := APIstub.GetState(recoveryKey)
+	if err != nil {
+		return s.returnError("Query recovery failed: " + err.Error())
+	}
+	if recoveryAsBytes == nil {
+		return s.returnError("No committed recovery of " + escrow.Key + " in transaction " + args[1])
+	}
+	var recovery EscrowRecovery
+	err = json.Unmarshal(recoveryAsBytes, &recovery)
+	if err != nil {
+		return s.returnError("Recovery format error: " + err.Error())
+	}
+	msp, err := cid.GetMSPID(APIstub)
+	if err != nil {
+		return s.returnError("Get MSP ID failed: " + err.Error())
+	}
+	if recovery.RequesterMSP != msp {
+		return s.returnError("Recovery was requested by " + recovery.RequesterMSP + ", not by " + msp)
+	}
+	if recovery.KeyID != escrow.KeyID {
+		return s.returnError("Escrow of " + escrow.Key + " was replaced after the recovery")
+	}
+
+	secret, shareMSPs, err := combineEscrowShares(escrow, sharesAsBytes)
+	if err != nil {
+		return s.returnError(err.Error())
+	}
+	if fmt.Sprint(shareMSPs) != fmt.Sprint(recovery.ShareMSPs) {
+		return s.returnError("Shares differ from the recorded recovery")
+	}
+
+	sealed, err := sealValue(APIstub, responseKey, escrowKey, "recovery", secret)
+	if err != nil {
+		return s.returnError("Seal recovered key failed: " + err.Error())
+	}
+	return shim.Success(sealed)
+}
@@ -0,0 +1,188 @@
+// Written by Xu Chen Hao
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+func TestGF256(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			product := gfMul(byte(a), byte(b))
+			if gfDiv(product, byte(b)) != byte(a) {
+				t.Fatalf("%d * %d / %d != %d", a, b, b, a)
+			}
+		}
+	}
+	// AES polynomial reference value
+	if gfMul(0x57, 0x83) != 0xc1 {
+		t.Errorf("0x57 * 0x83 = %#x, expected 0xc1", gfMul(0x57, 0x83))
+	}
+}
+
+// subsets returns all index subsets of size k of n
+func subsets(n, k int) [][]int {
+	if k == 0 {
+		return [][]int{{}}
+	}
+	var result [][]int
+	for first := 0; first <= n-k; first++ {
+		for _, rest := range subsets(n-first-1, k-1) {
+			subset := []int{first}
+			for _, i := range rest {
+				subset = append(subset, first+1+i)
+			}
+			result = append(result, subset)
+		}
+	}
+	return result
+}
+
+func TestShamirSplitCombine(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	for _, c := range []struct{ n, threshold int }{{2, 2}, {3, 2}, {5, 3}, {6, 6}} {
+		shares := shamirSplit(secret, c.n, c.threshold, []byte("seed"))
+		if len(shares) != c.n {
+			t.Fatalf("expected %d shares, got %d", c.n, len(shares))
+		}
+		for k := c.threshold; k <= c.n; k++ {
+			for _, subset := range subsets(c.n, k) {
+				var picked []ShamirShare
+				for _, i := range subset {
+					picked = append(picked, shares[i])
+				}
+				combined, err := shamirCombine(picked)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(combined, secret) {
+					t.Errorf("%d of %d shares %v do not reconstruct the secret", k, c.n, subset)
+				}
+			}
+		}
+		if c.threshold > 1 {
+			combined, err := shamirCombine(shares[:c.threshold-1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Equal(combined, secret) {
+				t.Errorf("%d shares below threshold %d reconstruct the secret", c.threshold-1, c.threshold)
+			}
+		}
+	}
+}
+
+func TestShamirDeterministic(t *testing.T) {
+	secret := []byte("secret")
+	first := shamirSplit(secret, 4, 3, []byte("tx1"))
+	second := shamirSplit(secret, 4, 3, []byte("tx1"))
+	other := shamirSplit(secret, 4, 3, []byte("tx2"))
+	for i := range first {
+		if !bytes.Equal(first[i].Y, second[i].Y) {
+			t.Errorf("share %d differs for the same seed", i)
+		}
+	}
+	if bytes.Equal(first[0].Y, other[0].Y) {
+		t.Error("shares equal for different seeds")
+	}
+	for i, share := range first {
+		if share.X != byte(i+1) {
+			t.Errorf("share %d has x %d", i, share.X)
+		}
+	}
+}
+
+func TestShamirCombineErrors(t *testing.T) {
+	shares := shamirSplit([]byte("secret"), 3, 2, []byte("seed"))
+	if _, err := shamirCombine(nil); err == nil {
+		t.Error("no shares: expected error")
+	}
+	if _, err := shamirCombine([]ShamirShare{shares[0], shares[0]}); err == nil {
+		t.Error("duplicate x: expected error")
+	}
+	if _, err := shamirCombine([]ShamirShare{{X: 0, Y: shares[0].Y}, shares[1]}); err == nil {
+		t.Error("zero x: expected error")
+	}
+	if _, err := shamirCombine([]ShamirShare{shares[0], {X: 2, Y: []byte{1}}}); err == nil {
+		t.Error("length mismatch: expected error")
+	}
+}
+
+func TestEscrowRecoveryReleasesCommittedOnly(t *testing.T) {
+	s := new(SmartContract)
+	stub := newIdentityStub("Org1MSP", "Org2MSP", "Org3MSP")
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	responseKey := []byte("fedcba9876543210fedcba9876543210")
+	shares := shamirSplit(secret, 3, 2, []byte("seed"))
+	escrow := Escrow{Key: "doc1", KeyID: keyID(secret), Threshold: 2, Shares: []EscrowShare{
+		{MSP: "Org1MSP", X: 1}, {MSP: "Org2MSP", X: 2}, {MSP: "Org3MSP", X: 3}}}
+	escrowAsBytes, err := json.Marshal(escrow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	escrowKey, err := stub.CreateCompositeKey(escrowIndex, []string{"doc1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub.MockTransactionStart("setup")
+	stub.PutState(escrowKey, escrowAsBytes)
+	stub.MockTransactionEnd("setup")
+
+	picked, err := json.Marshal(shares[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := func(txID string, sharesAsBytes []byte) func(shim.ChaincodeStubInterface) sc.Response {
+		return func(stub shim.ChaincodeStubInterface) sc.Response {
+			return s.releaseEscrowKey(stub, []string{"doc1", txID}, sharesAsBytes, responseKey)
+		}
+	}
+
+	stub.as(t, "Org1MSP", false)
+	if response := stub.invoke(release("tx1", picked)); !failed(response) {
+		t.Fatal("key released without recovery")
+	}
+	// the recovery is recorded in tx2
+	response := stub.invoke(func(stub shim.ChaincodeStubInterface) sc.Response {
+		return s.recoverEscrowKey(stub, []string{"doc1"}, picked)
+	})
+	if failed(response) {
+		t.Fatalf("%s", response.Payload)
+	}
+	if bytes.Contains(response.Payload, secret) {
+		t.Error("recovery response holds the key")
+	}
+	event := <-stub.ChaincodeEventsChannel
+	if bytes.Contains(event.Payload, secret) || bytes.Contains(event.Payload, []byte("sealed")) {
+		t.Errorf("recovery event holds the key: %s", event.Payload)
+	}
+
+	others, err := json.Marshal(shares[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response := stub.invoke(release("tx2", others)); !failed(response) {
+		t.Error("key released for other shares than recorded")
+	}
+	stub.as(t, "Org2MSP", false)
+	if response := stub.invoke(release("tx2", picked)); !failed(response) {
+		t.Error("key released to another org")
+	}
+	stub.as(t, "Org1MSP", false)
+	response = stub.invoke(release("tx2", picked))
+	if failed(response) {
+		t.Fatalf("%s", response.Payload)
+	}
+	released, err := openValue(responseKey, escrowKey, response.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(released, secret) {
+		t.Error("released key differs")
+	}
+}
@@ -0,0 +1,343 @@
+// Written by Xu Chen Hao
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+	"strconv"
+	"time"
+)
+
+// The expiry of a key is kept under expiry~key, and ordered by time under
+// expiryOrder~time~key so that purgeExpired only visits expired entries. Once
+// a value expired, the values of the key written before are hidden from the
+// history queries, also after the key is purged or written again.
+const expiryIndex = "expiry"
+const expiryOrderIndex = "expiryOrder"
+
+// default number of keys purged by one purgeExpired call
+const defaultPurgePageSize = 100
+
+// fixed width layout of the expiry order keys, so that they sort by time
+const expiryOrderLayout = "2006-01-02T15:04:05.000000000Z"
+
+type Expiry struct {
+	Key       string `json:"key"`
+	ExpiresAt string `json:"expiresAt,omitempty"`
+	// the values written before expired, they are hidden from history
+	HiddenBefore string `json:"hiddenBefore,omitempty"`
+}
+
+type PurgeSummary struct {
+	TxId   string   `json:"txId"`
+	Purged int      `json:"purged"`
+	Keys   []string `json:"keys"`
+	// set if more expired keys are left to purge
+	More bool `json:"more"`
+}
+
+func parseExpiry(expiresAt string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339Nano, expiresAt)
+	if err != nil {
+		return time.Time{}, errors.New("invalid expiry timestamp, need RFC3339: " + err.Error())
+	}
+	return t, nil
+}
+
+func (s *SmartContract) readExpiry(stub shim.ChaincodeStubInterface, key string) (*Expiry, error) {
+	expiryKey, err := stub.CreateCompositeKey(expiryIndex, []string{key})
+	if err != nil {
+		return nil, err
+	}
+	expiryAsBytes, err := stub.GetState(expiryKey)
+	if err != nil {
+		return nil, err
+	}
+	if expiryAsBytes == nil {
+		return nil, nil
+	}
+	var expiry Expiry
+	err = json.Unmarshal(expiryAsBytes, &expiry)
+	if err != nil {
+		return nil, err
+	}
+	return &expiry, nil
+}
+
+func expiryOrderKey(stub shim.ChaincodeStubInterface, key string, expiresAt time.Time) (string, error) {
+	return stub.CreateCompositeKey(expiryOrderIndex, []string{expiresAt.UTC().Format(expiryOrderLayout), key})
+}
+
+// writeExpiry sets the expiry of key, or removes it if expiresAt is empty. A
+// replaced expiry that has passed hides the values written before it.
+func (s *SmartContract) writeExpiry(stub shim.ChaincodeStubInterface, key, expiresAt string) error {
+	expiryKey, err := stub.CreateCompositeKey(expiryIndex, []string{key})
+	if err != nil {
+		return err
+	}
+	existing, err := s.readExpiry(stub, key)
+	if err != nil {
+		return err
+	}
+
+	expiry := Expiry{Key: key}
+	if existing != nil {
+		expiry.HiddenBefore = existing.HiddenBefore
+	}
+	if existing != nil && existing.ExpiresAt != "" {
+		existingAt, err := parseExpiry(existing.ExpiresAt)
+		if err != nil {
+			return err
+		}
+		orderKey, err := expiryOrderKey(stub, key, existingAt)
+		if err != nil {
+			return err
+		}
+		err = stub.DelState(orderKey)
+		if err != nil {
+			return err
+		}
+		txTime, err := txTimestamp(stub)
+		if err != nil {
+			return err
+		}
+		if !txTime.Before(existingAt) {
+			hidden := time.Time{}
+			if expiry.HiddenBefore != "" {
+				hidden, err = parseExpiry(expiry.HiddenBefore)
+				if err != nil {
+					return err
+				}
+			}
+			if existingAt.After(hidden) {
+				expiry.HiddenBefore = existing.ExpiresAt
+			}
+		}
+	}
+	if expiresAt != "" {
+		t, err := parseExpiry(expiresAt)
+		if err != nil {
+			return err
+		}
+		expiry.ExpiresAt = t.UTC().Format(time.RFC3339Nano)
+		orderKey, err := expiryOrderKey(stub, key, t)
+		if err != nil {
+			return err
+		}
+		err = stub.PutState(orderKey, []byte(key))
+		if err != nil {
+			return err
+		}
+	}
+
+	if expiry.ExpiresAt == "" && expiry.HiddenBefore == "" {
+		if existing == nil {
+			return nil
+		}
+		return stub.DelState(expiryKey)
+	}
+	expiryAsBytes, err := json.Marshal(expiry)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(expiryKey, expiryAsBytes)
+}
+
+// isExpired compares the expiry of key with the transaction timestamp, so
+// that every endorser gets the same result.
+func (s *SmartContract) isExpired(stub shim.ChaincodeStubInterface, key string) (bool, error) {
+	expiry, err := s.readExpiry(stub, key)
+	if err != nil {
+		return false, err
+	}
+	if expiry == nil || expiry.ExpiresAt == "" {
+		return false, nil
+	}
+	expiresAt, err := parseExpiry(expiry.ExpiresAt)
+	if err != nil {
+		return false, err
+	}
+	txTime, err := txTimestamp(stub)
+	if err != nil {
+		return false, err
+	}
+	return !txTime.Before(expiresAt), nil
+}
+
+// hiddenBefore returns the time before which the values of key expired, zero
+// if none did
+func (s *SmartContract) hiddenBefore(stub shim.ChaincodeStubInterface, key string) (time.Time, error) {
+	expiry, err := s.readExpiry(stub, key)
+	if err != nil || expiry == nil {
+		return time.Time{}, err
+	}
+	var hidden time.Time
+	if expiry.HiddenBefore != "" {
+		hidden, err = parseExpiry(expiry.HiddenBefore)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+	expired, err := s.isExpired(stub, key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if expired {
+		expiresAt, err := parseExpiry(expiry.ExpiresAt)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if expiresAt.After(hidden) {
+			hidden = expiresAt
+		}
+	}
+	return hidden, nil
+}
+
+// skipExpired is a key filter for query results
+func (s *SmartContract) skipExpired(stub shim.ChaincodeStubInterface) keyFilter {
+	return func(key string) (bool, error) {
+		return s.isExpired(stub, key)
+	}
+}
+
+// getCommonState reads a common value and treats an expired value as absent
+func (s *SmartContract) getCommonState(stub shim.ChaincodeStubInterface, key string) ([]byte, error) {
+	value, err := s.getState(stub, key)
+	if err != nil || value == nil {
+		return value, err
+	}
+	expired, err := s.isExpired(stub, key)
+	if err != nil {
+		return nil, err
+	}
+	if expired {
+		logger.Debug("Value of key " + key + " is expired")
+		return nil, nil
+	}
+	return value, nil
+}
+
+func (s *SmartContract) setCommonExpiry(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 {
+		return s.returnError("Wrong number of parameters, need key & expiry timestamp (RFC3339, empty to remove)")
+	}
+
+	logger.Debugf("Got request parameters: [key] %s, [expires at] %s", args[0], args[1])
+
+	commonKey := commonPrefix + args[0]
+	current, err := s.getCommonState(APIstub, commonKey)
+	if err != nil {
+		return s.returnError("Query failed: " + err.Error())
+	}
+	if current == nil {
+		return s.returnError("Key " + args[0] + " does not exist")
+	}
+
+	err = s.writeExpiry(APIstub, commonKey, args[1])
+	if err != nil {
+		return s.returnError("Expiry write to chain failed: " + err.Error())
+	}
+	return shim.Success(nil)
+}
+
+func (s *SmartContract) queryCommonExpiry(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return s.returnError("Wrong number of parameters, need query key")
+	}
+
+	expiry, err := s.readExpiry(APIstub, commonPrefix+args[0])
+	if err != nil {
+		return s.returnError("Query failed: " + err.Error())
+	}
+	if expiry == nil || expiry.ExpiresAt == "" {
+		return shim.Success(nil)
+	}
+	expiryAsBytes, err := json.Marshal(expiry)
+	if err != nil {
+		return s.returnError("Marshal expiry failed: " + err.Error())
+	}
+	return shim.Success(expiryAsBytes)
+}
+
+// purgeExpired deletes expired values and removes their expiry. Each call
+// purges at most page size keys, oldest expiry first, call it again while
+// the summary says more are left.
+func (s *SmartContract) purgeExpired(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) > 1 {
+		return s.returnError("Wrong number of parameters, need optional page size")
+	}
+
+	pageSize := defaultPurgePageSize
+	if len(args) > 0 && args[0] != "" {
+		size, err := strconv.Atoi(args[0])
+		if err != nil || size <= 0 {
+			return s.returnError("Invalid page size: " + args[0])
+		}
+		pageSize = size
+	}
+
+	txTime, err := txTimestamp(APIstub)
+	if err != nil {
+		return s.returnError("Get transaction timestamp failed: " + err.Error())
+	}
+
+	// the order index starts with the oldest expiry, and purged entries are
+	// removed from it, so the scan stops at the first entry not expired yet
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(expiryOrderIndex, []string{})
+	if err != nil {
+		return s.returnError("Query failed: " + err.Error())
+	}
+	defer resultsIterator.Close()
+
+	summary := PurgeSummary{TxId: APIstub.GetTxID(), Keys: []string{}}
+	for resultsIterator.HasNext() {
+		item, err := resultsIterator.Next()
+		if err != nil {
+			return s.returnError("Fetch next result failed: " + err.Error())
+		}
+		_, attributes, err := APIstub.SplitCompositeKey(item.Key)
+		if err != nil || len(attributes) != 2 {
+			return s.returnError("Invalid expiry order key: " + item.Key)
+		}
+		expiresAt, err := time.Parse(expiryOrderLayout, attributes[0])
+		if err != nil {
+			return s.returnError("Invalid expiry order key: " + err.Error())
+		}
+		if txTime.Before(expiresAt) {
+			break
+		}
+		if summary.Purged == pageSize {
+			summary.More = true
+			break
+		}
+
+		key := attributes[1]
+		logger.Debug("Purge expired key: " + key)
+		err = APIstub.DelState(key)
+		if err != nil {
+			return s.returnError("Data delete failed: " + err.Error())
+		}
+		err = s.writeExpiry(APIstub, key, "")
+		if err != nil {
+			return s.returnError("Expiry write to chain failed: " + err.Error())
+		}
+		summary.Purged++
+		summary.Keys = append(summary.Keys, key)
+	}
+
+	summaryAsBytes, err := json.Marshal(summary)
+	if err != nil {
+		return s.returnError("Marshal purge summary failed: " + err.Error())
+	}
+	err = APIstub.SetEvent("purgeExpired", summaryAsBytes)
+	if err != nil {
+		return s.returnError("Set event failed: " + err.Error())
+	}
+	return shim.Success(summaryAsBytes)
+}
@@ -0,0 +1,405 @@
+// Written by Xu Chen Hao
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
+	sc "github.com/hyperledger/fabric/protos/peer"
+	"strconv"
+)
+
+const (
+	ExportByRange     = "range"
+	ExportByDocType   = "docType"
+	ExportByComposite = "composite"
+)
+
+// limits of one importState call, so that the transaction stays well below
+// the orderer batch size. Larger exports have to be imported in several calls.
+const maxImportRecords = 500
+const maxImportBytes = 1024 * 1024
+
+// importApproval~hash~mspID is written by an admin of the org that approves
+// the import of the records with that hash
+const importApprovalIndex = "importApproval"
+
+// StateRecord is one line of an export
+type StateRecord struct {
+	Key     string          `json:"key"`
+	Value   json.RawMessage `json:"value,omitempty"`
+	Data    []byte          `json:"data,omitempty"`
+	DocType string          `json:"docType,omitempty"`
+	Meta    *EnvelopeMeta   `json:"meta,omitempty"`
+}
+
+type ImportResult struct {
+	Imported int `json:"imported"`
+}
+
+// assertAdmin checks the client has the "admin" attribute or the admin OU
+func (s *SmartContract) assertAdmin(stub shim.ChaincodeStubInterface) error {
+	admin, found, err := cid.GetAttributeValue(stub, "admin")
+	if err != nil {
+		return err
+	}
+	if found && admin == "true" {
+		return nil
+	}
+	cert, err := cid.GetX509Certificate(stub)
+	if err != nil {
+		return err
+	}
+	if cert != nil {
+		for _, ou := range cert.Subject.OrganizationalUnit {
+			if ou == "admin" {
+				return nil
+			}
+		}
+	}
+	return errors.New("only admins are allowed to call this function")
+}
+
+// assertOrgAdmin checks the client is an admin of the MSP
+func (s *SmartContract) assertOrgAdmin(stub shim.ChaincodeStubInterface, mspID string) error {
+	caller, err := cid.GetMSPID(stub)
+	if err != nil {
+		return err
+	}
+	if caller != mspID {
+		return errors.New("only admins of " + mspID + " are allowed to call this function")
+	}
+	return s.assertAdmin(stub)
+}
+
+// importHash is the hex SHA-256 hash of the JSON Lines records of an import
+func importHash(records string) string {
+	hash := sha256.Sum256([]byte(records))
+	return hex.EncodeToString(hash[:])
+}
+
+// approveImport records the approval of an admin of the caller's org for the
+// import of the records with the given hash.
+func (s *SmartContract) approveImport(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return s.returnError("Wrong number of parameters, need hex SHA-256 hash of the JSON Lines records")
+	}
+	hash, err := hex.DecodeString(args[0])
+	if err != nil || len(hash) != sha256.Size {
+		return s.returnError("Invalid SHA-256 hash: " + args[0])
+	}
+
+	err = s.assertAdmin(APIstub)
+	if err != nil {
+		return s.returnError("Approve import denied: " + err.Error())
+	}
+	mspID, err := cid.GetMSPID(APIstub)
+	if err != nil {
+		return s.returnError("Get client MSP failed: " + err.Error())
+	}
+
+	logger.Debugf("Approve import: [hash] %s, [MSP] %s", args[0], mspID)
+
+	approvalKey, err := APIstub.CreateCompositeKey(importApprovalIndex, []string{hex.EncodeToString(hash), mspID})
+	if err != nil {
+		return s.returnError("Create composite key failed: " + err.Error())
+	}
+	err = APIstub.PutState(approvalKey, []byte(APIstub.GetTxID()))
+	if err != nil {
+		return s.returnError("Data write to chain failed: " + err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// useImportApprovals checks that admins of a majority of the application orgs
+// of the channel approved the records, like the default Admins policy of the
+// channel application. The approvals are deleted, so they are used once.
+func (s *SmartContract) useImportApprovals(stub shim.ChaincodeStubInterface, hash string) error {
+	err := useApprovals(stub, importApprovalIndex, []string{hash})
+	if err != nil {
+		return errors.New("records " + hash + ": " + err.Error())
+	}
+	return nil
+}
+
+// useApprovals checks that admins of a majority of the application orgs of the
+// channel wrote an approval under index~attributes~mspID, and deletes the
+// approvals
+func useApprovals(stub shim.ChaincodeStubInterface, index string, attributes []string) error {
+	orgs, err := applicationOrgs(stub)
+	if err != nil {
+		return err
+	}
+	approvalKeys := []string{}
+	for _, mspID := range orgs {
+		approvalKey, err := stub.CreateCompositeKey(index, append(append([]string{}, attributes...), mspID))
+		if err != nil {
+			return err
+		}
+		approval, err := stub.GetState(approvalKey)
+		if err != nil {
+			return err
+		}
+		if approval != nil {
+			approvalKeys = append(approvalKeys, approvalKey)
+		}
+	}
+	if len(approvalKeys)*2 <= len(orgs) {
+		return fmt.Errorf("admins of %d of %d channel orgs approved, need a majority",
+			len(approvalKeys), len(orgs))
+	}
+	for _, approvalKey := range approvalKeys {
+		err = stub.DelState(approvalKey)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func stateRecord(key string, stored []byte) StateRecord {
+	envelope, value := decodeEnvelope(stored)
+	record := StateRecord{Key: key}
+	if json.Valid(value) {
+		record.Value = json.RawMessage(value)
+	} else {
+		record.Data = value
+	}
+	if envelope.Version > 0 {
+		record.DocType = envelope.DocType
+		record.Meta = &envelope.EnvelopeMeta
+	}
+	return record
+}
+
+// exportState writes one page of state as JSON Lines, followed by a line with
+// the response metadata holding the bookmark of the next page. An export by
+// document type selects enveloped values by their document type, and bare
+// POs and manifests by their schema. Bare values of other document types can
+// not be told apart, so their export by document type needs envelopes.
+func (s *SmartContract) exportState(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) < 3 {
+		return s.returnError("Wrong number of parameters, need mode ('range', 'docType' or 'composite'), " +
+			"mode arguments, page size & bookmark")
+	}
+
+	mode := args[0]
+	var modeArgs []string
+	switch mode {
+	case ExportByRange:
+		if len(args) != 5 {
+			return s.returnError("Wrong number of parameters, need 'range', start key, end key, page size & bookmark")
+		}
+		modeArgs = args[1:3]
+	case ExportByDocType, ExportByComposite:
+		if len(args) != 4 {
+			return s.returnError("Wrong number of parameters, need '" + mode + "', " + mode +
+				", page size & bookmark")
+		}
+		modeArgs = args[1:2]
+	default:
+		return s.returnError("Unknown export mode (need 'range', 'docType' or 'composite'): " + mode)
+	}
+	pageSize, err := strconv.ParseInt(args[len(args)-2], 10, 32)
+	if err != nil {
+		return s.returnError("Error convert page size to int32: " + err.Error())
+	}
+	bookmark := args[len(args)-1]
+
+	// only POs and manifests have a schema to match bare values with
+	schemaMatch := false
+	if mode == ExportByDocType {
+		schemaMatch = modeArgs[0] == DocTypePO || modeArgs[0] == DocTypeManifest
+		enabled, err := s.envelopeEnabled(APIstub)
+		if err != nil {
+			return s.returnError("Query config failed: " + err.Error())
+		}
+		if !enabled && !schemaMatch {
+			return s.returnError("Export of document type " + modeArgs[0] + " needs envelopes, " +
+				"export by range instead")
+		}
+	}
+
+	logger.Debugf("Export state: [mode] %s, [args] %v, [page size] %d, [bookmark] %s",
+		mode, modeArgs, pageSize, bookmark)
+
+	var resultsIterator shim.StateQueryIteratorInterface
+	var responseMetadata *sc.QueryResponseMetadata
+	switch mode {
+	case ExportByRange:
+		resultsIterator, responseMetadata, err = APIstub.GetStateByRangeWithPagination(
+			modeArgs[0], modeArgs[1], int32(pageSize), bookmark)
+	case ExportByDocType:
+		// document types are only known from envelopes, so walk all simple keys
+		resultsIterator, responseMetadata, err = APIstub.GetStateByRangeWithPagination(
+			"", "", int32(pageSize), bookmark)
+	case ExportByComposite:
+		resultsIterator, responseMetadata, err = APIstub.GetStateByPartialCompositeKeyWithPagination(
+			modeArgs[0], []string{}, int32(pageSize), bookmark)
+	}
+	if err != nil {
+		return s.returnError("Query failed: " + err.Error())
+	}
+	defer resultsIterator.Close()
+
+	var buffer bytes.Buffer
+	for resultsIterator.HasNext() {
+		item, err := resultsIterator.Next()
+		if err != nil {
+			return s.returnError("Fetch next result failed: " + err.Error())
+		}
+		record := stateRecord(item.Key, item.Value)
+		if mode == ExportByDocType && record.DocType != modeArgs[0] {
+			if record.Meta != nil || !schemaMatch {
+				continue
+			}
+			// a bare value of the document type passes its validation
+			bare := record
+			bare.DocType = modeArgs[0]
+			if s.validateRecord(bare, item.Value) != nil {
+				continue
+			}
+			record = bare
+		}
+		recordAsBytes, err := json.Marshal(record)
+		if err != nil {
+			return s.returnError("Marshal record failed: " + err.Error())
+		}
+		buffer.Write(recordAsBytes)
+		buffer.WriteString("\n")
+	}
+
+	metadataAsBytes, err := json.Marshal(map[string]interface{}{"ResponseMetadata": map[string]string{
+		"RecordsCount": fmt.Sprintf("%v", responseMetadata.FetchedRecordsCount),
+		"Bookmark":     responseMetadata.Bookmark,
+	}})
+	if err != nil {
+		return s.returnError("Marshal response metadata failed: " + err.Error())
+	}
+	buffer.Write(metadataAsBytes)
+	buffer.WriteString("\n")
+
+	return shim.Success(buffer.Bytes())
+}
+
+// validateRecord checks a record against the validation of its document type
+func (s *SmartContract) validateRecord(record StateRecord, value []byte) error {
+	switch record.DocType {
+	case DocTypePO:
+		var po PO
+		err := json.Unmarshal(value, &po)
+		if err != nil {
+			return errors.New("PO format error: " + err.Error())
+		}
+		if !s.validatePO(po) || poPrefix+po.PoNo != record.Key {
+			return errors.New("invalid PO")
+		}
+	case DocTypeManifest:
+		var manifest Manifest
+		err := json.Unmarshal(value, &manifest)
+		if err != nil {
+			return errors.New("manifest format error: " + err.Error())
+		}
+		if !s.validateManifest(manifest) || manifestPrefix+manifest.MasterBillNo != record.Key {
+			return errors.New("invalid manifest")
+		}
+	}
+	return nil
+}
+
+// importState replays exported JSON Lines records approved by admins of a
+// majority of the channel orgs. Records are stored with envelope metadata of
+// the importing transaction, the metadata of a record is kept as importedMeta.
+func (s *SmartContract) importState(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return s.returnError("Wrong number of parameters, need JSON Lines records")
+	}
+	if len(args[0]) > maxImportBytes {
+		return s.returnError(fmt.Sprintf("Too many bytes to import in one transaction (max %d)", maxImportBytes))
+	}
+
+	err := s.assertAdmin(APIstub)
+	if err != nil {
+		return s.returnError("Import denied: " + err.Error())
+	}
+	err = s.useImportApprovals(APIstub, importHash(args[0]))
+	if err != nil {
+		return s.returnError("Import denied: " + err.Error())
+	}
+
+	var result ImportResult
+	scanner := bufio.NewScanner(bytes.NewReader([]byte(args[0])))
+	scanner.Buffer(make([]byte, 64*1024), maxImportBytes)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var record StateRecord
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			return s.returnError(fmt.Sprintf("Record on line %d format error: %s", line, err))
+		}
+		// skip the response metadata line of an export
+		if record.Key == "" {
+			continue
+		}
+		if result.Imported == maxImportRecords {
+			return s.returnError(fmt.Sprintf("Too many records to import in one transaction (max %d)",
+				maxImportRecords))
+		}
+
+		value := record.Data
+		if record.Value != nil {
+			value = []byte(record.Value)
+		}
+		err = s.validateRecord(record, value)
+		if err != nil {
+			return s.returnError(fmt.Sprintf("Record on line %d (key %s) is invalid: %s", line, record.Key, err))
+		}
+
+		if record.Meta != nil && record.Meta.Version > 0 {
+			var envelope *Envelope
+			envelope, err = newEnvelope(APIstub, record.DocType, value)
+			if err != nil {
+				return s.returnError("Create envelope failed: " + err.Error())
+			}
+			envelope.ImportedMeta = record.Meta
+			var stored []byte
+			stored, err = json.Marshal(envelope)
+			if err != nil {
+				return s.returnError("Marshal envelope failed: " + err.Error())
+			}
+			err = APIstub.PutState(record.Key, stored)
+		} else {
+			err = s.putState(APIstub, record.DocType, record.Key, value)
+		}
+		if err != nil {
+			return s.returnError(fmt.Sprintf("Record on line %d (key %s) write to chain failed: %s",
+				line, record.Key, err))
+		}
+		result.Imported++
+	}
+	if err := scanner.Err(); err != nil {
+		return s.returnError("Read records failed: " + err.Error())
+	}
+
+	logger.Debugf("Imported %d records", result.Imported)
+
+	resultAsBytes, err := json.Marshal(result)
+	if err != nil {
+		return s.returnError("Marshal import result failed: " + err.Error())
+	}
+	return shim.Success(resultAsBytes)
+}
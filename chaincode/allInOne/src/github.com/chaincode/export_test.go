@@ -0,0 +1,65 @@
+// Written by Xu Chen Hao
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+func TestImportNeedsChannelAdmins(t *testing.T) {
+	s := new(SmartContract)
+	stub := newIdentityStub("Org1MSP", "Org2MSP", "Org3MSP")
+	records := `{"key":"k1","value":{"a":1},"docType":"common",` +
+		`"meta":{"$envelope":1,"docType":"common","creatorMSP":"Org9MSP","txId":"forged"}}` + "\n"
+	importRecords := func(shim.ChaincodeStubInterface) sc.Response {
+		return s.importState(stub, []string{records})
+	}
+	approve := func(shim.ChaincodeStubInterface) sc.Response {
+		return s.approveImport(stub, []string{importHash(records)})
+	}
+
+	stub.as(t, "Org2MSP", false)
+	if response := stub.invoke(approve); !failed(response) {
+		t.Fatal("client approved import")
+	}
+	stub.as(t, "Org1MSP", true)
+	if response := stub.invoke(approve); failed(response) {
+		t.Fatalf("%s", response.Payload)
+	}
+	if response := stub.invoke(importRecords); !failed(response) {
+		t.Fatal("import with approval of one of three orgs")
+	}
+
+	stub.as(t, "Org2MSP", true)
+	if response := stub.invoke(approve); failed(response) {
+		t.Fatalf("%s", response.Payload)
+	}
+	stub.as(t, "Org1MSP", false)
+	if response := stub.invoke(importRecords); !failed(response) {
+		t.Fatal("client imported records")
+	}
+	stub.as(t, "Org1MSP", true)
+	if response := stub.invoke(importRecords); failed(response) {
+		t.Fatalf("%s", response.Payload)
+	}
+	if response := stub.invoke(importRecords); !failed(response) {
+		t.Fatal("approvals used twice")
+	}
+
+	var envelope Envelope
+	if err := json.Unmarshal(stub.State["k1"], &envelope); err != nil {
+		t.Fatal(err)
+	}
+	if envelope.CreatorMSP != "Org1MSP" || envelope.TxId == "forged" {
+		t.Errorf("envelope meta not from the importing transaction: %s", stub.State["k1"])
+	}
+	if envelope.ImportedMeta == nil || envelope.ImportedMeta.CreatorMSP != "Org9MSP" {
+		t.Errorf("imported meta not kept: %s", stub.State["k1"])
+	}
+	if string(envelope.Value) != `{"a":1}` {
+		t.Errorf("value changed: %s", envelope.Value)
+	}
+}
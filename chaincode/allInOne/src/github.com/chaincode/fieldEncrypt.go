@@ -0,0 +1,352 @@
+// Written by Xu Chen Hao
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/entities"
+	sc "github.com/hyperledger/fabric/protos/peer"
+	"strings"
+)
+
+// Field level encryption replaces selected fields of a JSON document with
+// "$enc:<algorithm>:<base64 cipher text>" strings. The cipher text is the
+// encrypted JSON encoding of the field, so numbers and objects keep their type
+// after decryption. AES256-GCM fields hold a base64 cipher envelope, the field
+// path is part of its nonce. Fields are selected with dot separated paths such as
+// "goodsInfos.unitPrice", array elements with their index.
+
+// configuration name prefix of the encrypted field paths of a document type,
+// e.g. "encryptFields.po" = "goodsInfos.unitPrice,totalAmount"
+const ConfigEncryptFields = "encryptFields."
+
+const fieldCipherPrefix = "$enc:"
+
+// algorithm marker of the legacy entities AES-256 encrypter
+const FieldAlgAES256CBC = "AES256-CBC"
+
+// encryptedFieldPaths returns the paths passed with the call, or the paths
+// configured for the document type
+func (s *SmartContract) encryptedFieldPaths(stub shim.ChaincodeStubInterface, docType,
+	pathsJSON string) ([]string, error) {
+
+	var paths []string
+	if pathsJSON != "" {
+		err := json.Unmarshal([]byte(pathsJSON), &paths)
+		if err != nil {
+			return nil, errors.New("field paths must be a JSON array of strings: " + err.Error())
+		}
+	} else {
+		configured, err := s.getConfig(stub, ConfigEncryptFields+docType)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range strings.Split(configured, ",") {
+			if path = strings.TrimSpace(path); path != "" {
+				paths = append(paths, path)
+			}
+		}
+	}
+	if len(paths) == 0 {
+		return nil, errors.New("no encrypted fields passed or configured for document type " + docType)
+	}
+	return paths, nil
+}
+
+func isEncryptedField(value interface{}) bool {
+	text, ok := value.(string)
+	return ok && strings.HasPrefix(text, fieldCipherPrefix)
+}
+
+// hasEncryptedFields tells whether any field of a decoded JSON document is
+// encrypted
+func hasEncryptedFields(node interface{}) bool {
+	switch value := node.(type) {
+	case map[string]interface{}:
+		for _, child := range value {
+			if hasEncryptedFields(child) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, child := range value {
+			if hasEncryptedFields(child) {
+				return true
+			}
+		}
+	default:
+		return isEncryptedField(value)
+	}
+	return false
+}
+
+// encryptFields encrypts the fields at paths in place. A missing field is an
+// error, so that a misspelled path never leaves a field in plain text.
+func (s *SmartContract) encryptFields(stub shim.ChaincodeStubInterface, encKey []byte, stateKey string,
+	doc interface{}, paths []string) (interface{}, error) {
+
+	for _, path := range paths {
+		tokens := strings.Split(path, ".")
+		value, err := pointerGet(doc, tokens)
+		if err != nil {
+			return nil, errors.New("field " + path + " to encrypt: " + err.Error())
+		}
+		if isEncryptedField(value) {
+			continue
+		}
+		valueAsBytes, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		cipherText, err := sealValue(stub, encKey, stateKey, path, valueAsBytes)
+		if err != nil {
+			return nil, err
+		}
+		doc, err = pointerSet(doc, tokens,
+			fieldCipherPrefix+CipherAlgAES256GCM+":"+base64.StdEncoding.EncodeToString(cipherText))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// decryptField decrypts one "$enc:<algorithm>:<cipher text>" field
+func (s *SmartContract) decryptField(stub shim.ChaincodeStubInterface, decKey, IV []byte, stateKey string,
+	field string) (interface{}, error) {
+
+	parts := strings.SplitN(strings.TrimPrefix(field, fieldCipherPrefix), ":", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("invalid encrypted field")
+	}
+	cipherText, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+
+	var clearText []byte
+	switch parts[0] {
+	case CipherAlgAES256GCM:
+		clearText, err = openValue(decKey, stateKey, cipherText)
+	case FieldAlgAES256CBC:
+		var ent entities.Encrypter
+		ent, err = entities.NewAES256EncrypterEntity("ID", s.bccspInst, decKey, IV)
+		if err != nil {
+			return nil, errors.New("entities.NewAES256EncrypterEntity failed, err: " + err.Error())
+		}
+		clearText, err = s.decrypt(stub, ent, cipherText)
+	default:
+		return nil, errors.New("unsupported field encryption algorithm: " + parts[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON(clearText)
+}
+
+// decryptFields decrypts every encrypted field of the document, or only the
+// fields at paths if any are given
+func (s *SmartContract) decryptFields(stub shim.ChaincodeStubInterface, decKey, IV []byte, stateKey string,
+	doc interface{}, paths []string) (interface{}, error) {
+
+	if len(paths) > 0 {
+		for _, path := range paths {
+			tokens := strings.Split(path, ".")
+			value, err := pointerGet(doc, tokens)
+			if err != nil || !isEncryptedField(value) {
+				continue
+			}
+			clear, err := s.decryptField(stub, decKey, IV, stateKey, value.(string))
+			if err != nil {
+				return nil, errors.New("decrypt field " + path + " failed: " + err.Error())
+			}
+			doc, err = pointerSet(doc, tokens, clear)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return doc, nil
+	}
+
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		for name, value := range node {
+			clear, err := s.decryptFields(stub, decKey, IV, stateKey, value, nil)
+			if err != nil {
+				return nil, err
+			}
+			node[name] = clear
+		}
+	case []interface{}:
+		for i, value := range node {
+			clear, err := s.decryptFields(stub, decKey, IV, stateKey, value, nil)
+			if err != nil {
+				return nil, err
+			}
+			node[i] = clear
+		}
+	case string:
+		if isEncryptedField(node) {
+			return s.decryptField(stub, decKey, IV, stateKey, node)
+		}
+	}
+	return doc, nil
+}
+
+// fieldDocumentKey returns the state key of a document and validates it
+func (s *SmartContract) fieldDocumentKey(docType, key string, document []byte) (string, error) {
+	switch docType {
+	case DocTypePO:
+		var po PO
+		err := json.Unmarshal(document, &po)
+		if err != nil {
+			return "", errors.New("PO format error: " + err.Error())
+		}
+		if !s.validatePO(po) {
+			return "", errors.New("invalid PO")
+		}
+		if key != "" && key != po.PoNo {
+			return "", errors.New("key does not match poNo")
+		}
+		return poPrefix + po.PoNo, nil
+	case DocTypeManifest:
+		var manifest Manifest
+		err := json.Unmarshal(document, &manifest)
+		if err != nil {
+			return "", errors.New("manifest format error: " + err.Error())
+		}
+		if !s.validateManifest(manifest) {
+			return "", errors.New("invalid manifest")
+		}
+		if key != "" && key != manifest.MasterBillNo {
+			return "", errors.New("key does not match masterBillNo")
+		}
+		return manifestPrefix + manifest.MasterBillNo, nil
+	case DocTypeCommon:
+		if key == "" {
+			return "", errors.New("need key for common document")
+		}
+		return commonPrefix + key, nil
+	default:
+		return "", errors.New("unsupported document type (need 'po', 'manifest' or 'common'): " + docType)
+	}
+}
+
+// stateKey returns the state key of a document
+func (s *SmartContract) stateKey(docType, key string) (string, error) {
+	switch docType {
+	case DocTypePO:
+		return poPrefix + key, nil
+	case DocTypeManifest:
+		return manifestPrefix + key, nil
+	case DocTypeCommon:
+		return commonPrefix + key, nil
+	case DocTypeEncrypted:
+		return encryptPrefix + key, nil
+	default:
+		return "", errors.New("unsupported document type (need 'po', 'manifest', 'common' or 'encrypted'): " +
+			docType)
+	}
+}
+
+// uploadEncFields stores a PO, manifest or common JSON document with the
+// selected fields encrypted. The key may be empty for PO and manifest. The
+// typed PO and manifest functions can not handle encrypted fields, patchPO
+// and patchManifest reject these documents, upload them again instead.
+func (s *SmartContract) uploadEncFields(APIstub shim.ChaincodeStubInterface, args []string,
+	encKey []byte) sc.Response {
+
+	if len(args) != 3 && len(args) != 4 {
+		return s.returnError("Wrong number of parameters, need document type, key, document " +
+			"& optional field paths (JSON array)")
+	}
+
+	docType, key, document := args[0], args[1], []byte(args[2])
+	pathsJSON := ""
+	if len(args) == 4 {
+		pathsJSON = args[3]
+	}
+
+	stateKey, err := s.fieldDocumentKey(docType, key, document)
+	if err != nil {
+		return s.returnError("Document validation failed: " + err.Error())
+	}
+	paths, err := s.encryptedFieldPaths(APIstub, docType, pathsJSON)
+	if err != nil {
+		return s.returnError(err.Error())
+	}
+
+	logger.Debugf("Encrypt fields %v of %s document %s", paths, docType, stateKey)
+
+	doc, err := decodeJSON(document)
+	if err != nil {
+		return s.returnError("Document is not valid JSON: " + err.Error())
+	}
+	doc, err = s.encryptFields(APIstub, encKey, stateKey, doc, paths)
+	if err != nil {
+		return s.returnError("Encrypt fields failed: " + err.Error())
+	}
+
+	docAsBytes, err := json.Marshal(doc)
+	if err != nil {
+		return s.returnError("Marshal document failed: " + err.Error())
+	}
+	// the policy is derived from the plain text parties
+	err = s.setPartyKEP(kepStore{stub: APIstub}, docType, stateKey, json.RawMessage(document))
+	if err != nil {
+		return s.returnError("Set endorsement policy failed: " + err.Error())
+	}
+	logger.Debugf("Write chain: %s", redactDocument(docAsBytes))
+	err = s.putState(APIstub, docType, stateKey, docAsBytes)
+	if err != nil {
+		return s.returnError("Data write to chain failed: " + err.Error())
+	}
+	return shim.Success(docAsBytes)
+}
+
+// queryDecFields reads a document and decrypts its encrypted fields, or only
+// the fields at the optional paths
+func (s *SmartContract) queryDecFields(APIstub shim.ChaincodeStubInterface, args []string,
+	decKey, IV []byte) sc.Response {
+
+	if len(args) != 2 && len(args) != 3 {
+		return s.returnError("Wrong number of parameters, need document type, key & optional field paths (JSON array)")
+	}
+
+	stateKey, err := s.stateKey(args[0], args[1])
+	if err != nil {
+		return s.returnError(err.Error())
+	}
+	var paths []string
+	if len(args) == 3 && args[2] != "" {
+		err = json.Unmarshal([]byte(args[2]), &paths)
+		if err != nil {
+			return s.returnError("Field paths must be a JSON array of strings: " + err.Error())
+		}
+	}
+
+	docAsBytes, err := s.getState(APIstub, stateKey)
+	if err != nil {
+		return s.returnError("Query failed: " + err.Error())
+	}
+	if docAsBytes == nil {
+		return shim.Success(nil)
+	}
+	doc, err := decodeJSON(docAsBytes)
+	if err != nil {
+		return s.returnError("Stored document is not valid JSON: " + err.Error())
+	}
+
+	doc, err = s.decryptFields(APIstub, decKey, IV, stateKey, doc, paths)
+	if err != nil {
+		return s.returnError("Decrypt fields failed: " + err.Error())
+	}
+
+	docAsBytes, err = json.Marshal(doc)
+	if err != nil {
+		return s.returnError("Marshal document failed: " + err.Error())
+	}
+	return shim.Success(docAsBytes)
+}
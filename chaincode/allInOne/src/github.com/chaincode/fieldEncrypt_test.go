@@ -0,0 +1,87 @@
+// Written by Xu Chen Hao
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/statebased"
+)
+
+var testFieldKey = bytes.Repeat([]byte{7}, 32)
+
+func TestEncryptFieldsMissingPath(t *testing.T) {
+	s := new(SmartContract)
+	stub := shim.NewMockStub("fields", nil)
+	stub.MockTransactionStart("tx1")
+	defer stub.MockTransactionEnd("tx1")
+
+	doc, err := decodeJSON([]byte(`{"a":{"b":1},"c":"text"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.encryptFields(stub, testFieldKey, "k", doc, []string{"a.b", "a.x"}); err == nil {
+		t.Fatal("missing field a.x encrypted without error")
+	}
+
+	doc, err = decodeJSON([]byte(`{"a":{"b":1},"c":"text"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err = s.encryptFields(stub, testFieldKey, "k", doc, []string{"a.b", "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range [][]string{{"a", "b"}, {"c"}} {
+		value, err := pointerGet(doc, path)
+		if err != nil || !isEncryptedField(value) {
+			t.Errorf("field %v not encrypted: %v", path, value)
+		}
+	}
+}
+
+func TestUploadEncFieldsSetsPartyKEP(t *testing.T) {
+	s := new(SmartContract)
+	stub := shim.NewMockStub("fields", nil)
+	stub.MockTransactionStart("tx1")
+	defer stub.MockTransactionEnd("tx1")
+	for party, msp := range map[string]string{"Buyer1": "Org1MSP", "Seller1": "Org2MSP"} {
+		partyKey, err := stub.CreateCompositeKey(partyIndex, []string{party})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stub.PutState(partyKey, []byte(msp))
+	}
+
+	po := `{"poNo":"po1","buyer":"Buyer1","seller":"Seller1",` +
+		`"goodsInfos":{"unitPrice":2,"quantity":3,"amount":6}}`
+	response := s.uploadEncFields(stub, []string{DocTypePO, "", po, `["buyer","goodsInfos.unitPrice"]`},
+		testFieldKey)
+	if failed(response) {
+		t.Fatalf("%s", response.Payload)
+	}
+	var stored map[string]interface{}
+	if err := json.Unmarshal(stub.State[poPrefix+"po1"], &stored); err != nil {
+		t.Fatal(err)
+	}
+	if !isEncryptedField(stored["buyer"]) {
+		t.Errorf("buyer not encrypted: %v", stored["buyer"])
+	}
+
+	epBytes, err := stub.GetStateValidationParameter(poPrefix + "po1")
+	if err != nil || epBytes == nil {
+		t.Fatalf("no endorsement policy: %v", err)
+	}
+	ep, err := statebased.NewStateEP(epBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orgs := ep.ListOrgs()
+	sort.Strings(orgs)
+	if len(orgs) != 2 || orgs[0] != "Org1MSP" || orgs[1] != "Org2MSP" {
+		t.Errorf("expected policy of Org1MSP and Org2MSP, got %v", orgs)
+	}
+}
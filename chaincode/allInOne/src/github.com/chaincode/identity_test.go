@@ -0,0 +1,159 @@
+// Written by Xu Chen Hao
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/common"
+	"github.com/hyperledger/fabric/protos/msp"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// identityStub is a MockStub with a client identity and a channel config
+// holding the given application orgs, served by a fake qscc
+type identityStub struct {
+	*shim.MockStub
+	creator []byte
+	orgs    []string
+	tx      int
+}
+
+func newIdentityStub(orgs ...string) *identityStub {
+	return &identityStub{MockStub: shim.NewMockStub("identity", nil), orgs: orgs}
+}
+
+func (stub *identityStub) GetCreator() ([]byte, error) {
+	return stub.creator, nil
+}
+
+// as sets the client to a new certificate of the MSP, with the admin OU if
+// admin is set
+func (stub *identityStub) as(t *testing.T, mspID string, admin bool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ou := "client"
+	if admin {
+		ou = "admin"
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: ou + "@" + mspID, OrganizationalUnit: []string{ou}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub.creator, err = proto.Marshal(&msp.SerializedIdentity{
+		Mspid:   mspID,
+		IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// invoke runs f in a new transaction
+func (stub *identityStub) invoke(f func(shim.ChaincodeStubInterface) sc.Response) sc.Response {
+	stub.tx++
+	txID := "tx" + big.NewInt(int64(stub.tx)).String()
+	stub.MockTransactionStart(txID)
+	defer stub.MockTransactionEnd(txID)
+	return f(stub)
+}
+
+// failed tells whether a handler returned an error, which handlers return as
+// a reason payload
+func failed(response sc.Response) bool {
+	if response.Status != shim.OK {
+		return true
+	}
+	var re R_Err
+	return json.Unmarshal(response.Payload, &re) == nil && re.Reason != ""
+}
+
+func (stub *identityStub) InvokeChaincode(name string, args [][]byte, channel string) sc.Response {
+	if name != "qscc" {
+		return shim.Error("unknown chaincode " + name)
+	}
+	switch string(args[0]) {
+	case "GetChainInfo":
+		payload, err := proto.Marshal(&common.BlockchainInfo{Height: 1})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		return shim.Success(payload)
+	case "GetBlockByNumber":
+		block, err := stub.configBlock()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		payload, err := proto.Marshal(block)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		return shim.Success(payload)
+	}
+	return shim.Error("unknown qscc function " + string(args[0]))
+}
+
+// configBlock is block 0 holding the channel config, which is its own last
+// config block
+func (stub *identityStub) configBlock() (*common.Block, error) {
+	application := &common.ConfigGroup{Groups: map[string]*common.ConfigGroup{}}
+	for _, mspID := range stub.orgs {
+		fabricConfig, err := proto.Marshal(&msp.FabricMSPConfig{Name: mspID})
+		if err != nil {
+			return nil, err
+		}
+		mspConfig, err := proto.Marshal(&msp.MSPConfig{Config: fabricConfig})
+		if err != nil {
+			return nil, err
+		}
+		application.Groups[mspID] = &common.ConfigGroup{
+			Values: map[string]*common.ConfigValue{"MSP": {Value: mspConfig}},
+		}
+	}
+	configEnvelope, err := proto.Marshal(&common.ConfigEnvelope{Config: &common.Config{
+		ChannelGroup: &common.ConfigGroup{Groups: map[string]*common.ConfigGroup{"Application": application}},
+	}})
+	if err != nil {
+		return nil, err
+	}
+	payload, err := proto.Marshal(&common.Payload{Data: configEnvelope})
+	if err != nil {
+		return nil, err
+	}
+	envelope, err := proto.Marshal(&common.Envelope{Payload: payload})
+	if err != nil {
+		return nil, err
+	}
+	lastConfig, err := proto.Marshal(&common.LastConfig{Index: 0})
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := proto.Marshal(&common.Metadata{Value: lastConfig})
+	if err != nil {
+		return nil, err
+	}
+	blockMetadata := make([][]byte, common.BlockMetadataIndex_LAST_CONFIG+1)
+	blockMetadata[common.BlockMetadataIndex_LAST_CONFIG] = metadata
+	return &common.Block{
+		Data:     &common.BlockData{Data: [][]byte{envelope}},
+		Metadata: &common.BlockMetadata{Metadata: blockMetadata},
+	}, nil
+}
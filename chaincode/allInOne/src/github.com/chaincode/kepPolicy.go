@@ -0,0 +1,160 @@
+// Written by Xu Chen Hao
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/common/cauthdsl"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/common"
+	"github.com/hyperledger/fabric/protos/msp"
+	sc "github.com/hyperledger/fabric/protos/peer"
+	"strconv"
+	"strings"
+)
+
+// A key-level endorsement policy may be any signature policy expression of
+// the cauthdsl syntax, e.g. OR(AND('Org1MSP.member','Org2MSP.member'),'Org3MSP.peer').
+// The statebased helper behind kepAddOrgs and kepDelOrgs only keeps the orgs
+// of a policy, so changing orgs of a key with an expression policy replaces
+// the expression with an AND of all its orgs.
+
+type KEPPolicy struct {
+	Key    string `json:"key"`
+	Policy string `json:"policy"`
+}
+
+var policyRoleNames = map[msp.MSPRole_MSPRoleType]string{
+	msp.MSPRole_MEMBER: cauthdsl.RoleMember,
+	msp.MSPRole_ADMIN:  cauthdsl.RoleAdmin,
+	msp.MSPRole_CLIENT: cauthdsl.RoleClient,
+	msp.MSPRole_PEER:   cauthdsl.RolePeer,
+}
+
+// policyToString renders a signature policy in the syntax of the cauthdsl
+// parser
+func policyToString(envelope *common.SignaturePolicyEnvelope) (string, error) {
+	principals := make([]string, len(envelope.Identities))
+	for i, identity := range envelope.Identities {
+		if identity.PrincipalClassification != msp.MSPPrincipal_ROLE {
+			return "", errors.New("unsupported principal classification " +
+				identity.PrincipalClassification.String())
+		}
+		var role msp.MSPRole
+		err := proto.Unmarshal(identity.Principal, &role)
+		if err != nil {
+			return "", err
+		}
+		roleName, in := policyRoleNames[role.Role]
+		if !in {
+			return "", errors.New("unsupported role " + role.Role.String())
+		}
+		principals[i] = "'" + role.MspIdentifier + "." + roleName + "'"
+	}
+	return signaturePolicyToString(envelope.Rule, principals)
+}
+
+func signaturePolicyToString(policy *common.SignaturePolicy, principals []string) (string, error) {
+	switch rule := policy.GetType().(type) {
+	case *common.SignaturePolicy_SignedBy:
+		if rule.SignedBy < 0 || int(rule.SignedBy) >= len(principals) {
+			return "", errors.New("signed by unknown identity " + strconv.Itoa(int(rule.SignedBy)))
+		}
+		return principals[rule.SignedBy], nil
+	case *common.SignaturePolicy_NOutOf_:
+		rules := make([]string, len(rule.NOutOf.Rules))
+		for i, child := range rule.NOutOf.Rules {
+			childString, err := signaturePolicyToString(child, principals)
+			if err != nil {
+				return "", err
+			}
+			rules[i] = childString
+		}
+		n := int(rule.NOutOf.N)
+		switch {
+		case n == len(rules):
+			return "AND(" + strings.Join(rules, ",") + ")", nil
+		case n == 1:
+			return "OR(" + strings.Join(rules, ",") + ")", nil
+		default:
+			return "OutOf(" + strconv.Itoa(n) + "," + strings.Join(rules, ",") + ")", nil
+		}
+	default:
+		return "", errors.New("unsupported signature policy type")
+	}
+}
+
+// kepSetPolicy sets the endorsement policy expression for the keys of a
+// document type
+func (s *SmartContract) kepSetPolicy(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 3 {
+		return s.returnError("Wrong number of parameters, need document type, key (or JSON array of keys) " +
+			"& policy expression")
+	}
+
+	logger.Debugf("Got key-level endorsement policy keys: [type] %s, [keys] %s, [policy] %s",
+		args[0], args[1], args[2])
+	epKeys, err := s.kepStateKeys(stub, args[0], args[1])
+	if err != nil {
+		return s.returnError(err.Error())
+	}
+
+	envelope, err := cauthdsl.FromString(args[2])
+	if err != nil {
+		return s.returnError("Error parse endorsement policy: " + err.Error())
+	}
+	epBytes, err := proto.Marshal(envelope)
+	if err != nil {
+		return s.returnError("Error generate endorsement policy bytes: " + err.Error())
+	}
+
+	for _, epKey := range epKeys {
+		err = stub.SetStateValidationParameter(epKey, epBytes)
+		if err != nil {
+			return s.returnError("Error set key level endorsement policy: " + err.Error())
+		}
+	}
+
+	return shim.Success(nil)
+}
+
+// kepQueryPolicy returns the endorsement policy expression of the keys of a
+// document type, empty for keys without key-level endorsement policy
+func (s *SmartContract) kepQueryPolicy(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 2 {
+		return s.returnError("Wrong number of parameters, need document type & key (or JSON array of keys)")
+	}
+
+	epKeys, err := s.kepStateKeys(stub, args[0], args[1])
+	if err != nil {
+		return s.returnError(err.Error())
+	}
+
+	results := []KEPPolicy{}
+	for _, epKey := range epKeys {
+		epBytes, err := stub.GetStateValidationParameter(epKey)
+		if err != nil {
+			return s.returnError("Error get endorsement policy: " + err.Error())
+		}
+		result := KEPPolicy{Key: epKey}
+		if len(epBytes) != 0 {
+			var envelope common.SignaturePolicyEnvelope
+			err = proto.Unmarshal(epBytes, &envelope)
+			if err != nil {
+				return s.returnError("Error parse endorsement policy bytes: " + err.Error())
+			}
+			result.Policy, err = policyToString(&envelope)
+			if err != nil {
+				return s.returnError("Error render endorsement policy: " + err.Error())
+			}
+		}
+		results = append(results, result)
+	}
+	resultsAsBytes, err := json.Marshal(results)
+	if err != nil {
+		return s.returnError("Error marshal policy json: " + err.Error())
+	}
+
+	return shim.Success(resultsAsBytes)
+}
@@ -0,0 +1,53 @@
+// Written by Xu Chen Hao
+package main
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/common/cauthdsl"
+	"github.com/hyperledger/fabric/protos/common"
+)
+
+func TestPolicyToStringRoundTrip(t *testing.T) {
+	expressions := []string{
+		"OR('Org1MSP.member','Org2MSP.peer')",
+		"AND('Org1MSP.admin','Org2MSP.client')",
+		"OR(AND('Org1MSP.member','Org2MSP.member'),'Org3MSP.peer')",
+		"OutOf(2,'Org1MSP.member','Org2MSP.member','Org3MSP.member')",
+		"AND('Org1MSP.member',OutOf(2,'Org2MSP.member','Org3MSP.member',OR('Org4MSP.admin','Org5MSP.peer')))",
+	}
+	for _, expression := range expressions {
+		envelope, err := cauthdsl.FromString(expression)
+		if err != nil {
+			t.Fatalf("parse %s: %s", expression, err)
+		}
+		rendered, err := policyToString(envelope)
+		if err != nil {
+			t.Fatalf("render %s: %s", expression, err)
+		}
+		parsed, err := cauthdsl.FromString(rendered)
+		if err != nil {
+			t.Fatalf("parse rendered %s: %s", rendered, err)
+		}
+		if !proto.Equal(envelope, parsed) {
+			t.Errorf("round trip of %s changed the policy, rendered %s", expression, rendered)
+		}
+	}
+}
+
+func TestPolicyToStringRejects(t *testing.T) {
+	envelope, err := cauthdsl.FromString("OR('Org1MSP.member','Org2MSP.member')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope.Rule.GetNOutOf().Rules[1] = &common.SignaturePolicy{
+		Type: &common.SignaturePolicy_SignedBy{SignedBy: 5},
+	}
+	if _, err = policyToString(envelope); err == nil {
+		t.Error("expected error for unknown identity")
+	}
+	if _, err = policyToString(&common.SignaturePolicyEnvelope{Rule: &common.SignaturePolicy{}}); err == nil {
+		t.Error("expected error for empty rule")
+	}
+}
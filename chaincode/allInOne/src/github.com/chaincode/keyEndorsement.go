@@ -3,86 +3,230 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	"github.com/hyperledger/fabric/core/chaincode/shim/ext/statebased"
 	sc "github.com/hyperledger/fabric/protos/peer"
+	"strings"
 )
 
-func (s *SmartContract) kepAddOrgs(stub shim.ChaincodeStubInterface, args []string) sc.Response {
-	if len(args) < 3 {
-		return s.returnError("Wrong number of parameters, expect more than 2")
-	}
+// key type of the key-level endorsement policy functions for composite keys,
+// given as JSON array of object type and attributes
+const DocTypeComposite = "composite"
 
-	key := args[0]
-	logger.Debug("Got key-level endorsement policy key: " + key)
-	epKey := poPrefix + key
+type KEPOrgs struct {
+	Key  string   `json:"key"`
+	Orgs []string `json:"orgs"`
+}
 
-	roleType := statebased.RoleType(args[1])
-	if roleType != statebased.RoleTypeMember && roleType != statebased.RoleTypePeer {
-		return s.returnError("Wrong role type specified (need 'MEMBER' or 'PEER'): " + args[1])
+// kepStateKeys resolves the keys of a document type to the state keys the
+// writers use. The keys are a single key or a JSON array of keys to apply the
+// policy change to all of them. Composite keys are JSON arrays of object type
+// and attributes, e.g. ["escrow","k1"], batches are arrays of these.
+func (s *SmartContract) kepStateKeys(stub shim.ChaincodeStubInterface, docType, keys string) ([]string, error) {
+	if docType == DocTypeComposite {
+		var batch [][]string
+		if err := json.Unmarshal([]byte(keys), &batch); err != nil {
+			var single []string
+			if err := json.Unmarshal([]byte(keys), &single); err != nil {
+				return nil, errors.New("composite key must be a JSON array of object type and attributes")
+			}
+			batch = [][]string{single}
+		}
+		stateKeys := make([]string, 0, len(batch))
+		for _, parts := range batch {
+			if len(parts) == 0 {
+				return nil, errors.New("composite key without object type")
+			}
+			stateKey, err := stub.CreateCompositeKey(parts[0], parts[1:])
+			if err != nil {
+				return nil, err
+			}
+			stateKeys = append(stateKeys, stateKey)
+		}
+		return stateKeys, nil
 	}
 
-	// get the endorsement policy for the key
-	epBytes, err := stub.GetStateValidationParameter(epKey)
+	batch, err := parseKEPKeys(keys)
 	if err != nil {
-		return s.returnError("Error get endorsement policy: " + err.Error())
+		return nil, err
 	}
-	ep, err := statebased.NewStateEP(epBytes)
-	if err != nil {
-		return s.returnError("Error generate new endorsement policy: " + err.Error())
+	stateKeys := make([]string, 0, len(batch))
+	for _, key := range batch {
+		stateKey, err := s.stateKey(docType, key)
+		if err != nil {
+			return nil, err
+		}
+		stateKeys = append(stateKeys, stateKey)
 	}
+	return stateKeys, nil
+}
 
-	logger.Debugf("Organizations to be set to key-level endorsement policy: %v", args[2:])
-	// add organizations to endorsement policy
-	err = ep.AddOrgs(roleType, args[2:]...)
-	if err != nil {
-		return s.returnError("Error add organizations to endorsement policy: " + err.Error())
+// parseKEPKeys returns a single key or the keys of a JSON array
+func parseKEPKeys(keys string) ([]string, error) {
+	batch := []string{keys}
+	if strings.HasPrefix(keys, "[") {
+		if err := json.Unmarshal([]byte(keys), &batch); err != nil {
+			return nil, errors.New("keys format error: " + err.Error())
+		}
 	}
-	epBytes, err = ep.Policy()
-	if err != nil {
-		return s.returnError("Error generate endorsement policy bytes: " + err.Error())
+	return batch, nil
+}
+
+// kepStore reads and writes the endorsement policies of public state, or of
+// a private data collection if set
+type kepStore struct {
+	stub       shim.ChaincodeStubInterface
+	collection string
+}
+
+func (k kepStore) get(key string) ([]byte, error) {
+	if k.collection == "" {
+		return k.stub.GetStateValidationParameter(key)
 	}
+	return k.stub.GetPrivateDataValidationParameter(k.collection, key)
+}
+
+func (k kepStore) set(key string, ep []byte) error {
+	if k.collection == "" {
+		return k.stub.SetStateValidationParameter(key, ep)
+	}
+	return k.stub.SetPrivateDataValidationParameter(k.collection, key, ep)
+}
+
+// kepPrivateIndex marks in public state the private data keys that were
+// created, so that all endorsers agree on new keys whether they are members
+// of the collection or not
+const kepPrivateIndex = "kepPrivate"
 
-	// set the modified endorsement policy for the key
-	err = stub.SetStateValidationParameter(epKey, epBytes)
+func (k kepStore) markerKey(key string) (string, error) {
+	return k.stub.CreateCompositeKey(kepPrivateIndex, []string{k.collection, key})
+}
+
+// exists tells whether the key has a value yet. Private data keys are looked
+// up by their public marker, never in the collection itself.
+func (k kepStore) exists(key string) (bool, error) {
+	if k.collection == "" {
+		value, err := k.stub.GetState(key)
+		return value != nil, err
+	}
+	markerKey, err := k.markerKey(key)
 	if err != nil {
-		return s.returnError("Error set key level endorsement policy: " + err.Error())
+		return false, err
 	}
+	value, err := k.stub.GetState(markerKey)
+	return value != nil, err
+}
 
-	return shim.Success(nil)
+// mark records a new private data key in public state, the marker holds the
+// creating transaction ID
+func (k kepStore) mark(key string) error {
+	if k.collection == "" {
+		return nil
+	}
+	markerKey, err := k.markerKey(key)
+	if err != nil {
+		return err
+	}
+	return k.stub.PutState(markerKey, []byte(k.stub.GetTxID()))
 }
 
+// updateKEP applies the change to the endorsement policy of every key
+func (s *SmartContract) updateKEP(store kepStore, epKeys []string,
+	change func(ep statebased.KeyEndorsementPolicy) error) error {
 
-func (s *SmartContract) kepDelOrgs(stub shim.ChaincodeStubInterface, args []string) sc.Response {
-	if len(args) < 2 {
-		return s.returnError("No orgs to delete specified")
+	for _, epKey := range epKeys {
+		// get the endorsement policy for the key
+		epBytes, err := store.get(epKey)
+		if err != nil {
+			return errors.New("Error get endorsement policy: " + err.Error())
+		}
+		ep, err := statebased.NewStateEP(epBytes)
+		if err != nil {
+			return errors.New("Error generate new endorsement policy: " + err.Error())
+		}
+
+		err = change(ep)
+		if err != nil {
+			return err
+		}
+		epBytes, err = ep.Policy()
+		if err != nil {
+			return errors.New("Error generate endorsement policy bytes: " + err.Error())
+		}
+
+		// set the modified endorsement policy for the key
+		err = store.set(epKey, epBytes)
+		if err != nil {
+			return errors.New("Error set key level endorsement policy: " + err.Error())
+		}
 	}
+	return nil
+}
 
-	key := args[0]
-	logger.Debug("Got key-level endorsement policy key: " + key)
-	epKey := poPrefix + key
+func (s *SmartContract) kepAddOrgs(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	return s.kepAddDocOrgs(stub, append([]string{DocTypePO}, args...))
+}
 
-	// get the endorsement policy for the key
-	epBytes, err := stub.GetStateValidationParameter(epKey)
+// kepAddDocOrgs adds organizations to the endorsement policy of the keys of a
+// document type
+func (s *SmartContract) kepAddDocOrgs(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) < 4 {
+		return s.returnError("Wrong number of parameters, need document type, key (or JSON array of keys), " +
+			"role type & organizations")
+	}
+
+	logger.Debugf("Got key-level endorsement policy keys: [type] %s, [keys] %s", args[0], args[1])
+	epKeys, err := s.kepStateKeys(stub, args[0], args[1])
 	if err != nil {
-		return s.returnError("Error get endorsement policy: " + err.Error())
+		return s.returnError(err.Error())
 	}
-	ep, err := statebased.NewStateEP(epBytes)
+
+	roleType := statebased.RoleType(args[2])
+	if roleType != statebased.RoleTypeMember && roleType != statebased.RoleTypePeer {
+		return s.returnError("Wrong role type specified (need 'MEMBER' or 'PEER'): " + args[2])
+	}
+
+	logger.Debugf("Organizations to be set to key-level endorsement policy: %v", args[3:])
+	err = s.updateKEP(kepStore{stub: stub}, epKeys, func(ep statebased.KeyEndorsementPolicy) error {
+		// add organizations to endorsement policy
+		err := ep.AddOrgs(roleType, args[3:]...)
+		if err != nil {
+			return errors.New("Error add organizations to endorsement policy: " + err.Error())
+		}
+		return nil
+	})
 	if err != nil {
-		return s.returnError("Error generate new endorsement policy: " + err.Error())
+		return s.returnError(err.Error())
 	}
 
-	// delete organizations from the endorsement policy of that key
-	ep.DelOrgs(args[1:]...)
-	epBytes, err = ep.Policy()
+	return shim.Success(nil)
+}
+
+func (s *SmartContract) kepDelOrgs(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	return s.kepDelDocOrgs(stub, append([]string{DocTypePO}, args...))
+}
+
+// kepDelDocOrgs deletes organizations from the endorsement policy of the keys
+// of a document type
+func (s *SmartContract) kepDelDocOrgs(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) < 3 {
+		return s.returnError("No orgs to delete specified")
+	}
+
+	logger.Debugf("Got key-level endorsement policy keys: [type] %s, [keys] %s", args[0], args[1])
+	epKeys, err := s.kepStateKeys(stub, args[0], args[1])
 	if err != nil {
-		return s.returnError("Error generate endorsement policy bytes: " + err.Error())
+		return s.returnError(err.Error())
 	}
 
-	// set the modified endorsement policy for the key
-	err = stub.SetStateValidationParameter(epKey, epBytes)
+	err = s.updateKEP(kepStore{stub: stub}, epKeys, func(ep statebased.KeyEndorsementPolicy) error {
+		// delete organizations from the endorsement policy of that key
+		ep.DelOrgs(args[2:]...)
+		return nil
+	})
 	if err != nil {
-		return s.returnError("Error set key level endorsement policy: " + err.Error())
+		return s.returnError(err.Error())
 	}
 
 	return shim.Success(nil)
@@ -99,24 +243,60 @@ func (s *SmartContract) kepListOrgs(stub shim.ChaincodeStubInterface, args []str
 	logger.Debug("Got key-level endorsement policy key: " + key)
 	epKey := poPrefix + key
 
+	orgs, err := s.listKEPOrgs(kepStore{stub: stub}, epKey)
+	if err != nil {
+		return s.returnError(err.Error())
+	}
+	orgsList, err := json.Marshal(orgs)
+	if err != nil {
+		return s.returnError("Error marshal orgs json: " + err.Error())
+	}
+
+	return shim.Success(orgsList)
+}
+
+func (s *SmartContract) listKEPOrgs(store kepStore, epKey string) ([]string, error) {
 	// get the endorsement policy for the key
-	epBytes, err := stub.GetStateValidationParameter(epKey)
+	epBytes, err := store.get(epKey)
 	if err != nil {
-		return s.returnError("Error get endorsement policy: " + err.Error())
+		return nil, errors.New("Error get endorsement policy: " + err.Error())
 	}
 	ep, err := statebased.NewStateEP(epBytes)
 	if err != nil {
-		return s.returnError("Error generate new endorsement policy: " + err.Error())
+		return nil, errors.New("Error generate new endorsement policy: " + err.Error())
 	}
 
 	// get the list of organizations in the endorsement policy
-	orgs := ep.ListOrgs()
-	orgsList, err := json.Marshal(orgs)
+	return ep.ListOrgs(), nil
+}
+
+// kepListDocOrgs returns the organizations of the endorsement policy of each
+// key of a document type
+func (s *SmartContract) kepListDocOrgs(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 2 {
+		return s.returnError("Wrong number of parameters, need document type & key (or JSON array of keys)")
+	}
+
+	logger.Debugf("Got key-level endorsement policy keys: [type] %s, [keys] %s", args[0], args[1])
+	epKeys, err := s.kepStateKeys(stub, args[0], args[1])
+	if err != nil {
+		return s.returnError(err.Error())
+	}
+
+	results := []KEPOrgs{}
+	for _, epKey := range epKeys {
+		orgs, err := s.listKEPOrgs(kepStore{stub: stub}, epKey)
+		if err != nil {
+			return s.returnError(err.Error())
+		}
+		results = append(results, KEPOrgs{Key: epKey, Orgs: orgs})
+	}
+	resultsAsBytes, err := json.Marshal(results)
 	if err != nil {
 		return s.returnError("Error marshal orgs json: " + err.Error())
 	}
 
-	return shim.Success(orgsList)
+	return shim.Success(resultsAsBytes)
 }
 
 // delEP deletes the state-based endorsement policy for the key altogether
@@ -125,15 +305,155 @@ func (s *SmartContract) delKEP(stub shim.ChaincodeStubInterface, args []string)
 		return shim.Error("No key specified or too many keys specified")
 	}
 
-	key := args[0]
-	logger.Debug("Got key-level endorsement policy key: " + key)
-	epKey := poPrefix + key
+	return s.delDocKEP(stub, append([]string{DocTypePO}, args...))
+}
+
+// delDocKEP deletes the state-based endorsement policy of the keys of a
+// document type altogether
+func (s *SmartContract) delDocKEP(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 2 {
+		return s.returnError("Wrong number of parameters, need document type & key (or JSON array of keys)")
+	}
+
+	logger.Debugf("Got key-level endorsement policy keys: [type] %s, [keys] %s", args[0], args[1])
+	epKeys, err := s.kepStateKeys(stub, args[0], args[1])
+	if err != nil {
+		return s.returnError(err.Error())
+	}
+
+	for _, epKey := range epKeys {
+		// set the modified endorsement policy for the key to nil
+		err = stub.SetStateValidationParameter(epKey, nil)
+		if err != nil {
+			return s.returnError("Error set key level endorsement policy: " + err.Error())
+		}
+	}
+
+	return shim.Success(nil)
+}
+
+// kepAddPrivateOrgs adds organizations to the endorsement policy of private
+// data keys of a collection
+func (s *SmartContract) kepAddPrivateOrgs(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) < 4 {
+		return s.returnError("Wrong number of parameters, need collection, key (or JSON array of keys), " +
+			"role type & organizations")
+	}
+
+	logger.Debugf("Got private key-level endorsement policy keys: [collection] %s, [keys] %s", args[0], args[1])
+	epKeys, err := privateKEPKeys(args[1])
+	if err != nil {
+		return s.returnError(err.Error())
+	}
+
+	roleType := statebased.RoleType(args[2])
+	if roleType != statebased.RoleTypeMember && roleType != statebased.RoleTypePeer {
+		return s.returnError("Wrong role type specified (need 'MEMBER' or 'PEER'): " + args[2])
+	}
+
+	logger.Debugf("Organizations to be set to key-level endorsement policy: %v", args[3:])
+	err = s.updateKEP(kepStore{stub: stub, collection: args[0]}, epKeys,
+		func(ep statebased.KeyEndorsementPolicy) error {
+			// add organizations to endorsement policy
+			err := ep.AddOrgs(roleType, args[3:]...)
+			if err != nil {
+				return errors.New("Error add organizations to endorsement policy: " + err.Error())
+			}
+			return nil
+		})
+	if err != nil {
+		return s.returnError(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// kepDelPrivateOrgs deletes organizations from the endorsement policy of
+// private data keys of a collection
+func (s *SmartContract) kepDelPrivateOrgs(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) < 3 {
+		return s.returnError("No orgs to delete specified")
+	}
 
-	// set the modified endorsement policy for the key to nil
-	err := stub.SetStateValidationParameter(epKey, nil)
+	logger.Debugf("Got private key-level endorsement policy keys: [collection] %s, [keys] %s", args[0], args[1])
+	epKeys, err := privateKEPKeys(args[1])
 	if err != nil {
-		return s.returnError("Error set key level endorsement policy: " + err.Error())
+		return s.returnError(err.Error())
+	}
+
+	err = s.updateKEP(kepStore{stub: stub, collection: args[0]}, epKeys,
+		func(ep statebased.KeyEndorsementPolicy) error {
+			// delete organizations from the endorsement policy of that key
+			ep.DelOrgs(args[2:]...)
+			return nil
+		})
+	if err != nil {
+		return s.returnError(err.Error())
 	}
 
 	return shim.Success(nil)
 }
+
+// kepListPrivateOrgs returns the organizations of the endorsement policy of
+// each private data key of a collection
+func (s *SmartContract) kepListPrivateOrgs(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 2 {
+		return s.returnError("Wrong number of parameters, need collection & key (or JSON array of keys)")
+	}
+
+	epKeys, err := privateKEPKeys(args[1])
+	if err != nil {
+		return s.returnError(err.Error())
+	}
+
+	results := []KEPOrgs{}
+	for _, epKey := range epKeys {
+		orgs, err := s.listKEPOrgs(kepStore{stub: stub, collection: args[0]}, epKey)
+		if err != nil {
+			return s.returnError(err.Error())
+		}
+		results = append(results, KEPOrgs{Key: epKey, Orgs: orgs})
+	}
+	resultsAsBytes, err := json.Marshal(results)
+	if err != nil {
+		return s.returnError("Error marshal orgs json: " + err.Error())
+	}
+
+	return shim.Success(resultsAsBytes)
+}
+
+// delPrivateKEP deletes the endorsement policy of private data keys of a
+// collection altogether
+func (s *SmartContract) delPrivateKEP(stub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 2 {
+		return s.returnError("Wrong number of parameters, need collection & key (or JSON array of keys)")
+	}
+
+	epKeys, err := privateKEPKeys(args[1])
+	if err != nil {
+		return s.returnError(err.Error())
+	}
+
+	for _, epKey := range epKeys {
+		err = stub.SetPrivateDataValidationParameter(args[0], epKey, nil)
+		if err != nil {
+			return s.returnError("Error set key level endorsement policy: " + err.Error())
+		}
+	}
+
+	return shim.Success(nil)
+}
+
+// privateKEPKeys resolves keys to the private data keys writeChainWithPrivate
+// uses
+func privateKEPKeys(keys string) ([]string, error) {
+	batch, err := parseKEPKeys(keys)
+	if err != nil {
+		return nil, err
+	}
+	epKeys := make([]string, len(batch))
+	for i, key := range batch {
+		epKeys[i] = privateDataPrefix + key
+	}
+	return epKeys, nil
+}
@@ -0,0 +1,330 @@
+// Written by Xu Chen Hao
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
+	sc "github.com/hyperledger/fabric/protos/peer"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// A key provider supplies the symmetric keys of the encrypt module. The
+// transient provider returns the keys passed in transient as before. The
+// secret and PKCS#11 providers derive keys as HMAC-SHA256(secret, purpose,
+// label), so that only the key label travels in transient and every endorser
+// holding the same secret derives the same key. Who may use a label is kept
+// on chain under keyLabelACL~label, see keyLabelAllowed. Keys the client
+// passes in transient are never replaced by derived keys. With PKCS#11 the secret is a
+// generic secret key object that never leaves the token, e.g. in SoftHSM:
+//
+//	softhsm2-util --init-token --free --label chaincode --pin 1234 --so-pin 1234
+//	pkcs11-tool --module libsofthsm2.so --login --pin 1234 --token-label chaincode \
+//	    --keygen --key-type GENERIC:32 --label keyProvider
+//
+// The PKCS#11 provider needs cgo and is only built with the pkcs11 build tag.
+// The provider is chosen at startup with these environment variables.
+const (
+	EnvKeyProvider       = "KEY_PROVIDER"
+	EnvKeySecret         = "KEY_PROVIDER_SECRET"
+	EnvKeySecretFile     = "KEY_PROVIDER_SECRET_FILE"
+	EnvPKCS11Library     = "KEY_PROVIDER_PKCS11_LIBRARY"
+	EnvPKCS11TokenLabel  = "KEY_PROVIDER_PKCS11_TOKEN_LABEL"
+	EnvPKCS11Pin         = "KEY_PROVIDER_PKCS11_PIN"
+	EnvPKCS11KeyLabel    = "KEY_PROVIDER_PKCS11_KEY_LABEL"
+	KeyProviderTransient = "transient"
+	KeyProviderSecret    = "secret"
+	KeyProviderPKCS11    = "pkcs11"
+)
+
+// transient names of the key labels of derived keys
+const KEYLABEL = "KEYLABEL"
+const IDXKEYLABEL = "IDXKEYLABEL"
+const OLDKEYLABEL = "OLDKEYLABEL"
+const NEWKEYLABEL = "NEWKEYLABEL"
+
+const defaultKeyLabel = "default"
+
+const keyLabelACLIndex = "keyLabelACL"
+
+// KeyLabelACL lists the orgs that may use a key label. If an attribute
+// "name=value" is set, the client certificate must carry it as well. Only
+// admins of the owner org, the org that set the ACL first, may change it.
+type KeyLabelACL struct {
+	Label     string   `json:"label"`
+	OwnerMSP  string   `json:"ownerMSP"`
+	MSPs      []string `json:"msps"`
+	Attribute string   `json:"attribute,omitempty"`
+}
+
+// derivedKeyLabels maps the transient key names a derived provider supplies to
+// the transient name of their label. Other keys, such as signing and private
+// keys, are always taken from transient.
+var derivedKeyLabels = map[string]string{
+	ENCKEY: KEYLABEL,
+	DECKEY: KEYLABEL,
+	IDXKEY: IDXKEYLABEL,
+	OLDKEY: OLDKEYLABEL,
+	NEWKEY: NEWKEYLABEL,
+}
+
+type KeyProvider interface {
+	// GetTransient returns the transient map completed with the keys of
+	// the provider
+	GetTransient(stub shim.ChaincodeStubInterface) (map[string][]byte, error)
+}
+
+type transientKeyProvider struct{}
+
+func (p *transientKeyProvider) GetTransient(stub shim.ChaincodeStubInterface) (map[string][]byte, error) {
+	return stub.GetTransient()
+}
+
+// derivedKeyProvider derives keys with an HMAC function over the purpose and
+// label of the key
+type derivedKeyProvider struct {
+	hmac func(data []byte) ([]byte, error)
+}
+
+func (p *derivedKeyProvider) GetTransient(stub shim.ChaincodeStubInterface) (map[string][]byte, error) {
+	tMap, err := stub.GetTransient()
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string][]byte, len(tMap)+len(derivedKeyLabels))
+	for name, value := range tMap {
+		keys[name] = value
+	}
+	allowed := map[string]bool{}
+	for name, labelName := range derivedKeyLabels {
+		if _, in := tMap[name]; in {
+			// keys supplied by the client are used as they are
+			continue
+		}
+		label, explicit := tMap[labelName]
+		if !explicit {
+			// the data key is derived from the default label, the index key
+			// and rotation keys only when asked for
+			if labelName != KEYLABEL {
+				continue
+			}
+			label = []byte(defaultKeyLabel)
+		}
+		ok, checked := allowed[string(label)]
+		if !checked {
+			ok, err = keyLabelAllowed(stub, string(label))
+			if err != nil {
+				return nil, err
+			}
+			allowed[string(label)] = ok
+		}
+		if !ok {
+			if explicit {
+				return nil, errors.New("caller may not use key label " + string(label))
+			}
+			logger.Debugf("Skip derived key %s, caller may not use the default key label", name)
+			continue
+		}
+		purpose := "data"
+		if name == IDXKEY {
+			purpose = "index"
+		}
+		key, err := p.hmac([]byte(purpose + "\x00" + string(label)))
+		if err != nil {
+			return nil, errors.New("derive key " + name + " failed: " + err.Error())
+		}
+		keys[name] = key
+	}
+	return keys, nil
+}
+
+func newSecretKeyProvider(secret []byte) (*derivedKeyProvider, error) {
+	if len(secret) < 32 {
+		return nil, errors.New("need key provider secret of at least 256 bit")
+	}
+	return &derivedKeyProvider{hmac: func(data []byte) ([]byte, error) {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(data)
+		return mac.Sum(nil), nil
+	}}, nil
+}
+
+// newKeyProvider creates the key provider configured in the environment
+func newKeyProvider() (KeyProvider, error) {
+	switch provider := os.Getenv(EnvKeyProvider); provider {
+	case "", KeyProviderTransient:
+		return &transientKeyProvider{}, nil
+	case KeyProviderSecret:
+		secretHex := os.Getenv(EnvKeySecret)
+		if file := os.Getenv(EnvKeySecretFile); file != "" {
+			content, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			secretHex = strings.TrimSpace(string(content))
+		}
+		secret, err := hex.DecodeString(secretHex)
+		if err != nil {
+			return nil, errors.New("key provider secret must be hex encoded: " + err.Error())
+		}
+		return newSecretKeyProvider(secret)
+	case KeyProviderPKCS11:
+		return newPKCS11KeyProvider(os.Getenv(EnvPKCS11Library), os.Getenv(EnvPKCS11TokenLabel),
+			os.Getenv(EnvPKCS11Pin), os.Getenv(EnvPKCS11KeyLabel))
+	default:
+		return nil, errors.New("unknown key provider: " + provider)
+	}
+}
+
+func readKeyLabelACL(stub shim.ChaincodeStubInterface, label string) (string, *KeyLabelACL, error) {
+	aclKey, err := stub.CreateCompositeKey(keyLabelACLIndex, []string{label})
+	if err != nil {
+		return "", nil, err
+	}
+	aclAsBytes, err := stub.GetState(aclKey)
+	if err != nil || aclAsBytes == nil {
+		return aclKey, nil, err
+	}
+	var acl KeyLabelACL
+	err = json.Unmarshal(aclAsBytes, &acl)
+	if err != nil {
+		return "", nil, err
+	}
+	return aclKey, &acl, nil
+}
+
+// keyLabelAllowed checks the caller against the ACL of a key label. Labels
+// without ACL may not be used by anybody.
+func keyLabelAllowed(stub shim.ChaincodeStubInterface, label string) (bool, error) {
+	_, acl, err := readKeyLabelACL(stub, label)
+	if err != nil || acl == nil {
+		return false, err
+	}
+	msp, err := cid.GetMSPID(stub)
+	if err != nil {
+		return false, err
+	}
+	member := false
+	for _, aclMSP := range acl.MSPs {
+		if aclMSP == msp {
+			member = true
+			break
+		}
+	}
+	if !member {
+		return false, nil
+	}
+	if acl.Attribute == "" {
+		return true, nil
+	}
+	parts := strings.SplitN(acl.Attribute, "=", 2)
+	value, found, err := cid.GetAttributeValue(stub, parts[0])
+	if err != nil {
+		return false, err
+	}
+	return found && (len(parts) == 1 || value == parts[1]), nil
+}
+
+// assertKeyLabelOwner checks the caller is an admin of the owner org of the
+// ACL. ACLs set before owners were kept belong to the orgs listed in them.
+func (s *SmartContract) assertKeyLabelOwner(stub shim.ChaincodeStubInterface, acl *KeyLabelACL) error {
+	if acl.OwnerMSP != "" {
+		return s.assertOrgAdmin(stub, acl.OwnerMSP)
+	}
+	msp, err := cid.GetMSPID(stub)
+	if err != nil {
+		return err
+	}
+	for _, aclMSP := range acl.MSPs {
+		if aclMSP == msp {
+			return s.assertOrgAdmin(stub, msp)
+		}
+	}
+	return errors.New(msp + " does not own key label " + acl.Label)
+}
+
+// setKeyLabelACL sets the orgs and optional attribute allowed to use a key
+// label of a derived key provider, an empty org list removes the ACL. The
+// caller must be an admin of the owner org, a new ACL is owned by the
+// caller's org.
+func (s *SmartContract) setKeyLabelACL(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 && len(args) != 3 {
+		return s.returnError("Wrong number of parameters, need key label, MSP IDs (JSON array) " +
+			"& optional attribute (name=value)")
+	}
+
+	owner, err := cid.GetMSPID(APIstub)
+	if err != nil {
+		return s.returnError("Get MSP ID failed: " + err.Error())
+	}
+	aclKey, existing, err := readKeyLabelACL(APIstub, args[0])
+	if err != nil {
+		return s.returnError("Query key label ACL failed: " + err.Error())
+	}
+	if existing != nil {
+		err = s.assertKeyLabelOwner(APIstub, existing)
+		if existing.OwnerMSP != "" {
+			owner = existing.OwnerMSP
+		}
+	} else {
+		err = s.assertOrgAdmin(APIstub, owner)
+	}
+	if err != nil {
+		return s.returnError("Set key label ACL denied: " + err.Error())
+	}
+
+	acl := KeyLabelACL{Label: args[0], OwnerMSP: owner}
+	err = json.Unmarshal([]byte(args[1]), &acl.MSPs)
+	if err != nil {
+		return s.returnError("MSP IDs format error: " + err.Error())
+	}
+	if len(args) == 3 {
+		acl.Attribute = args[2]
+	}
+	logger.Debugf("Set key label ACL: [label] %s, [owner] %s, [msps] %v, [attribute] %s",
+		acl.Label, acl.OwnerMSP, acl.MSPs, acl.Attribute)
+
+	if len(acl.MSPs) == 0 {
+		err = APIstub.DelState(aclKey)
+		if err != nil {
+			return s.returnError("Data write to chain failed: " + err.Error())
+		}
+		return shim.Success(nil)
+	}
+	aclAsBytes, err := json.Marshal(acl)
+	if err != nil {
+		return s.returnError("Marshal key label ACL failed: " + err.Error())
+	}
+	err = APIstub.PutState(aclKey, aclAsBytes)
+	if err != nil {
+		return s.returnError("Data write to chain failed: " + err.Error())
+	}
+	return shim.Success(aclAsBytes)
+}
+
+func (s *SmartContract) queryKeyLabelACL(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return s.returnError("Wrong number of parameters, need key label")
+	}
+
+	_, acl, err := readKeyLabelACL(APIstub, args[0])
+	if err != nil {
+		return s.returnError("Query key label ACL failed: " + err.Error())
+	}
+	if acl == nil {
+		return shim.Success(nil)
+	}
+	aclAsBytes, err := json.Marshal(acl)
+	if err != nil {
+		return s.returnError("Marshal key label ACL failed: " + err.Error())
+	}
+	return shim.Success(aclAsBytes)
+}
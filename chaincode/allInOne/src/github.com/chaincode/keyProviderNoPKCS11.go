@@ -0,0 +1,13 @@
+// Written by Xu Chen Hao
+//go:build !pkcs11
+// +build !pkcs11
+
+package main
+
+import (
+	"errors"
+)
+
+func newPKCS11KeyProvider(library, tokenLabel, pin, keyLabel string) (*derivedKeyProvider, error) {
+	return nil, errors.New("PKCS#11 key provider is not supported, build the chaincode with the pkcs11 tag")
+}
@@ -0,0 +1,80 @@
+// Written by Xu Chen Hao
+//go:build pkcs11
+// +build pkcs11
+
+package main
+
+import (
+	"errors"
+	"github.com/miekg/pkcs11"
+	"sync"
+)
+
+// pkcs11Session computes HMACs with a secret key object of a token
+type pkcs11Session struct {
+	mutex   sync.Mutex
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	key     pkcs11.ObjectHandle
+}
+
+func newPKCS11KeyProvider(library, tokenLabel, pin, keyLabel string) (*derivedKeyProvider, error) {
+	ctx := pkcs11.New(library)
+	if ctx == nil {
+		return nil, errors.New("load PKCS#11 library " + library + " failed")
+	}
+	err := ctx.Initialize()
+	if err != nil {
+		return nil, err
+	}
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, slot := range slots {
+		info, err := ctx.GetTokenInfo(slot)
+		if err != nil || info.Label != tokenLabel {
+			continue
+		}
+		session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+		if err != nil {
+			return nil, err
+		}
+		err = ctx.Login(session, pkcs11.CKU_USER, pin)
+		if err != nil && err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+			return nil, err
+		}
+
+		err = ctx.FindObjectsInit(session, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, keyLabel),
+		})
+		if err != nil {
+			return nil, err
+		}
+		objects, _, err := ctx.FindObjects(session, 1)
+		ctx.FindObjectsFinal(session)
+		if err != nil {
+			return nil, err
+		}
+		if len(objects) == 0 {
+			return nil, errors.New("no secret key " + keyLabel + " on token " + tokenLabel)
+		}
+
+		p := &pkcs11Session{ctx: ctx, session: session, key: objects[0]}
+		return &derivedKeyProvider{hmac: p.hmac}, nil
+	}
+	return nil, errors.New("no PKCS#11 token " + tokenLabel)
+}
+
+func (p *pkcs11Session) hmac(data []byte) ([]byte, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	err := p.ctx.SignInit(p.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_SHA256_HMAC, nil)}, p.key)
+	if err != nil {
+		return nil, err
+	}
+	return p.ctx.Sign(p.session, data)
+}
@@ -0,0 +1,71 @@
+// Written by Xu Chen Hao
+//go:build pkcs11
+// +build pkcs11
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// softHSMLibraries are the usual install locations of SoftHSM
+var softHSMLibraries = []string{
+	"/usr/lib/softhsm/libsofthsm2.so",
+	"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/local/lib/softhsm/libsofthsm2.so",
+	"/usr/lib64/pkcs11/libsofthsm2.so",
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// TestPKCS11KeyProvider runs against a SoftHSM token set up as described in
+// keyProvider.go, it is skipped if SoftHSM is not installed
+func TestPKCS11KeyProvider(t *testing.T) {
+	library := os.Getenv(EnvPKCS11Library)
+	if library == "" {
+		for _, candidate := range softHSMLibraries {
+			if _, err := os.Stat(candidate); err == nil {
+				library = candidate
+				break
+			}
+		}
+	}
+	if library == "" {
+		t.Skip("SoftHSM not installed")
+	}
+
+	provider, err := newPKCS11KeyProvider(library, envOr(EnvPKCS11TokenLabel, "chaincode"),
+		envOr(EnvPKCS11Pin, "1234"), envOr(EnvPKCS11KeyLabel, "keyProvider"))
+	if err != nil {
+		t.Skip("SoftHSM token not set up: " + err.Error())
+	}
+
+	first, err := provider.hmac([]byte("data\x00default"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 32 {
+		t.Fatalf("expected 32 byte key, got %d", len(first))
+	}
+	second, err := provider.hmac([]byte("data\x00default"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Fatal("derived keys differ for the same label")
+	}
+	other, err := provider.hmac([]byte("data\x00other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(first, other) {
+		t.Fatal("derived keys equal for different labels")
+	}
+}
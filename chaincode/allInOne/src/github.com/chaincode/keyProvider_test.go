@@ -0,0 +1,49 @@
+// Written by Xu Chen Hao
+package main
+
+import (
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+func TestKeyLabelACLOwner(t *testing.T) {
+	s := new(SmartContract)
+	stub := newIdentityStub("Org1MSP", "Org2MSP")
+	setACL := func(msps string) func(shim.ChaincodeStubInterface) sc.Response {
+		return func(stub shim.ChaincodeStubInterface) sc.Response {
+			return s.setKeyLabelACL(stub, []string{"label1", msps})
+		}
+	}
+
+	stub.as(t, "Org1MSP", false)
+	if response := stub.invoke(setACL(`["Org1MSP"]`)); !failed(response) {
+		t.Fatal("client set the ACL")
+	}
+	stub.as(t, "Org1MSP", true)
+	if response := stub.invoke(setACL(`["Org1MSP","Org2MSP"]`)); failed(response) {
+		t.Fatalf("%s", response.Payload)
+	}
+
+	// a listed org is no owner
+	stub.as(t, "Org2MSP", true)
+	if response := stub.invoke(setACL(`["Org2MSP"]`)); !failed(response) {
+		t.Fatal("admin of another org changed the ACL")
+	}
+	if response := stub.invoke(setACL(`[]`)); !failed(response) {
+		t.Fatal("admin of another org removed the ACL")
+	}
+
+	stub.as(t, "Org1MSP", true)
+	if response := stub.invoke(setACL(`["Org1MSP"]`)); failed(response) {
+		t.Fatalf("%s", response.Payload)
+	}
+	_, acl, err := readKeyLabelACL(stub, "label1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acl == nil || acl.OwnerMSP != "Org1MSP" || len(acl.MSPs) != 1 {
+		t.Errorf("unexpected ACL %+v", acl)
+	}
+}
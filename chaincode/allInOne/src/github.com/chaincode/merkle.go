@@ -0,0 +1,237 @@
+// Written by Xu Chen Hao
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const merkleIndex = "merkle"
+
+// prefixes to separate leaf and inner node hashes (see RFC 6962)
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+// BatchRoot is stored for every batch upload, keyed by the transaction ID
+type BatchRoot struct {
+	TxId       string   `json:"txId"`
+	Root       string   `json:"root"`
+	Keys       []string `json:"keys"`
+	LeafHashes []string `json:"leafHashes"`
+}
+
+type ProofStep struct {
+	Hash string `json:"hash"`
+	// "left" or "right", the side of the sibling
+	Position string `json:"position"`
+}
+
+type BatchProof struct {
+	TxId  string      `json:"txId"`
+	Key   string      `json:"key"`
+	Index int         `json:"index"`
+	Leaf  string      `json:"leaf"`
+	Root  string      `json:"root"`
+	Path  []ProofStep `json:"path"`
+}
+
+// merkleLeaf hashes one batch item as sha256(0x00 || len(key) || key || value)
+func merkleLeaf(key string, value []byte) []byte {
+	var buffer bytes.Buffer
+	buffer.WriteByte(merkleLeafPrefix)
+	keyLength := make([]byte, 4)
+	binary.BigEndian.PutUint32(keyLength, uint32(len(key)))
+	buffer.Write(keyLength)
+	buffer.WriteString(key)
+	buffer.Write(value)
+	hash := sha256.Sum256(buffer.Bytes())
+	return hash[:]
+}
+
+func merkleNode(left, right []byte) []byte {
+	var buffer bytes.Buffer
+	buffer.WriteByte(merkleNodePrefix)
+	buffer.Write(left)
+	buffer.Write(right)
+	hash := sha256.Sum256(buffer.Bytes())
+	return hash[:]
+}
+
+// merkleRootAndPath computes the root over the leaves and the inclusion path
+// of the leaf at index. A lone node at the end of a level is promoted to the
+// next level unchanged.
+func merkleRootAndPath(leaves [][]byte, index int) ([]byte, []ProofStep) {
+	if len(leaves) == 0 {
+		return nil, nil
+	}
+	path := []ProofStep{}
+	level := leaves
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			if index == i {
+				path = append(path, ProofStep{Hash: hex.EncodeToString(level[i+1]), Position: "right"})
+			} else if index == i+1 {
+				path = append(path, ProofStep{Hash: hex.EncodeToString(level[i]), Position: "left"})
+			}
+			next = append(next, merkleNode(level[i], level[i+1]))
+		}
+		index = index / 2
+		level = next
+	}
+	return level[0], path
+}
+
+// verifyMerkleProof recomputes the root from a leaf and its inclusion path
+func verifyMerkleProof(leaf string, path []ProofStep, root string) (bool, error) {
+	current, err := hex.DecodeString(leaf)
+	if err != nil {
+		return false, errors.New("leaf is not hex encoded: " + err.Error())
+	}
+	for _, step := range path {
+		sibling, err := hex.DecodeString(step.Hash)
+		if err != nil {
+			return false, errors.New("proof hash is not hex encoded: " + err.Error())
+		}
+		switch step.Position {
+		case "left":
+			current = merkleNode(sibling, current)
+		case "right":
+			current = merkleNode(current, sibling)
+		default:
+			return false, errors.New("invalid proof position: " + step.Position)
+		}
+	}
+	return hex.EncodeToString(current) == root, nil
+}
+
+// writeBatchRoot computes and stores the Merkle root of the batch items under
+// the transaction ID
+func (s *SmartContract) writeBatchRoot(stub shim.ChaincodeStubInterface,
+	keys []string, values [][]byte) (*BatchRoot, error) {
+
+	batchRoot := BatchRoot{TxId: stub.GetTxID(), Keys: keys, LeafHashes: []string{}}
+	var leaves [][]byte
+	for i, key := range keys {
+		leaf := merkleLeaf(key, values[i])
+		leaves = append(leaves, leaf)
+		batchRoot.LeafHashes = append(batchRoot.LeafHashes, hex.EncodeToString(leaf))
+	}
+	root, _ := merkleRootAndPath(leaves, 0)
+	batchRoot.Root = hex.EncodeToString(root)
+
+	batchRootAsBytes, err := json.Marshal(batchRoot)
+	if err != nil {
+		return nil, err
+	}
+	rootKey, err := stub.CreateCompositeKey(merkleIndex, []string{batchRoot.TxId})
+	if err != nil {
+		return nil, err
+	}
+	logger.Debugf("Write batch root on chain: [txId] %s, [root] %s", batchRoot.TxId, batchRoot.Root)
+	err = stub.PutState(rootKey, batchRootAsBytes)
+	if err != nil {
+		return nil, err
+	}
+	return &batchRoot, nil
+}
+
+func (s *SmartContract) getBatchProof(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 {
+		return s.returnError("Wrong number of parameters, need batch txId & key")
+	}
+
+	txId := args[0]
+	key := args[1]
+	logger.Debugf("Get batch proof: [txId] %s, [key] %s", txId, key)
+
+	rootKey, err := APIstub.CreateCompositeKey(merkleIndex, []string{txId})
+	if err != nil {
+		return s.returnError("Create composite key failed: " + err.Error())
+	}
+	batchRootAsBytes, err := APIstub.GetState(rootKey)
+	if err != nil {
+		return s.returnError("Query failed: " + err.Error())
+	}
+	if batchRootAsBytes == nil {
+		return s.returnError("No batch found for txId " + txId)
+	}
+	var batchRoot BatchRoot
+	err = json.Unmarshal(batchRootAsBytes, &batchRoot)
+	if err != nil {
+		return s.returnError("Batch root format error: " + err.Error())
+	}
+
+	// the last write of a key in a batch is the one in the state
+	index := -1
+	for i := len(batchRoot.Keys) - 1; i >= 0; i-- {
+		if batchRoot.Keys[i] == key {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return s.returnError("Key " + key + " is not part of batch " + txId)
+	}
+
+	var leaves [][]byte
+	for _, leafHash := range batchRoot.LeafHashes {
+		leaf, err := hex.DecodeString(leafHash)
+		if err != nil {
+			return s.returnError("Batch root format error: " + err.Error())
+		}
+		leaves = append(leaves, leaf)
+	}
+	root, path := merkleRootAndPath(leaves, index)
+	if hex.EncodeToString(root) != batchRoot.Root {
+		return s.returnError("Stored leaves of batch " + txId + " do not match its root")
+	}
+
+	proof := BatchProof{TxId: txId, Key: key, Index: index, Leaf: batchRoot.LeafHashes[index],
+		Root: batchRoot.Root, Path: path}
+	proofAsBytes, err := json.Marshal(proof)
+	if err != nil {
+		return s.returnError("Marshal proof failed: " + err.Error())
+	}
+	return shim.Success(proofAsBytes)
+}
+
+// verifyBatchProof checks a proof returned by getBatchProof without reading
+// the ledger. If a value is given, the leaf is recomputed from key & value.
+func (s *SmartContract) verifyBatchProof(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 && len(args) != 2 {
+		return s.returnError("Wrong number of parameters, need proof JSON & optional value")
+	}
+
+	var proof BatchProof
+	err := json.Unmarshal([]byte(args[0]), &proof)
+	if err != nil {
+		return s.returnError("Proof format error: " + err.Error())
+	}
+	if len(args) == 2 && hex.EncodeToString(merkleLeaf(proof.Key, []byte(args[1]))) != proof.Leaf {
+		return shim.Success([]byte("false"))
+	}
+
+	valid, err := verifyMerkleProof(proof.Leaf, proof.Path, proof.Root)
+	if err != nil {
+		return s.returnError("Verify proof failed: " + err.Error())
+	}
+	if !valid {
+		return shim.Success([]byte("false"))
+	}
+	return shim.Success([]byte("true"))
+}
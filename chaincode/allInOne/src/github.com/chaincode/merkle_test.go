@@ -0,0 +1,100 @@
+// Written by Xu Chen Hao
+package main
+
+import (
+	"encoding/hex"
+	"strconv"
+	"testing"
+)
+
+func testLeaves(n int) [][]byte {
+	leaves := make([][]byte, n)
+	for i := range leaves {
+		leaves[i] = merkleLeaf("key"+strconv.Itoa(i), []byte("value"+strconv.Itoa(i)))
+	}
+	return leaves
+}
+
+func TestMerkleProofs(t *testing.T) {
+	for n := 1; n <= 17; n++ {
+		leaves := testLeaves(n)
+		root, _ := merkleRootAndPath(leaves, 0)
+		for i, leaf := range leaves {
+			leafRoot, path := merkleRootAndPath(leaves, i)
+			if hex.EncodeToString(leafRoot) != hex.EncodeToString(root) {
+				t.Fatalf("%d leaves: root differs for index %d", n, i)
+			}
+			valid, err := verifyMerkleProof(hex.EncodeToString(leaf), path, hex.EncodeToString(root))
+			if err != nil {
+				t.Fatalf("%d leaves, index %d: %s", n, i, err)
+			}
+			if !valid {
+				t.Errorf("%d leaves: proof of index %d is invalid", n, i)
+			}
+		}
+	}
+}
+
+func TestMerkleSingleLeaf(t *testing.T) {
+	leaves := testLeaves(1)
+	root, path := merkleRootAndPath(leaves, 0)
+	if len(path) != 0 {
+		t.Errorf("expected empty path, got %d steps", len(path))
+	}
+	if hex.EncodeToString(root) != hex.EncodeToString(leaves[0]) {
+		t.Error("root of a single leaf must be the leaf")
+	}
+}
+
+func TestMerkleProofRejects(t *testing.T) {
+	leaves := testLeaves(5)
+	root, path := merkleRootAndPath(leaves, 2)
+	rootHex := hex.EncodeToString(root)
+
+	// another leaf with the path of index 2
+	valid, err := verifyMerkleProof(hex.EncodeToString(leaves[3]), path, rootHex)
+	if err != nil || valid {
+		t.Errorf("proof for wrong leaf: valid %v, err %v", valid, err)
+	}
+
+	// swapped sides
+	swapped := make([]ProofStep, len(path))
+	for i, step := range path {
+		swapped[i] = step
+		if step.Position == "left" {
+			swapped[i].Position = "right"
+		} else {
+			swapped[i].Position = "left"
+		}
+	}
+	valid, err = verifyMerkleProof(hex.EncodeToString(leaves[2]), swapped, rootHex)
+	if err != nil || valid {
+		t.Errorf("proof with swapped sides: valid %v, err %v", valid, err)
+	}
+
+	// leaf and node hashes are domain separated, an inner node is no leaf
+	inner := merkleNode(leaves[0], leaves[1])
+	_, upperPath := merkleRootAndPath([][]byte{inner, merkleNode(leaves[2], leaves[3]), leaves[4]}, 0)
+	if valid, _ := verifyMerkleProof(hex.EncodeToString(inner), upperPath, rootHex); !valid {
+		t.Error("inner node does not verify against its own level")
+	}
+	if hex.EncodeToString(merkleLeaf("", inner)) == hex.EncodeToString(inner) {
+		t.Error("leaf hash equals node hash")
+	}
+
+	if _, err = verifyMerkleProof("zz", path, rootHex); err == nil {
+		t.Error("expected error for leaf that is not hex")
+	}
+	bad := append([]ProofStep{}, path...)
+	bad[0].Position = "up"
+	if _, err = verifyMerkleProof(hex.EncodeToString(leaves[2]), bad, rootHex); err == nil {
+		t.Error("expected error for invalid position")
+	}
+}
+
+func TestMerkleLeafEncoding(t *testing.T) {
+	// the key length prefix keeps key and value apart
+	if hex.EncodeToString(merkleLeaf("ab", []byte("c"))) == hex.EncodeToString(merkleLeaf("a", []byte("bc"))) {
+		t.Error("leaves of different key/value splits are equal")
+	}
+}
@@ -0,0 +1,179 @@
+// Written by Xu Chen Hao
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
+	sc "github.com/hyperledger/fabric/protos/peer"
+	"strings"
+	"time"
+)
+
+const notaryIndex = "notary"
+
+const (
+	DigestSHA256  = "sha256"
+	DigestSHA3256 = "sha3-256"
+)
+
+// Anchor is the on-chain record of an off-chain document, only its digests
+// and some metadata are stored.
+type Anchor struct {
+	SHA256       string `json:"sha256,omitempty"`
+	SHA3256      string `json:"sha3-256,omitempty"`
+	DocType      string `json:"docType"`
+	URI          string `json:"uri"`
+	SubmitterMSP string `json:"submitterMSP"`
+	TxId         string `json:"txId"`
+	Timestamp    string `json:"timestamp"`
+}
+
+type AnchorVerification struct {
+	Anchored bool    `json:"anchored"`
+	Anchor   *Anchor `json:"anchor,omitempty"`
+}
+
+// normalizeDigest checks a hex encoded digest of the given algorithm and
+// returns it in lower case.
+func normalizeDigest(algorithm, digest string) (string, error) {
+	if algorithm != DigestSHA256 && algorithm != DigestSHA3256 {
+		return "", errors.New("unsupported digest algorithm (need 'sha256' or 'sha3-256'): " + algorithm)
+	}
+	digest = strings.ToLower(digest)
+	raw, err := hex.DecodeString(digest)
+	if err != nil {
+		return "", errors.New("digest is not hex encoded: " + err.Error())
+	}
+	if len(raw) != 32 {
+		return "", errors.New("digest must be 32 bytes for " + algorithm)
+	}
+	return digest, nil
+}
+
+func (s *SmartContract) readAnchor(stub shim.ChaincodeStubInterface, algorithm, digest string) (*Anchor, error) {
+	anchorKey, err := stub.CreateCompositeKey(notaryIndex, []string{algorithm, digest})
+	if err != nil {
+		return nil, err
+	}
+	anchorAsBytes, err := stub.GetState(anchorKey)
+	if err != nil {
+		return nil, err
+	}
+	if anchorAsBytes == nil {
+		return nil, nil
+	}
+	var anchor Anchor
+	err = json.Unmarshal(anchorAsBytes, &anchor)
+	if err != nil {
+		return nil, err
+	}
+	return &anchor, nil
+}
+
+func (s *SmartContract) anchorDocument(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return s.returnError("Wrong number of parameters, need anchor JSON (sha256, sha3-256, docType & uri)")
+	}
+
+	logger.Debug("Got request parameters: " + args[0])
+
+	var anchor Anchor
+	err := json.Unmarshal([]byte(args[0]), &anchor)
+	if err != nil {
+		return s.returnError("Anchor format error: " + err.Error())
+	}
+	if anchor.SHA256 == "" && anchor.SHA3256 == "" {
+		return s.returnError("Need at least one digest (sha256 or sha3-256)")
+	}
+
+	// pairs of algorithm & digest, kept in order to stay deterministic
+	var digests [][2]string
+	if anchor.SHA256 != "" {
+		anchor.SHA256, err = normalizeDigest(DigestSHA256, anchor.SHA256)
+		if err != nil {
+			return s.returnError(err.Error())
+		}
+		digests = append(digests, [2]string{DigestSHA256, anchor.SHA256})
+	}
+	if anchor.SHA3256 != "" {
+		anchor.SHA3256, err = normalizeDigest(DigestSHA3256, anchor.SHA3256)
+		if err != nil {
+			return s.returnError(err.Error())
+		}
+		digests = append(digests, [2]string{DigestSHA3256, anchor.SHA3256})
+	}
+
+	// the metadata is taken from the transaction, not from the caller
+	anchor.SubmitterMSP, err = cid.GetMSPID(APIstub)
+	if err != nil {
+		return s.returnError("Get submitter MSP ID failed: " + err.Error())
+	}
+	anchor.TxId = APIstub.GetTxID()
+	txTime, err := txTimestamp(APIstub)
+	if err != nil {
+		return s.returnError("Get transaction timestamp failed: " + err.Error())
+	}
+	anchor.Timestamp = txTime.UTC().Format(time.RFC3339Nano)
+
+	anchorAsBytes, err := json.Marshal(anchor)
+	if err != nil {
+		return s.returnError("Marshal anchor failed: " + err.Error())
+	}
+
+	for _, pair := range digests {
+		algorithm, digest := pair[0], pair[1]
+
+		// keep the first anchoring of a document
+		existing, err := s.readAnchor(APIstub, algorithm, digest)
+		if err != nil {
+			return s.returnError("Query failed: " + err.Error())
+		}
+		if existing != nil {
+			return s.returnConflict("Document " + algorithm + ":" + digest + " is already anchored")
+		}
+
+		anchorKey, err := APIstub.CreateCompositeKey(notaryIndex, []string{algorithm, digest})
+		if err != nil {
+			return s.returnError("Create composite key failed: " + err.Error())
+		}
+		err = APIstub.PutState(anchorKey, anchorAsBytes)
+		if err != nil {
+			return s.returnError("Data write to chain failed: " + err.Error())
+		}
+	}
+
+	return shim.Success(anchorAsBytes)
+}
+
+func (s *SmartContract) verifyDocument(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 && len(args) != 2 {
+		return s.returnError("Wrong number of parameters, need digest & optional algorithm ('sha256' or 'sha3-256')")
+	}
+
+	algorithm := DigestSHA256
+	if len(args) == 2 {
+		algorithm = args[1]
+	}
+	digest, err := normalizeDigest(algorithm, args[0])
+	if err != nil {
+		return s.returnError(err.Error())
+	}
+
+	logger.Debugf("Verify document: [algorithm] %s, [digest] %s", algorithm, digest)
+
+	anchor, err := s.readAnchor(APIstub, algorithm, digest)
+	if err != nil {
+		return s.returnError("Query failed: " + err.Error())
+	}
+
+	verificationAsBytes, err := json.Marshal(AnchorVerification{Anchored: anchor != nil, Anchor: anchor})
+	if err != nil {
+		return s.returnError("Marshal verification result failed: " + err.Error())
+	}
+	return shim.Success(verificationAsBytes)
+}
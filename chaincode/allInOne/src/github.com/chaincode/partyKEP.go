@@ -0,0 +1,317 @@
+// Written by Xu Chen Hao
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/statebased"
+	sc "github.com/hyperledger/fabric/protos/peer"
+	"strings"
+)
+
+// Party names of documents, like the buyer and seller of a PO, are mapped to
+// MSP IDs on chain under party~name. An admin of an org registers the party
+// names of its org, and only the registering org can remove a name again.
+// A name claimed by the wrong org is disputed by approvePartyOverride: once
+// admins of a majority of the channel orgs approved moving the name to an org,
+// an admin of that org takes it over with overrideParty.
+// When a document is created, its key gets a key-level endorsement policy
+// requiring a member of the org of every party field, so that later updates
+// need all parties. The private PO details written with uploadPOWithPrivate
+// get the same policy in their collections.
+// A document with parties of both registered and unregistered orgs is
+// rejected, unless "kepUnregistered.<docType>" is set to "skip" to leave the
+// unregistered ones out of the policy. Documents without any registered party
+// get no policy. Whether a private document is new is told by a public
+// marker, see kepStore.exists.
+const partyIndex = "party"
+
+// partyOverride~party~msp~approverMSP is written by an admin of the approving
+// org
+const partyOverrideIndex = "partyOverride"
+
+// configuration name prefix of the party fields of a document type, e.g.
+// "kepParties.manifest" = "shipper,consignee,carrier", "none" to disable
+const ConfigKEPParties = "kepParties."
+
+// configuration name prefix of the handling of parties without registered
+// org, "reject" (default) or "skip"
+const ConfigKEPUnregistered = "kepUnregistered."
+
+var defaultKEPParties = map[string][]string{
+	DocTypePO: {"buyer", "seller"},
+}
+
+type PartyMSP struct {
+	Party string `json:"party"`
+	MSP   string `json:"msp"`
+}
+
+func (s *SmartContract) kepParties(stub shim.ChaincodeStubInterface, docType string) ([]string, error) {
+	configured, err := s.getConfig(stub, ConfigKEPParties+docType)
+	if err != nil {
+		return nil, err
+	}
+	if configured == "" {
+		return defaultKEPParties[docType], nil
+	}
+	var fields []string
+	if configured == "none" {
+		return fields, nil
+	}
+	for _, field := range strings.Split(configured, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields, nil
+}
+
+func (s *SmartContract) readPartyMSP(stub shim.ChaincodeStubInterface, party string) (string, string, error) {
+	partyKey, err := stub.CreateCompositeKey(partyIndex, []string{party})
+	if err != nil {
+		return "", "", err
+	}
+	msp, err := stub.GetState(partyKey)
+	if err != nil {
+		return "", "", err
+	}
+	return partyKey, string(msp), nil
+}
+
+// setPartyKEP sets the endorsement policy of a new document to the orgs of
+// its parties, in public state or a private data collection. Existing
+// documents keep their policy.
+func (s *SmartContract) setPartyKEP(store kepStore, docType, key string, document interface{}) error {
+
+	stub := store.stub
+	existing, err := store.exists(key)
+	if err != nil {
+		return err
+	}
+	if existing {
+		return nil
+	}
+	err = store.mark(key)
+	if err != nil {
+		return err
+	}
+	fields, err := s.kepParties(stub, docType)
+	if err != nil {
+		return err
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	docAsBytes, err := json.Marshal(document)
+	if err != nil {
+		return err
+	}
+	doc, err := decodeJSON(docAsBytes)
+	if err != nil {
+		return err
+	}
+
+	var msps, unregistered []string
+	for _, field := range fields {
+		value, err := pointerGet(doc, strings.Split(field, "."))
+		if err != nil {
+			continue
+		}
+		party, ok := value.(string)
+		if !ok || party == "" {
+			continue
+		}
+		_, msp, err := s.readPartyMSP(stub, party)
+		if err != nil {
+			return err
+		}
+		if msp == "" {
+			unregistered = append(unregistered, party)
+			continue
+		}
+		msps = append(msps, msp)
+	}
+	if len(msps) == 0 {
+		return nil
+	}
+	if len(unregistered) > 0 {
+		handling, err := s.getConfig(stub, ConfigKEPUnregistered+docType)
+		if err != nil {
+			return err
+		}
+		if handling != "skip" {
+			return fmt.Errorf("parties without registered org: %v", unregistered)
+		}
+		logger.Debugf("Skip parties without registered org: %v", unregistered)
+	}
+
+	logger.Debugf("Set party endorsement policy: [collection] %s, [key] %s, [orgs] %v", store.collection, key, msps)
+	ep, err := statebased.NewStateEP(nil)
+	if err != nil {
+		return err
+	}
+	err = ep.AddOrgs(statebased.RoleTypeMember, msps...)
+	if err != nil {
+		return err
+	}
+	epBytes, err := ep.Policy()
+	if err != nil {
+		return err
+	}
+	return store.set(key, epBytes)
+}
+
+// registerParty maps party names to the caller's org, only admins of the org
+// may call it
+func (s *SmartContract) registerParty(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) == 0 {
+		return s.returnError("Wrong number of parameters, need party names")
+	}
+
+	msp, err := cid.GetMSPID(APIstub)
+	if err != nil {
+		return s.returnError("Get MSP ID failed: " + err.Error())
+	}
+	err = s.assertOrgAdmin(APIstub, msp)
+	if err != nil {
+		return s.returnError("Register party denied: " + err.Error())
+	}
+	logger.Debugf("Register parties: [msp] %s, [parties] %v", msp, args)
+
+	for _, party := range args {
+		if party == "" {
+			return s.returnError("Empty party name")
+		}
+		partyKey, registered, err := s.readPartyMSP(APIstub, party)
+		if err != nil {
+			return s.returnError("Query party failed: " + err.Error())
+		}
+		if registered != "" && registered != msp {
+			return s.returnError(fmt.Sprintf("Party %s is registered by %s", party, registered))
+		}
+		err = APIstub.PutState(partyKey, []byte(msp))
+		if err != nil {
+			return s.returnError("Data write to chain failed: " + err.Error())
+		}
+	}
+	return shim.Success(nil)
+}
+
+// removeParty removes party names registered by the caller's org
+func (s *SmartContract) removeParty(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) == 0 {
+		return s.returnError("Wrong number of parameters, need party names")
+	}
+
+	msp, err := cid.GetMSPID(APIstub)
+	if err != nil {
+		return s.returnError("Get MSP ID failed: " + err.Error())
+	}
+
+	for _, party := range args {
+		partyKey, registered, err := s.readPartyMSP(APIstub, party)
+		if err != nil {
+			return s.returnError("Query party failed: " + err.Error())
+		}
+		if registered != msp {
+			return s.returnError("Party " + party + " is not registered by " + msp)
+		}
+		err = APIstub.DelState(partyKey)
+		if err != nil {
+			return s.returnError("Data write to chain failed: " + err.Error())
+		}
+	}
+	return shim.Success(nil)
+}
+
+// approvePartyOverride records the approval of an admin of the caller's org to
+// move a party name to an org
+func (s *SmartContract) approvePartyOverride(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 {
+		return s.returnError("Wrong number of parameters, need party name & MSP ID")
+	}
+	if args[0] == "" || args[1] == "" {
+		return s.returnError("Empty party name or MSP ID")
+	}
+
+	approver, err := cid.GetMSPID(APIstub)
+	if err != nil {
+		return s.returnError("Get MSP ID failed: " + err.Error())
+	}
+	err = s.assertOrgAdmin(APIstub, approver)
+	if err != nil {
+		return s.returnError("Approve party override denied: " + err.Error())
+	}
+	logger.Debugf("Approve party override: [party] %s, [msp] %s, [approver] %s", args[0], args[1], approver)
+
+	approvalKey, err := APIstub.CreateCompositeKey(partyOverrideIndex, []string{args[0], args[1], approver})
+	if err != nil {
+		return s.returnError("Create composite key failed: " + err.Error())
+	}
+	err = APIstub.PutState(approvalKey, []byte(APIstub.GetTxID()))
+	if err != nil {
+		return s.returnError("Data write to chain failed: " + err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// overrideParty moves a party name to the caller's org, registered by any org
+// or none, if admins of a majority of the channel orgs approved it. Only
+// admins of the org may call it.
+func (s *SmartContract) overrideParty(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return s.returnError("Wrong number of parameters, need party name")
+	}
+
+	msp, err := cid.GetMSPID(APIstub)
+	if err != nil {
+		return s.returnError("Get MSP ID failed: " + err.Error())
+	}
+	err = s.assertOrgAdmin(APIstub, msp)
+	if err != nil {
+		return s.returnError("Override party denied: " + err.Error())
+	}
+	partyKey, registered, err := s.readPartyMSP(APIstub, args[0])
+	if err != nil {
+		return s.returnError("Query party failed: " + err.Error())
+	}
+	err = useApprovals(APIstub, partyOverrideIndex, []string{args[0], msp})
+	if err != nil {
+		return s.returnError("Override party denied: " + err.Error())
+	}
+
+	logger.Infof("Party %s moved from %q to %s", args[0], registered, msp)
+
+	err = APIstub.PutState(partyKey, []byte(msp))
+	if err != nil {
+		return s.returnError("Data write to chain failed: " + err.Error())
+	}
+	return shim.Success(nil)
+}
+
+func (s *SmartContract) queryParty(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return s.returnError("Wrong number of parameters, need party name")
+	}
+
+	_, msp, err := s.readPartyMSP(APIstub, args[0])
+	if err != nil {
+		return s.returnError("Query party failed: " + err.Error())
+	}
+	if msp == "" {
+		return shim.Success(nil)
+	}
+	partyAsBytes, err := json.Marshal(PartyMSP{Party: args[0], MSP: msp})
+	if err != nil {
+		return s.returnError(err.Error())
+	}
+	return shim.Success(partyAsBytes)
+}
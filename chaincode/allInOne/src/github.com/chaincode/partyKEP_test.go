@@ -0,0 +1,62 @@
+// Written by Xu Chen Hao
+package main
+
+import (
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+func TestPartyRegistrationAndOverride(t *testing.T) {
+	s := new(SmartContract)
+	stub := newIdentityStub("Org1MSP", "Org2MSP", "Org3MSP")
+	call := func(f func(shim.ChaincodeStubInterface, []string) sc.Response,
+		args ...string) func(shim.ChaincodeStubInterface) sc.Response {
+		return func(stub shim.ChaincodeStubInterface) sc.Response {
+			return f(stub, args)
+		}
+	}
+
+	stub.as(t, "Org1MSP", false)
+	if response := stub.invoke(call(s.registerParty, "Buyer1")); !failed(response) {
+		t.Fatal("client registered a party")
+	}
+	stub.as(t, "Org1MSP", true)
+	if response := stub.invoke(call(s.registerParty, "Buyer1")); failed(response) {
+		t.Fatalf("%s", response.Payload)
+	}
+	stub.as(t, "Org2MSP", true)
+	if response := stub.invoke(call(s.registerParty, "Buyer1")); !failed(response) {
+		t.Fatal("party registered by another org")
+	}
+
+	// the dispute needs a majority of the three orgs
+	if response := stub.invoke(call(s.approvePartyOverride, "Buyer1", "Org2MSP")); failed(response) {
+		t.Fatalf("%s", response.Payload)
+	}
+	if response := stub.invoke(call(s.overrideParty, "Buyer1")); !failed(response) {
+		t.Fatal("override approved by one of three orgs")
+	}
+	stub.as(t, "Org3MSP", true)
+	if response := stub.invoke(call(s.approvePartyOverride, "Buyer1", "Org2MSP")); failed(response) {
+		t.Fatalf("%s", response.Payload)
+	}
+	if response := stub.invoke(call(s.overrideParty, "Buyer1")); !failed(response) {
+		t.Fatal("override by an org the name was not approved for")
+	}
+	stub.as(t, "Org2MSP", false)
+	if response := stub.invoke(call(s.overrideParty, "Buyer1")); !failed(response) {
+		t.Fatal("client overrode a party")
+	}
+	stub.as(t, "Org2MSP", true)
+	if response := stub.invoke(call(s.overrideParty, "Buyer1")); failed(response) {
+		t.Fatalf("%s", response.Payload)
+	}
+	if _, msp, err := s.readPartyMSP(stub, "Buyer1"); err != nil || msp != "Org2MSP" {
+		t.Errorf("party registered by %q, expected Org2MSP (%v)", msp, err)
+	}
+	if response := stub.invoke(call(s.overrideParty, "Buyer1")); !failed(response) {
+		t.Error("approvals used twice")
+	}
+}
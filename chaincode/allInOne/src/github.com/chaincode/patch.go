@@ -0,0 +1,491 @@
+// Written by Xu Chen Hao
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	// RFC 7386 JSON Merge Patch
+	PatchTypeMerge = "merge"
+	// RFC 6902 JSON Patch
+	PatchTypeJSON = "json"
+)
+
+type PatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// applyPatch applies a patch of the given type to a JSON document and returns
+// the patched document.
+func applyPatch(doc []byte, patchType string, patch []byte) ([]byte, error) {
+	target, err := decodeJSON(doc)
+	if err != nil {
+		return nil, errors.New("current document is not valid JSON: " + err.Error())
+	}
+
+	switch patchType {
+	case PatchTypeMerge:
+		mergePatch, err := decodeJSON(patch)
+		if err != nil {
+			return nil, errors.New("merge patch is not valid JSON: " + err.Error())
+		}
+		target = applyMergePatch(target, mergePatch)
+	case PatchTypeJSON:
+		var operations []PatchOperation
+		err = json.Unmarshal(patch, &operations)
+		if err != nil {
+			return nil, errors.New("JSON patch is not an array of operations: " + err.Error())
+		}
+		for i, operation := range operations {
+			target, err = applyPatchOperation(target, operation)
+			if err != nil {
+				return nil, fmt.Errorf("JSON patch operation %d (%s %s) failed: %s",
+					i, operation.Op, operation.Path, err)
+			}
+		}
+	default:
+		return nil, errors.New("unknown patch type (need 'merge' or 'json'): " + patchType)
+	}
+
+	return json.Marshal(target)
+}
+
+func decodeJSON(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	err := decoder.Decode(&value)
+	if err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, errors.New("unexpected data after JSON value")
+	}
+	return value, nil
+}
+
+// applyMergePatch implements the MergePatch function of RFC 7386
+func applyMergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+	for name, value := range patchObject {
+		if value == nil {
+			delete(targetObject, name)
+		} else {
+			targetObject[name] = applyMergePatch(targetObject[name], value)
+		}
+	}
+	return targetObject
+}
+
+func applyPatchOperation(doc interface{}, operation PatchOperation) (interface{}, error) {
+	path, err := parsePointer(operation.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch operation.Op {
+	case "add":
+		value, err := operationValue(operation)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, value)
+	case "remove":
+		doc, _, err = pointerRemove(doc, path)
+		return doc, err
+	case "replace":
+		value, err := operationValue(operation)
+		if err != nil {
+			return nil, err
+		}
+		doc, _, err = pointerRemove(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, value)
+	case "move":
+		from, err := parsePointer(operation.From)
+		if err != nil {
+			return nil, err
+		}
+		if len(path) > len(from) && reflect.DeepEqual(path[:len(from)], from) {
+			return nil, errors.New("cannot move a value into one of its children")
+		}
+		doc, value, err := pointerRemove(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, value)
+	case "copy":
+		from, err := parsePointer(operation.From)
+		if err != nil {
+			return nil, err
+		}
+		value, err := pointerGet(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		// copy through JSON so that the two locations do not share state
+		valueAsBytes, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		value, err = decodeJSON(valueAsBytes)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, value)
+	case "test":
+		value, err := operationValue(operation)
+		if err != nil {
+			return nil, err
+		}
+		current, err := pointerGet(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !jsonEqual(current, value) {
+			return nil, errors.New("test failed, value does not match")
+		}
+		return doc, nil
+	default:
+		return nil, errors.New("unknown operation")
+	}
+}
+
+func operationValue(operation PatchOperation) (interface{}, error) {
+	if operation.Value == nil {
+		return nil, errors.New("missing value")
+	}
+	return decodeJSON(operation.Value)
+}
+
+func jsonEqual(a, b interface{}) bool {
+	aAsBytes, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	bAsBytes, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	// decode again without UseNumber so that 1.0 and 1 compare equal
+	var aValue, bValue interface{}
+	if json.Unmarshal(aAsBytes, &aValue) != nil || json.Unmarshal(bAsBytes, &bValue) != nil {
+		return false
+	}
+	return reflect.DeepEqual(aValue, bValue)
+}
+
+// parsePointer splits a RFC 6901 JSON Pointer into its unescaped tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, errors.New("JSON pointer must start with '/': " + pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+func arrayIndex(token string, length int, allowEnd bool) (int, error) {
+	if allowEnd && token == "-" {
+		return length, nil
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, errors.New("invalid array index: " + token)
+	}
+	max := length - 1
+	if allowEnd {
+		max = length
+	}
+	if index > max {
+		return 0, errors.New("array index out of range: " + token)
+	}
+	return index, nil
+}
+
+func pointerGet(doc interface{}, path []string) (interface{}, error) {
+	current := doc
+	for _, token := range path {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, errors.New("path not found: " + token)
+			}
+			current = value
+		case []interface{}:
+			index, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			current = node[index]
+		default:
+			return nil, errors.New("path not found: " + token)
+		}
+	}
+	return current, nil
+}
+
+// pointerAdd adds value at path and returns the new document, the document
+// itself is replaced if path is empty.
+func pointerAdd(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	parent, err := pointerGet(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = value
+		return doc, nil
+	case []interface{}:
+		index, err := arrayIndex(last, len(node), true)
+		if err != nil {
+			return nil, err
+		}
+		node = append(node, nil)
+		copy(node[index+1:], node[index:])
+		node[index] = value
+		return pointerSet(doc, path[:len(path)-1], node)
+	default:
+		return nil, errors.New("parent of path is not an object or array")
+	}
+}
+
+// pointerRemove removes the value at path and returns the new document and
+// the removed value.
+func pointerRemove(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, doc, nil
+	}
+	parent, err := pointerGet(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+	last := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		value, ok := node[last]
+		if !ok {
+			return nil, nil, errors.New("path not found: " + last)
+		}
+		delete(node, last)
+		return doc, value, nil
+	case []interface{}:
+		index, err := arrayIndex(last, len(node), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		value := node[index]
+		node = append(node[:index], node[index+1:]...)
+		doc, err = pointerSet(doc, path[:len(path)-1], node)
+		return doc, value, err
+	default:
+		return nil, nil, errors.New("parent of path is not an object or array")
+	}
+}
+
+// pointerSet replaces the value at an existing path, used when an array
+// changes length and has to be stored back in its parent.
+func pointerSet(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	parent, err := pointerGet(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = value
+	case []interface{}:
+		index, err := arrayIndex(last, len(node), false)
+		if err != nil {
+			return nil, err
+		}
+		node[index] = value
+	default:
+		return nil, errors.New("parent of path is not an object or array")
+	}
+	return doc, nil
+}
+
+func (s *SmartContract) patchCommon(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 3 {
+		return s.returnError("Wrong number of parameters, need key, patch type ('merge' or 'json') & patch")
+	}
+
+	logger.Debugf("Got request parameters: [key] %s, [patch type] %s, [patch] %s", args[0], args[1],
+		redactDocument([]byte(args[2])))
+
+	commonKey := commonPrefix + args[0]
+	current, err := s.getCommonState(APIstub, commonKey)
+	if err != nil {
+		return s.returnError("Query failed: " + err.Error())
+	}
+	if current == nil {
+		return s.returnError("Key " + args[0] + " does not exist")
+	}
+	// values that are not JSON are rejected by applyPatch
+	if doc, err := decodeJSON(current); err == nil && hasEncryptedFields(doc) {
+		return s.returnError("Value of key " + args[0] + " has encrypted fields, upload it with uploadEncFields")
+	}
+
+	patched, err := applyPatch(current, args[1], []byte(args[2]))
+	if err != nil {
+		return s.returnError("Patch failed: " + err.Error())
+	}
+
+	logger.Debugf("Write value on chain: %s", redactDocument(patched))
+	err = s.putState(APIstub, DocTypeCommon, commonKey, patched)
+	if err != nil {
+		return s.returnError("Data write to chain failed: " + err.Error())
+	}
+
+	return shim.Success(patched)
+}
+
+func (s *SmartContract) patchPO(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 3 {
+		return s.returnError("参数数量不正确")
+	}
+
+	logger.Debugf("Got request parameters: [poNo] %s, [patch type] %s, [patch] %s", args[0], args[1],
+		redactDocument([]byte(args[2])))
+
+	poKey := poPrefix + args[0]
+	current, err := s.getState(APIstub, poKey)
+	if err != nil {
+		return s.returnError("po单查询失败" + err.Error())
+	}
+	if current == nil {
+		return s.returnError("PO单不存在: " + args[0])
+	}
+	doc, err := decodeJSON(current)
+	if err != nil {
+		return s.returnError("PO单格式错误: " + err.Error())
+	}
+	if hasEncryptedFields(doc) {
+		return s.returnError("PO单含加密字段, 请用uploadEncFields更新: " + args[0])
+	}
+
+	patched, err := applyPatch(current, args[1], []byte(args[2]))
+	if err != nil {
+		return s.returnError("PO单更新失败: " + err.Error())
+	}
+
+	var po PO
+	err = json.Unmarshal(patched, &po)
+	if err != nil {
+		return s.returnError("PO单格式错误: " + err.Error())
+	}
+	if po.PoNo != args[0] {
+		return s.returnError("PO单号不能修改")
+	}
+
+	// 验证PO单是否合法
+	if !s.validatePO(po) {
+		return s.returnError("PO单不合法")
+	}
+
+	// 数据上链
+	err = s.writeChainPO(APIstub, po)
+	if err != nil {
+		return s.returnError("PO单上链失败: " + err.Error())
+	}
+
+	poAsBytes, err := json.Marshal(po)
+	if err != nil {
+		return s.returnError(err.Error())
+	}
+	return shim.Success(poAsBytes)
+}
+
+func (s *SmartContract) patchManifest(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 3 {
+		return s.returnError("参数数量不正确")
+	}
+
+	logger.Debugf("Got request parameters: [masterBillNo] %s, [patch type] %s, [patch] %s",
+		args[0], args[1], redactDocument([]byte(args[2])))
+
+	manifestKey := manifestPrefix + args[0]
+	current, err := s.getState(APIstub, manifestKey)
+	if err != nil {
+		return s.returnError("主舱单查询失败" + err.Error())
+	}
+	if current == nil {
+		return s.returnError("主舱单不存在: " + args[0])
+	}
+	doc, err := decodeJSON(current)
+	if err != nil {
+		return s.returnError("主舱单格式错误: " + err.Error())
+	}
+	if hasEncryptedFields(doc) {
+		return s.returnError("主舱单含加密字段, 请用uploadEncFields更新: " + args[0])
+	}
+
+	patched, err := applyPatch(current, args[1], []byte(args[2]))
+	if err != nil {
+		return s.returnError("主舱单更新失败: " + err.Error())
+	}
+
+	var manifest Manifest
+	err = json.Unmarshal(patched, &manifest)
+	if err != nil {
+		return s.returnError("主舱单格式错误: " + err.Error())
+	}
+	if manifest.MasterBillNo != args[0] {
+		return s.returnError("主舱单号不能修改")
+	}
+
+	// 验证主舱单是否合法
+	if !s.validateManifest(manifest) {
+		return s.returnError("主舱单不合法")
+	}
+
+	// 数据上链
+	err = s.writeChainManifest(APIstub, manifest)
+	if err != nil {
+		return s.returnError("主舱单上链失败: " + err.Error())
+	}
+
+	manifestAsBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return s.returnError(err.Error())
+	}
+	return shim.Success(manifestAsBytes)
+}
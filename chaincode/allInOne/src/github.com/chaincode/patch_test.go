@@ -0,0 +1,129 @@
+// Written by Xu Chen Hao
+package main
+
+import (
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func TestApplyMergePatch(t *testing.T) {
+	cases := []struct {
+		doc, patch, expected string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for _, c := range cases {
+		patched, err := applyPatch([]byte(c.doc), PatchTypeMerge, []byte(c.patch))
+		if err != nil {
+			t.Fatalf("merge %s into %s: %s", c.patch, c.doc, err)
+		}
+		if string(patched) != c.expected {
+			t.Errorf("merge %s into %s: expected %s, got %s", c.patch, c.doc, c.expected, patched)
+		}
+	}
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+	cases := []struct {
+		doc, patch, expected string
+	}{
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`},
+		{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":"qux"}]`, `{"foo":["bar","qux"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`},
+		{`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`},
+		{`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`,
+			`[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+			`{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{`{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`,
+			`{"foo":["all","cows","eat","grass"]}`},
+		{`{"foo":{"bar":1}}`, `[{"op":"copy","from":"/foo","path":"/baz"},{"op":"replace","path":"/baz/bar","value":2}]`,
+			`{"baz":{"bar":2},"foo":{"bar":1}}`},
+		{`{"baz":"qux","foo":["a",2,"c"]}`,
+			`[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`,
+			`{"baz":"qux","foo":["a",2,"c"]}`},
+		{`{"a/b":1,"m~n":2}`, `[{"op":"replace","path":"/a~1b","value":3},{"op":"remove","path":"/m~0n"}]`,
+			`{"a/b":3}`},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"","value":{"baz":1}}]`, `{"baz":1}`},
+	}
+	for _, c := range cases {
+		patched, err := applyPatch([]byte(c.doc), PatchTypeJSON, []byte(c.patch))
+		if err != nil {
+			t.Fatalf("patch %s with %s: %s", c.doc, c.patch, err)
+		}
+		if string(patched) != c.expected {
+			t.Errorf("patch %s with %s: expected %s, got %s", c.doc, c.patch, c.expected, patched)
+		}
+	}
+}
+
+func TestApplyJSONPatchErrors(t *testing.T) {
+	cases := []struct {
+		doc, patch string
+	}{
+		{`{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`},
+		{`{"foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`},
+		{`{"foo":"bar"}`, `[{"op":"replace","path":"/baz","value":1}]`},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/5","value":1}]`},
+		{`{"foo":["bar"]}`, `[{"op":"remove","path":"/foo/01"}]`},
+		{`{"foo":{"bar":1}}`, `[{"op":"move","from":"/foo","path":"/foo/bar/baz"}]`},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz"}]`},
+		{`{"foo":"bar"}`, `[{"op":"invalid","path":"/foo"}]`},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"foo","value":1}]`},
+		{`{"foo":"bar"}`, `{"op":"add","path":"/foo","value":1}`},
+	}
+	for _, c := range cases {
+		if _, err := applyPatch([]byte(c.doc), PatchTypeJSON, []byte(c.patch)); err == nil {
+			t.Errorf("patch %s with %s: expected error", c.doc, c.patch)
+		}
+	}
+	if _, err := applyPatch([]byte(`{}`), "unknown", []byte(`{}`)); err == nil {
+		t.Error("unknown patch type: expected error")
+	}
+	if _, err := applyPatch([]byte(`not json`), PatchTypeMerge, []byte(`{}`)); err == nil {
+		t.Error("invalid document: expected error")
+	}
+}
+
+// a failing operation must leave the document unchanged
+func TestApplyJSONPatchAtomic(t *testing.T) {
+	doc := []byte(`{"foo":"bar"}`)
+	_, err := applyPatch(doc, PatchTypeJSON,
+		[]byte(`[{"op":"add","path":"/baz","value":1},{"op":"test","path":"/foo","value":"qux"}]`))
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if string(doc) != `{"foo":"bar"}` {
+		t.Errorf("document changed: %s", doc)
+	}
+}
+
+func TestPatchCommonRejectsEncryptedFields(t *testing.T) {
+	s := new(SmartContract)
+	stub := shim.NewMockStub("patch", nil)
+	stub.MockTransactionStart("tx1")
+	defer stub.MockTransactionEnd("tx1")
+	stored := `{"a":"$enc:AES256-GCM:AAAA","b":1}`
+	stub.PutState(commonPrefix+"k1", []byte(stored))
+
+	response := s.patchCommon(stub, []string{"k1", PatchTypeMerge, `{"a":"plain"}`})
+	if !failed(response) {
+		t.Fatalf("patch of encrypted value accepted: %s", response.Payload)
+	}
+	if string(stub.State[commonPrefix+"k1"]) != stored {
+		t.Errorf("value changed: %s", stub.State[commonPrefix+"k1"])
+	}
+}
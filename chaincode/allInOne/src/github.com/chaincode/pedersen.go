@@ -0,0 +1,169 @@
+// Written by Xu Chen Hao
+package main
+
+import (
+	"crypto/elliptic"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+	"strconv"
+)
+
+// Pedersen commitments C = v*G + r*H on P-256, where G is the base point and
+// H a point with unknown discrete logarithm to G, hashed from a fixed seed.
+// Commitments are additively homomorphic: C(a) + C(b) = C(a+b) with the sum
+// of the blindings, and q*C(a) = C(q*a).
+//
+// A range proof shows that a commitment holds a value in [1, 2^n]. The owner
+// commits to the bits of v-1, so that the bit commitments weighted with 2^i
+// add up to C - G, and proves with an OR proof for every bit commitment B
+// that either B or B - G is a multiple of H. Proofs are made off chain by the
+// data owner, the chaincode only verifies them.
+
+// max number of bits of a range proof
+const maxRangeProofBits = 64
+
+var pedersenCurve = elliptic.P256()
+
+var pedersenH = hashToPoint([]byte("blockchain-quick-start pedersen H"))
+
+type ecPoint struct {
+	X, Y *big.Int
+}
+
+// BitProof is the commitment to one bit with the challenges and responses of
+// its OR proof
+type BitProof struct {
+	Commitment []byte `json:"commitment"`
+	E0         []byte `json:"e0"`
+	S0         []byte `json:"s0"`
+	E1         []byte `json:"e1"`
+	S1         []byte `json:"s1"`
+}
+
+type RangeProof struct {
+	Bits []BitProof `json:"bits"`
+}
+
+// hashToPoint maps a seed to a curve point by try and increment
+func hashToPoint(seed []byte) ecPoint {
+	params := pedersenCurve.Params()
+	three := big.NewInt(3)
+	for counter := 0; ; counter++ {
+		digest := sha256.Sum256(append(append([]byte{}, seed...), byte(counter)))
+		x := new(big.Int).SetBytes(digest[:])
+		if x.Cmp(params.P) >= 0 {
+			continue
+		}
+		// y^2 = x^3 - 3x + b
+		rhs := new(big.Int).Exp(x, three, params.P)
+		rhs.Sub(rhs, new(big.Int).Mul(three, x))
+		rhs.Add(rhs, params.B)
+		rhs.Mod(rhs, params.P)
+		if y := new(big.Int).ModSqrt(rhs, params.P); y != nil {
+			return ecPoint{x, y}
+		}
+	}
+}
+
+func decodePoint(encoded []byte) (ecPoint, error) {
+	x, y := elliptic.Unmarshal(pedersenCurve, encoded)
+	if x == nil {
+		return ecPoint{}, errors.New("invalid curve point")
+	}
+	return ecPoint{x, y}, nil
+}
+
+func (p ecPoint) bytes() []byte {
+	return elliptic.Marshal(pedersenCurve, p.X, p.Y)
+}
+
+func (p ecPoint) equal(q ecPoint) bool {
+	return p.X.Cmp(q.X) == 0 && p.Y.Cmp(q.Y) == 0
+}
+
+func (p ecPoint) add(q ecPoint) ecPoint {
+	x, y := pedersenCurve.Add(p.X, p.Y, q.X, q.Y)
+	return ecPoint{x, y}
+}
+
+// neg keeps the point at infinity (0, 0)
+func (p ecPoint) neg() ecPoint {
+	if p.Y.Sign() == 0 {
+		return p
+	}
+	return ecPoint{p.X, new(big.Int).Sub(pedersenCurve.Params().P, p.Y)}
+}
+
+func (p ecPoint) mul(k *big.Int) ecPoint {
+	x, y := pedersenCurve.ScalarMult(p.X, p.Y, new(big.Int).Mod(k, pedersenCurve.Params().N).Bytes())
+	return ecPoint{x, y}
+}
+
+func baseMul(k *big.Int) ecPoint {
+	x, y := pedersenCurve.ScalarBaseMult(new(big.Int).Mod(k, pedersenCurve.Params().N).Bytes())
+	return ecPoint{x, y}
+}
+
+func generatorG() ecPoint {
+	params := pedersenCurve.Params()
+	return ecPoint{params.Gx, params.Gy}
+}
+
+// pedersenCommit returns v*G + r*H
+func pedersenCommit(v, r *big.Int) ecPoint {
+	return baseMul(v).add(pedersenH.mul(r))
+}
+
+// bitChallenge is the Fiat-Shamir challenge of the OR proof of bit i
+func bitChallenge(context string, i int, commitment, t0, t1 ecPoint) *big.Int {
+	digest := sha256.New()
+	digest.Write([]byte("pedersen range proof\x00" + context + "\x00" + strconv.Itoa(i)))
+	digest.Write(commitment.bytes())
+	digest.Write(t0.bytes())
+	digest.Write(t1.bytes())
+	e := new(big.Int).SetBytes(digest.Sum(nil))
+	return e.Mod(e, pedersenCurve.Params().N)
+}
+
+// verifyRangeProof checks that the commitment holds a value in [1, 2^n]. The
+// context binds the proof to the document field it was made for.
+func verifyRangeProof(context string, commitment ecPoint, proof *RangeProof) error {
+	if proof == nil || len(proof.Bits) == 0 {
+		return errors.New("missing range proof")
+	}
+	if len(proof.Bits) > maxRangeProofBits {
+		return errors.New("range proof has more than " + strconv.Itoa(maxRangeProofBits) + " bits")
+	}
+
+	n := pedersenCurve.Params().N
+	g := generatorG()
+	var sum ecPoint
+	for i, bit := range proof.Bits {
+		b, err := decodePoint(bit.Commitment)
+		if err != nil {
+			return errors.New("bit " + strconv.Itoa(i) + ": " + err.Error())
+		}
+		weighted := b.mul(new(big.Int).Lsh(big.NewInt(1), uint(i)))
+		if i == 0 {
+			sum = weighted
+		} else {
+			sum = sum.add(weighted)
+		}
+
+		e0, s0 := new(big.Int).SetBytes(bit.E0), new(big.Int).SetBytes(bit.S0)
+		e1, s1 := new(big.Int).SetBytes(bit.E1), new(big.Int).SetBytes(bit.S1)
+		// t0 = s0*H - e0*B, t1 = s1*H - e1*(B - G)
+		t0 := pedersenH.mul(s0).add(b.mul(e0).neg())
+		t1 := pedersenH.mul(s1).add(b.add(g.neg()).mul(e1).neg())
+		e := new(big.Int).Add(e0, e1)
+		if e.Mod(e, n).Cmp(bitChallenge(context, i, b, t0, t1)) != 0 {
+			return errors.New("bit " + strconv.Itoa(i) + ": invalid proof")
+		}
+	}
+
+	if !sum.equal(commitment.add(g.neg())) {
+		return errors.New("bit commitments do not add up to the commitment")
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+// Written by Xu Chen Hao
+package main
+
+import (
+	"crypto/rand"
+	"math/big"
+	"testing"
+)
+
+func randomScalar(t *testing.T) *big.Int {
+	k, err := rand.Int(rand.Reader, pedersenCurve.Params().N)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// proveRange makes a range proof for a commitment to v in [1, 2^bits] with
+// blinding r, the way a data owner does off chain
+func proveRange(t *testing.T, context string, v, r *big.Int, bits int) *RangeProof {
+	n := pedersenCurve.Params().N
+	g := generatorG()
+	value := new(big.Int).Sub(v, big.NewInt(1))
+
+	// bit blindings weighted with 2^i add up to r
+	blindings := make([]*big.Int, bits)
+	rest := new(big.Int).Set(r)
+	for i := 1; i < bits; i++ {
+		blindings[i] = randomScalar(t)
+		rest.Sub(rest, new(big.Int).Lsh(blindings[i], uint(i)))
+	}
+	blindings[0] = rest.Mod(rest, n)
+
+	proof := &RangeProof{}
+	for i := 0; i < bits; i++ {
+		bit := value.Bit(i)
+		b := pedersenCommit(big.NewInt(int64(bit)), blindings[i])
+		k := randomScalar(t)
+		// simulate the branch of the other bit value, prove the real one
+		eFake, sFake := randomScalar(t), randomScalar(t)
+		var t0, t1 ecPoint
+		if bit == 0 {
+			t0 = pedersenH.mul(k)
+			t1 = pedersenH.mul(sFake).add(b.add(g.neg()).mul(eFake).neg())
+		} else {
+			t0 = pedersenH.mul(sFake).add(b.mul(eFake).neg())
+			t1 = pedersenH.mul(k)
+		}
+		e := bitChallenge(context, i, b, t0, t1)
+		eReal := new(big.Int).Sub(e, eFake)
+		eReal.Mod(eReal, n)
+		sReal := new(big.Int).Mul(eReal, blindings[i])
+		sReal.Add(sReal, k).Mod(sReal, n)
+
+		bitProof := BitProof{Commitment: b.bytes()}
+		if bit == 0 {
+			bitProof.E0, bitProof.S0, bitProof.E1, bitProof.S1 = eReal.Bytes(), sReal.Bytes(), eFake.Bytes(), sFake.Bytes()
+		} else {
+			bitProof.E0, bitProof.S0, bitProof.E1, bitProof.S1 = eFake.Bytes(), sFake.Bytes(), eReal.Bytes(), sReal.Bytes()
+		}
+		proof.Bits = append(proof.Bits, bitProof)
+	}
+	return proof
+}
+
+func TestRangeProof(t *testing.T) {
+	for _, v := range []int64{1, 2, 5, 255, 256} {
+		r := randomScalar(t)
+		commitment := pedersenCommit(big.NewInt(v), r)
+		proof := proveRange(t, "po/unitPrice", big.NewInt(v), r, 8)
+		if err := verifyRangeProof("po/unitPrice", commitment, proof); err != nil {
+			t.Errorf("value %d: %s", v, err)
+		}
+	}
+}
+
+func TestRangeProofRejects(t *testing.T) {
+	v, r := big.NewInt(42), randomScalar(t)
+	commitment := pedersenCommit(v, r)
+	proof := proveRange(t, "po/unitPrice", v, r, 8)
+
+	if err := verifyRangeProof("po/amount", commitment, proof); err == nil {
+		t.Error("proof accepted for another context")
+	}
+	if err := verifyRangeProof("po/unitPrice", pedersenCommit(big.NewInt(43), r), proof); err == nil {
+		t.Error("proof accepted for another commitment")
+	}
+	if err := verifyRangeProof("po/unitPrice", commitment, nil); err == nil {
+		t.Error("missing proof accepted")
+	}
+
+	tampered := &RangeProof{Bits: append([]BitProof{}, proof.Bits...)}
+	tampered.Bits[3].S0 = randomScalar(t).Bytes()
+	if err := verifyRangeProof("po/unitPrice", commitment, tampered); err == nil {
+		t.Error("tampered proof accepted")
+	}
+
+	// a bit commitment to 2 has no valid OR proof
+	two := pedersenCommit(big.NewInt(2), r)
+	forged := &RangeProof{Bits: append([]BitProof{}, proof.Bits...)}
+	forged.Bits[0].Commitment = two.bytes()
+	if err := verifyRangeProof("po/unitPrice", commitment, forged); err == nil {
+		t.Error("proof with a non-bit commitment accepted")
+	}
+
+	long := &RangeProof{Bits: make([]BitProof, maxRangeProofBits+1)}
+	if err := verifyRangeProof("po/unitPrice", commitment, long); err == nil {
+		t.Error("proof with too many bits accepted")
+	}
+}
+
+func TestPedersenHomomorphic(t *testing.T) {
+	a, ra := big.NewInt(7), randomScalar(t)
+	b, rb := big.NewInt(11), randomScalar(t)
+	sum := pedersenCommit(a, ra).add(pedersenCommit(b, rb))
+	if !sum.equal(pedersenCommit(new(big.Int).Add(a, b), new(big.Int).Add(ra, rb))) {
+		t.Error("C(a) + C(b) != C(a+b)")
+	}
+	if !pedersenCommit(a, ra).mul(big.NewInt(3)).equal(pedersenCommit(big.NewInt(21), new(big.Int).Mul(ra, big.NewInt(3)))) {
+		t.Error("3*C(a) != C(3a)")
+	}
+}
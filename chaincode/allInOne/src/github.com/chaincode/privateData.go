@@ -97,9 +97,14 @@ func (s *SmartContract) writeChainWithPrivate(APIstub shim.ChaincodeStubInterfac
 	if err != nil {
 		return err
 	}
-	logger.Debug("Write data on collectionPOPrivateDetails: " + string(privatePOBytes))
+	logger.Debugf("Write data on collectionPOPrivateDetails: %s", redactDocument(privatePOBytes))
 	privatePOKey := privateDataPrefix + po.PoNo
-	err = APIstub.PutPrivateData("collectionPOPrivateDetails", privatePOKey, privatePOBytes)
+	err = s.setPartyKEP(kepStore{stub: APIstub, collection: "collectionPOPrivateDetails"}, DocTypePO, privatePOKey, po)
+	if err != nil {
+		logger.Error("Set private data endorsement policy failed: " + err.Error())
+		return err
+	}
+	err = s.putPrivateData(APIstub, DocTypePO, "collectionPOPrivateDetails", privatePOKey, privatePOBytes)
 	if err != nil {
 		// if failed to write the private data (unit price), then just ignore
 		logger.Error("Write private data failed: " + err.Error())
@@ -112,9 +117,13 @@ func (s *SmartContract) writeChainWithPrivate(APIstub shim.ChaincodeStubInterfac
 		logger.Error("Write public data failed: " + err.Error())
 		return err
 	}
-	logger.Debug("Write data on collectionPO: " + string(publicPOBytes))
+	logger.Debugf("Write data on collectionPO: %s", redactDocument(publicPOBytes))
 	privatePOKey = privateDataPrefix + po.PoNo
-	err = APIstub.PutPrivateData("collectionPO", privatePOKey, publicPOBytes)
+	err = s.setPartyKEP(kepStore{stub: APIstub, collection: "collectionPO"}, DocTypePO, privatePOKey, po)
+	if err != nil {
+		return err
+	}
+	err = s.putPrivateData(APIstub, DocTypePO, "collectionPO", privatePOKey, publicPOBytes)
 	if err != nil {
 		return err
 	}
@@ -125,7 +134,7 @@ func (s *SmartContract) readPubChain(APIstub shim.ChaincodeStubInterface, poNo s
 
 	logger.Debug("Query collectionPO data: " + poNo)
 	privatePOKey := privateDataPrefix + poNo
-	result, err := APIstub.GetPrivateData("collectionPO", privatePOKey)
+	result, err := s.getPrivateData(APIstub, "collectionPO", privatePOKey)
 	if err != nil {
 		return nil, err
 	}
@@ -143,7 +152,7 @@ func (s *SmartContract) readPriChain(APIstub shim.ChaincodeStubInterface, poNo s
 
 	logger.Debug("Query collectionPOPrivateDetails data: " + poNo)
 	privatePOKey := privateDataPrefix + poNo
-	result, err := APIstub.GetPrivateData("collectionPOPrivateDetails", privatePOKey)
+	result, err := s.getPrivateData(APIstub, "collectionPOPrivateDetails", privatePOKey)
 	if err != nil {
 		return nil, err
 	}
@@ -163,7 +172,7 @@ func (s *SmartContract) uploadPOWithPrivate(APIstub shim.ChaincodeStubInterface,
 		return s.returnError("参数数量不正确")
 	}
 
-	logger.Debug("获取请求参数: " + args[0])
+	logger.Debugf("获取请求参数: %s", redactDocument([]byte(args[0])))
 
 	poAsBytes := []byte(args[0])
 	var po PO
@@ -202,7 +211,7 @@ func (s *SmartContract) queryPOPublic(APIstub shim.ChaincodeStubInterface, args
 	if err != nil {
 		return s.returnError("po单无效: " + err.Error())
 	}
-	logger.Debug("Read public data from chain: " + string(poAsByte))
+	logger.Debugf("Read public data from chain: %s", redactDocument(poAsByte))
 	return shim.Success(poAsByte)
 }
 
@@ -221,6 +230,6 @@ func (s *SmartContract) queryPOPrivate(APIstub shim.ChaincodeStubInterface, args
 	if err != nil {
 		return s.returnError("po单无效: " + err.Error())
 	}
-	logger.Debug("Read private data from chain: " + string(poAsByte))
+	logger.Debugf("Read private data from chain: %s", redactDocument(poAsByte))
 	return shim.Success(poAsByte)
 }
@@ -0,0 +1,604 @@
+// Written by Xu Chen Hao
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
+	sc "github.com/hyperledger/fabric/protos/peer"
+	"math/big"
+	"sort"
+)
+
+// Multi-recipient encryption seals a document with its own data key, which the
+// client passes in transient DATAKEY. The data key is wrapped with ECIES for
+// the P-256 public key every recipient org registered under
+// recipientKey~MSP, the wrapped keys are kept under recipients~stateKey.
+// Only an admin of the org registers its key. Every key registered stays
+// under recipientKeyHistory~MSP~keyID, so that wrapped keys naming an older
+// key ID can still be traced to their key.
+// Adding or revoking recipients only rewrites the wrapped keys. Only the
+// uploader org or an admin may upload the key again or revoke recipients. A
+// revoked recipient may still know the data key, so upload the value again
+// with a new data key if that matters.
+const recipientKeyIndex = "recipientKey"
+const recipientsIndex = "recipients"
+const recipientKeyHistoryIndex = "recipientKeyHistory"
+
+const DATAKEY = "DATAKEY"
+const PRIVKEY = "PRIVKEY"
+
+type RecipientKey struct {
+	MSP       string `json:"msp"`
+	PublicKey string `json:"publicKey"`
+	KeyID     string `json:"keyId"`
+}
+
+// WrappedKey is the data key encrypted for one recipient with the shared
+// secret of an ephemeral key and the recipient key
+type WrappedKey struct {
+	MSP                string `json:"msp"`
+	RecipientKeyID     string `json:"recipientKeyId"`
+	EphemeralPublicKey []byte `json:"ephemeralPublicKey"`
+	Nonce              []byte `json:"nonce"`
+	WrappedKey         []byte `json:"wrappedKey"`
+}
+
+type Recipients struct {
+	Key         string       `json:"key"`
+	KeyID       string       `json:"keyId"`
+	UploaderMSP string       `json:"uploaderMSP"`
+	Recipients  []WrappedKey `json:"recipients"`
+}
+
+func publicKeyID(pub *ecdsa.PublicKey) string {
+	return keyID(elliptic.Marshal(pub.Curve, pub.X, pub.Y))
+}
+
+// parsePublicKey accepts a PEM encoded P-256 public key or certificate
+func parsePublicKey(publicKeyPEM string) (*ecdsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(publicKeyPEM))
+	if block == nil {
+		return nil, errors.New("public key is not PEM encoded")
+	}
+	var key interface{}
+	var err error
+	if block.Type == "CERTIFICATE" {
+		var cert *x509.Certificate
+		cert, err = x509.ParseCertificate(block.Bytes)
+		if err == nil {
+			key = cert.PublicKey
+		}
+	} else {
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.(*ecdsa.PublicKey)
+	if !ok || pub.Curve != elliptic.P256() {
+		return nil, errors.New("need ECDSA P-256 public key")
+	}
+	return pub, nil
+}
+
+// parsePrivateKey accepts a PEM encoded PKCS#8 or SEC 1 P-256 private key
+func parsePrivateKey(privateKeyPEM []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(privateKeyPEM)
+	if block == nil {
+		return nil, errors.New("private key is not PEM encoded")
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(*ecdsa.PrivateKey)
+	if !ok || priv.Curve != elliptic.P256() {
+		return nil, errors.New("need ECDSA P-256 private key")
+	}
+	return priv, nil
+}
+
+// keyEncryptionKey derives the AES key from the ECDH shared secret
+func keyEncryptionKey(sharedX *big.Int, ephemeral []byte) (cipher.AEAD, error) {
+	digest := sha256.New()
+	digest.Write(sharedX.Bytes())
+	digest.Write(ephemeral)
+	digest.Write([]byte("wrap"))
+	block, err := aes.NewCipher(digest.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// wrapDataKey encrypts the data key for a recipient. The ephemeral key is
+// derived from the data key so that every endorser computes the same result.
+func wrapDataKey(stub shim.ChaincodeStubInterface, dataKey []byte, stateKey string,
+	recipient *RecipientKey) (*WrappedKey, error) {
+
+	pub, err := parsePublicKey(recipient.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	curve := elliptic.P256()
+	mac := hmac.New(sha256.New, dataKey)
+	mac.Write([]byte(stub.GetTxID() + "\x00" + stateKey + "\x00" + recipient.MSP))
+	scalar := new(big.Int).SetBytes(mac.Sum(nil))
+	scalar.Mod(scalar, new(big.Int).Sub(curve.Params().N, big.NewInt(1)))
+	scalar.Add(scalar, big.NewInt(1))
+
+	ephX, ephY := curve.ScalarBaseMult(scalar.Bytes())
+	ephemeral := elliptic.Marshal(curve, ephX, ephY)
+	sharedX, _ := curve.ScalarMult(pub.X, pub.Y, scalar.Bytes())
+
+	gcm, err := keyEncryptionKey(sharedX, ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	wrapped := WrappedKey{
+		MSP:                recipient.MSP,
+		RecipientKeyID:     recipient.KeyID,
+		EphemeralPublicKey: ephemeral,
+		Nonce:              cipherNonce(stub, dataKey, stateKey, recipient.MSP, dataKey, gcm.NonceSize()),
+	}
+	wrapped.WrappedKey = gcm.Seal(nil, wrapped.Nonce, dataKey, []byte(stateKey))
+	return &wrapped, nil
+}
+
+func unwrapDataKey(priv *ecdsa.PrivateKey, stateKey string, wrapped WrappedKey) ([]byte, error) {
+	curve := elliptic.P256()
+	ephX, ephY := elliptic.Unmarshal(curve, wrapped.EphemeralPublicKey)
+	if ephX == nil {
+		return nil, errors.New("invalid ephemeral public key")
+	}
+	sharedX, _ := curve.ScalarMult(ephX, ephY, priv.D.Bytes())
+	gcm, err := keyEncryptionKey(sharedX, wrapped.EphemeralPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped.Nonce) != gcm.NonceSize() {
+		return nil, errors.New("invalid nonce size")
+	}
+	dataKey, err := gcm.Open(nil, wrapped.Nonce, wrapped.WrappedKey, []byte(stateKey))
+	if err != nil {
+		return nil, errors.New("unwrap data key failed: " + err.Error())
+	}
+	return dataKey, nil
+}
+
+func (s *SmartContract) readRecipientKey(stub shim.ChaincodeStubInterface, msp string) (*RecipientKey, error) {
+	keyKey, err := stub.CreateCompositeKey(recipientKeyIndex, []string{msp})
+	if err != nil {
+		return nil, err
+	}
+	keyAsBytes, err := stub.GetState(keyKey)
+	if err != nil {
+		return nil, err
+	}
+	if keyAsBytes == nil {
+		return nil, errors.New("no public key registered for " + msp)
+	}
+	var recipient RecipientKey
+	err = json.Unmarshal(keyAsBytes, &recipient)
+	if err != nil {
+		return nil, err
+	}
+	return &recipient, nil
+}
+
+func (s *SmartContract) readRecipientKeyByID(stub shim.ChaincodeStubInterface, msp, keyID string) (*RecipientKey, error) {
+	historyKey, err := stub.CreateCompositeKey(recipientKeyHistoryIndex, []string{msp, keyID})
+	if err != nil {
+		return nil, err
+	}
+	keyAsBytes, err := stub.GetState(historyKey)
+	if err != nil {
+		return nil, err
+	}
+	if keyAsBytes == nil {
+		return nil, errors.New("no public key " + keyID + " registered for " + msp)
+	}
+	var recipient RecipientKey
+	err = json.Unmarshal(keyAsBytes, &recipient)
+	if err != nil {
+		return nil, err
+	}
+	return &recipient, nil
+}
+
+func (s *SmartContract) readRecipients(stub shim.ChaincodeStubInterface, stateKey string) (string, *Recipients, error) {
+	recipientsKey, err := stub.CreateCompositeKey(recipientsIndex, []string{stateKey})
+	if err != nil {
+		return "", nil, err
+	}
+	recipientsAsBytes, err := stub.GetState(recipientsKey)
+	if err != nil {
+		return "", nil, err
+	}
+	if recipientsAsBytes == nil {
+		return recipientsKey, nil, nil
+	}
+	var recipients Recipients
+	err = json.Unmarshal(recipientsAsBytes, &recipients)
+	if err != nil {
+		return "", nil, err
+	}
+	return recipientsKey, &recipients, nil
+}
+
+func (s *SmartContract) writeRecipients(stub shim.ChaincodeStubInterface, recipientsKey string,
+	recipients *Recipients) ([]byte, error) {
+
+	sort.Slice(recipients.Recipients, func(i, j int) bool {
+		return recipients.Recipients[i].MSP < recipients.Recipients[j].MSP
+	})
+	recipientsAsBytes, err := json.Marshal(recipients)
+	if err != nil {
+		return nil, err
+	}
+	return recipientsAsBytes, stub.PutState(recipientsKey, recipientsAsBytes)
+}
+
+// assertUploader checks the caller's org uploaded the value, or the caller is
+// an admin
+func (s *SmartContract) assertUploader(stub shim.ChaincodeStubInterface, recipients *Recipients) error {
+	caller, err := cid.GetMSPID(stub)
+	if err != nil {
+		return err
+	}
+	if recipients.UploaderMSP != "" && recipients.UploaderMSP == caller {
+		return nil
+	}
+	if err = s.assertAdmin(stub); err != nil {
+		return errors.New(caller + " did not upload " + recipients.Key + " and is no admin")
+	}
+	return nil
+}
+
+// wrapForRecipients adds wrapped data keys for the given MSPs, existing
+// recipients are wrapped again with their current public key
+func (s *SmartContract) wrapForRecipients(stub shim.ChaincodeStubInterface, dataKey []byte,
+	recipients *Recipients, msps []string) error {
+
+	for _, msp := range msps {
+		recipient, err := s.readRecipientKey(stub, msp)
+		if err != nil {
+			return err
+		}
+		wrapped, err := wrapDataKey(stub, dataKey, recipients.Key, recipient)
+		if err != nil {
+			return errors.New("wrap data key for " + msp + " failed: " + err.Error())
+		}
+		replaced := false
+		for i := range recipients.Recipients {
+			if recipients.Recipients[i].MSP == msp {
+				recipients.Recipients[i] = *wrapped
+				replaced = true
+			}
+		}
+		if !replaced {
+			recipients.Recipients = append(recipients.Recipients, *wrapped)
+		}
+	}
+	return nil
+}
+
+// unwrapForCaller finds the wrapped data key of the private key and unwraps it
+func unwrapForCaller(recipients *Recipients, privateKeyPEM []byte) ([]byte, error) {
+	priv, err := parsePrivateKey(privateKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	id := publicKeyID(&priv.PublicKey)
+	for _, wrapped := range recipients.Recipients {
+		if wrapped.RecipientKeyID == id {
+			dataKey, err := unwrapDataKey(priv, recipients.Key, wrapped)
+			if err != nil {
+				return nil, err
+			}
+			if keyID(dataKey) != recipients.KeyID {
+				return nil, errors.New("unwrapped data key does not match")
+			}
+			return dataKey, nil
+		}
+	}
+	return nil, errors.New("private key is not a recipient of " + recipients.Key)
+}
+
+// registerRecipientKey registers the public key of the caller's org, the
+// caller must be an admin of the org. Earlier keys are kept by key ID.
+func (s *SmartContract) registerRecipientKey(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return s.returnError("Wrong number of parameters, need PEM encoded public key or certificate")
+	}
+
+	pub, err := parsePublicKey(args[0])
+	if err != nil {
+		return s.returnError("Invalid public key: " + err.Error())
+	}
+	msp, err := cid.GetMSPID(APIstub)
+	if err != nil {
+		return s.returnError("Get MSP ID failed: " + err.Error())
+	}
+	err = s.assertOrgAdmin(APIstub, msp)
+	if err != nil {
+		return s.returnError("Register denied: " + err.Error())
+	}
+
+	logger.Debugf("Register recipient key: [msp] %s, [key ID] %s", msp, publicKeyID(pub))
+
+	publicKeyDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return s.returnError("Marshal public key failed: " + err.Error())
+	}
+	recipient := RecipientKey{
+		MSP:       msp,
+		PublicKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyDER})),
+		KeyID:     publicKeyID(pub),
+	}
+	keyKey, err := APIstub.CreateCompositeKey(recipientKeyIndex, []string{msp})
+	if err != nil {
+		return s.returnError("Create composite key failed: " + err.Error())
+	}
+	historyKey, err := APIstub.CreateCompositeKey(recipientKeyHistoryIndex, []string{msp, recipient.KeyID})
+	if err != nil {
+		return s.returnError("Create composite key failed: " + err.Error())
+	}
+	recipientAsBytes, err := json.Marshal(recipient)
+	if err != nil {
+		return s.returnError("Marshal recipient key failed: " + err.Error())
+	}
+	err = APIstub.PutState(historyKey, recipientAsBytes)
+	if err != nil {
+		return s.returnError("Data write to chain failed: " + err.Error())
+	}
+	err = APIstub.PutState(keyKey, recipientAsBytes)
+	if err != nil {
+		return s.returnError("Data write to chain failed: " + err.Error())
+	}
+	return shim.Success(recipientAsBytes)
+}
+
+// queryRecipientKey returns the current key of the MSP, or the key with the
+// given key ID
+func (s *SmartContract) queryRecipientKey(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 && len(args) != 2 {
+		return s.returnError("Wrong number of parameters, need MSP ID & optional key ID")
+	}
+
+	var recipient *RecipientKey
+	var err error
+	if len(args) == 2 {
+		recipient, err = s.readRecipientKeyByID(APIstub, args[0], args[1])
+	} else {
+		recipient, err = s.readRecipientKey(APIstub, args[0])
+	}
+	if err != nil {
+		return s.returnError("Query recipient key failed: " + err.Error())
+	}
+	recipientAsBytes, err := json.Marshal(recipient)
+	if err != nil {
+		return s.returnError("Marshal recipient key failed: " + err.Error())
+	}
+	return shim.Success(recipientAsBytes)
+}
+
+// uploadMultiEncrypt seals the value with the data key and wraps the data key
+// for every recipient MSP. An existing key is only replaced by its uploader
+// org or an admin.
+func (s *SmartContract) uploadMultiEncrypt(APIstub shim.ChaincodeStubInterface, args []string,
+	dataKey []byte) sc.Response {
+
+	if len(args) != 3 {
+		return s.returnError("Wrong number of parameters, need key, value & recipient MSP IDs (JSON array)")
+	}
+
+	key := args[0]
+	var msps []string
+	err := json.Unmarshal([]byte(args[2]), &msps)
+	if err != nil || len(msps) == 0 {
+		return s.returnError("Recipients must be a non empty JSON array of MSP IDs")
+	}
+
+	logger.Debugf("Multi-recipient encrypt: [key] %s, [recipients] %v", key, msps)
+
+	recipientsKey, existing, err := s.readRecipients(APIstub, key)
+	if err != nil {
+		return s.returnError("Query recipients failed: " + err.Error())
+	}
+	if existing == nil {
+		existingValue, err := s.getState(APIstub, key)
+		if err != nil {
+			return s.returnError("Query failed: " + err.Error())
+		}
+		if existingValue != nil {
+			existing = &Recipients{Key: key}
+		}
+	}
+	if existing != nil {
+		err = s.assertUploader(APIstub, existing)
+		if err != nil {
+			return s.returnError("Overwrite denied: " + err.Error())
+		}
+	}
+	uploader, err := cid.GetMSPID(APIstub)
+	if err != nil {
+		return s.returnError("Get MSP ID failed: " + err.Error())
+	}
+
+	cipherText, err := sealValue(APIstub, dataKey, key, "", []byte(args[1]))
+	if err != nil {
+		return s.returnError("Encrypt failed: " + err.Error())
+	}
+	recipients := &Recipients{Key: key, KeyID: keyID(dataKey), UploaderMSP: uploader, Recipients: []WrappedKey{}}
+	err = s.wrapForRecipients(APIstub, dataKey, recipients, msps)
+	if err != nil {
+		return s.returnError(err.Error())
+	}
+
+	err = s.putState(APIstub, DocTypeEncrypted, key, cipherText)
+	if err != nil {
+		return s.returnError("Data write to chain failed: " + err.Error())
+	}
+	recipientsAsBytes, err := s.writeRecipients(APIstub, recipientsKey, recipients)
+	if err != nil {
+		return s.returnError("Recipients write to chain failed: " + err.Error())
+	}
+	return shim.Success(recipientsAsBytes)
+}
+
+// queryMultiDecrypt unwraps the data key with the recipient private key and
+// decrypts the value
+func (s *SmartContract) queryMultiDecrypt(APIstub shim.ChaincodeStubInterface, args []string,
+	privateKeyPEM []byte) sc.Response {
+
+	if len(args) != 1 {
+		return s.returnError("Wrong number of parameters, need key")
+	}
+
+	key := args[0]
+	_, recipients, err := s.readRecipients(APIstub, key)
+	if err != nil {
+		return s.returnError("Query recipients failed: " + err.Error())
+	}
+	if recipients == nil {
+		return s.returnError("No recipients for " + key)
+	}
+	dataKey, err := unwrapForCaller(recipients, privateKeyPEM)
+	if err != nil {
+		return s.returnError(err.Error())
+	}
+
+	cipherText, err := s.getState(APIstub, key)
+	if err != nil {
+		return s.returnError("Query failed: " + err.Error())
+	}
+	clearText, err := openValue(dataKey, key, cipherText)
+	if err != nil {
+		return s.returnError("Data decrypt failed: " + err.Error())
+	}
+	return shim.Success(clearText)
+}
+
+// addRecipients wraps the data key for more MSPs, the caller proves access
+// with the private key of a current recipient
+func (s *SmartContract) addRecipients(APIstub shim.ChaincodeStubInterface, args []string,
+	privateKeyPEM []byte) sc.Response {
+
+	if len(args) != 2 {
+		return s.returnError("Wrong number of parameters, need key & recipient MSP IDs (JSON array)")
+	}
+
+	var msps []string
+	err := json.Unmarshal([]byte(args[1]), &msps)
+	if err != nil || len(msps) == 0 {
+		return s.returnError("Recipients must be a non empty JSON array of MSP IDs")
+	}
+	recipientsKey, recipients, err := s.readRecipients(APIstub, args[0])
+	if err != nil {
+		return s.returnError("Query recipients failed: " + err.Error())
+	}
+	if recipients == nil {
+		return s.returnError("No recipients for " + args[0])
+	}
+	dataKey, err := unwrapForCaller(recipients, privateKeyPEM)
+	if err != nil {
+		return s.returnError(err.Error())
+	}
+
+	logger.Debugf("Add recipients: [key] %s, [recipients] %v", args[0], msps)
+
+	err = s.wrapForRecipients(APIstub, dataKey, recipients, msps)
+	if err != nil {
+		return s.returnError(err.Error())
+	}
+	recipientsAsBytes, err := s.writeRecipients(APIstub, recipientsKey, recipients)
+	if err != nil {
+		return s.returnError("Recipients write to chain failed: " + err.Error())
+	}
+	return shim.Success(recipientsAsBytes)
+}
+
+// revokeRecipients removes the wrapped data keys of MSPs, only the uploader
+// org or an admin may revoke
+func (s *SmartContract) revokeRecipients(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 {
+		return s.returnError("Wrong number of parameters, need key & recipient MSP IDs (JSON array)")
+	}
+
+	var msps []string
+	err := json.Unmarshal([]byte(args[1]), &msps)
+	if err != nil || len(msps) == 0 {
+		return s.returnError("Recipients must be a non empty JSON array of MSP IDs")
+	}
+	recipientsKey, recipients, err := s.readRecipients(APIstub, args[0])
+	if err != nil {
+		return s.returnError("Query recipients failed: " + err.Error())
+	}
+	if recipients == nil {
+		return s.returnError("No recipients for " + args[0])
+	}
+	err = s.assertUploader(APIstub, recipients)
+	if err != nil {
+		return s.returnError("Revoke denied: " + err.Error())
+	}
+
+	revoke := map[string]bool{}
+	for _, msp := range msps {
+		revoke[msp] = true
+	}
+	remaining := []WrappedKey{}
+	for _, wrapped := range recipients.Recipients {
+		if !revoke[wrapped.MSP] {
+			remaining = append(remaining, wrapped)
+		}
+	}
+	if len(remaining) == 0 {
+		return s.returnError("Cannot revoke all recipients")
+	}
+
+	logger.Debugf("Revoke recipients: [key] %s, [recipients] %v", args[0], msps)
+
+	recipients.Recipients = remaining
+	recipientsAsBytes, err := s.writeRecipients(APIstub, recipientsKey, recipients)
+	if err != nil {
+		return s.returnError("Recipients write to chain failed: " + err.Error())
+	}
+	return shim.Success(recipientsAsBytes)
+}
+
+func (s *SmartContract) queryRecipients(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return s.returnError("Wrong number of parameters, need key")
+	}
+
+	_, recipients, err := s.readRecipients(APIstub, args[0])
+	if err != nil {
+		return s.returnError("Query recipients failed: " + err.Error())
+	}
+	if recipients == nil {
+		return shim.Success(nil)
+	}
+	recipientsAsBytes, err := json.Marshal(recipients)
+	if err != nil {
+		return s.returnError("Marshal recipients failed: " + err.Error())
+	}
+	return shim.Success(recipientsAsBytes)
+}
@@ -0,0 +1,71 @@
+// Written by Xu Chen Hao
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+func testPublicKey(t *testing.T) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func TestRegisterRecipientKey(t *testing.T) {
+	s := new(SmartContract)
+	stub := newIdentityStub("Org1MSP", "Org2MSP")
+	register := func(publicKey string) func(shim.ChaincodeStubInterface) sc.Response {
+		return func(stub shim.ChaincodeStubInterface) sc.Response {
+			return s.registerRecipientKey(stub, []string{publicKey})
+		}
+	}
+	query := func(args ...string) RecipientKey {
+		response := stub.invoke(func(stub shim.ChaincodeStubInterface) sc.Response {
+			return s.queryRecipientKey(stub, args)
+		})
+		if failed(response) {
+			t.Fatalf("query %v: %s", args, response.Payload)
+		}
+		var recipient RecipientKey
+		if err := json.Unmarshal(response.Payload, &recipient); err != nil {
+			t.Fatal(err)
+		}
+		return recipient
+	}
+
+	stub.as(t, "Org1MSP", false)
+	if response := stub.invoke(register(testPublicKey(t))); !failed(response) {
+		t.Fatal("client registered the org key")
+	}
+
+	stub.as(t, "Org1MSP", true)
+	if response := stub.invoke(register(testPublicKey(t))); failed(response) {
+		t.Fatalf("%s", response.Payload)
+	}
+	first := query("Org1MSP")
+	if response := stub.invoke(register(testPublicKey(t))); failed(response) {
+		t.Fatalf("%s", response.Payload)
+	}
+	second := query("Org1MSP")
+	if second.KeyID == first.KeyID {
+		t.Fatal("key not replaced")
+	}
+	if kept := query("Org1MSP", first.KeyID); kept.PublicKey != first.PublicKey {
+		t.Errorf("earlier key %s not kept", first.KeyID)
+	}
+}
@@ -0,0 +1,168 @@
+// Written by Xu Chen Hao
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Sensitive values are redacted before they are logged. A value is replaced
+// by a summary of its length and a keyed hash, so that log lines of the same
+// value can be matched without revealing it. The hash key is random per
+// process, so low-entropy values like prices can't be guessed from the hash.
+// JSON documents are redacted per field: each field has a policy, fields
+// without a policy are summarized. Redaction only runs when a log line is
+// written, redact and redactDocument return a fmt.Stringer to pass as
+// argument of a formatted log call. Logging is local to a peer, so the switches
+// are environment variables rather than on-chain config:
+//
+//	LOG_PLAINTEXT=true                         log plaintext, for development only
+//	LOG_REDACTION_POLICY=unitPrice=omit,buyer=plain
+const (
+	EnvLogPlaintext       = "LOG_PLAINTEXT"
+	EnvLogRedactionPolicy = "LOG_REDACTION_POLICY"
+)
+
+// redaction policies of a document field
+const (
+	// log the value
+	RedactPlain = "plain"
+	// log length and hash
+	RedactHash = "hash"
+	// log the length only
+	RedactLength = "length"
+	// leave the field out
+	RedactOmit = "omit"
+)
+
+// fields logged by default, identifiers only
+var defaultRedactionPolicy = map[string]string{
+	"poNo":         RedactPlain,
+	"masterBillNo": RedactPlain,
+	"key":          RedactPlain,
+	"docType":      RedactPlain,
+}
+
+var logPlaintext = os.Getenv(EnvLogPlaintext) == "true"
+
+var redactionPolicy = parseRedactionPolicy(os.Getenv(EnvLogRedactionPolicy))
+
+var redactionKey = newRedactionKey()
+
+func newRedactionKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic("read random redaction key failed: " + err.Error())
+	}
+	return key
+}
+
+// parseRedactionPolicy adds the "field=policy" pairs to the default policy.
+// Unknown policies fall back to hash.
+func parseRedactionPolicy(spec string) map[string]string {
+	policy := make(map[string]string, len(defaultRedactionPolicy))
+	for field, fieldPolicy := range defaultRedactionPolicy {
+		policy[field] = fieldPolicy
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			continue
+		}
+		switch parts[1] {
+		case RedactPlain, RedactHash, RedactLength, RedactOmit:
+			policy[parts[0]] = parts[1]
+		default:
+			policy[parts[0]] = RedactHash
+		}
+	}
+	return policy
+}
+
+func redactionSummary(value []byte, fieldPolicy string) string {
+	if fieldPolicy == RedactLength {
+		return "<redacted " + strconv.Itoa(len(value)) + " bytes>"
+	}
+	mac := hmac.New(sha256.New, redactionKey)
+	mac.Write(value)
+	return "<redacted " + strconv.Itoa(len(value)) + " bytes, hash " + hex.EncodeToString(mac.Sum(nil)[:8]) + ">"
+}
+
+type redactedValue []byte
+
+type redactedDocument []byte
+
+// redact returns the value for a log line
+func redact(value []byte) fmt.Stringer {
+	return redactedValue(value)
+}
+
+// redactDocument returns a JSON document for a log line with every field
+// redacted after its policy. Other values are redacted as a whole.
+func redactDocument(value []byte) fmt.Stringer {
+	return redactedDocument(value)
+}
+
+func (value redactedValue) String() string {
+	if logPlaintext {
+		return string(value)
+	}
+	return redactionSummary(value, RedactHash)
+}
+
+func (value redactedDocument) String() string {
+	if logPlaintext {
+		return string(value)
+	}
+	var doc interface{}
+	if err := json.Unmarshal(value, &doc); err != nil {
+		return redactedValue(value).String()
+	}
+	var redacted bytes.Buffer
+	encoder := json.NewEncoder(&redacted)
+	// keep the summaries readable
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(redactNode(doc, RedactHash)); err != nil {
+		return redactedValue(value).String()
+	}
+	return strings.TrimSuffix(redacted.String(), "\n")
+}
+
+func redactNode(node interface{}, fieldPolicy string) interface{} {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(n))
+		for field, child := range n {
+			childPolicy, in := redactionPolicy[field]
+			if !in {
+				// nested fields follow the policy of the parent unless set
+				childPolicy = fieldPolicy
+			}
+			if childPolicy == RedactOmit {
+				continue
+			}
+			redacted[field] = redactNode(child, childPolicy)
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(n))
+		for i, child := range n {
+			redacted[i] = redactNode(child, fieldPolicy)
+		}
+		return redacted
+	default:
+		if fieldPolicy == RedactPlain {
+			return n
+		}
+		value, _ := json.Marshal(n)
+		return redactionSummary(value, fieldPolicy)
+	}
+}
@@ -0,0 +1,450 @@
+// Written by Xu Chen Hao
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Every cipher envelope records the ID of its key (see keyID). reencrypt moves
+// the values of a key range from an old to a new key page by page, the
+// progress of a rotation is kept under rotation~oldKeyID~newKeyID.
+const rotationIndex = "rotation"
+
+const OLDKEY = "OLDKEY"
+const NEWKEY = "NEWKEY"
+
+const defaultReencryptPageSize = 100
+
+// key ID reported for values of the legacy entities encrypter
+const legacyKeyID = "legacy"
+
+type RotationProgress struct {
+	OldKeyID    string `json:"oldKeyId"`
+	NewKeyID    string `json:"newKeyId"`
+	StartKey    string `json:"startKey"`
+	EndKey      string `json:"endKey"`
+	Examined    int    `json:"examined"`
+	Reencrypted int    `json:"reencrypted"`
+	Bookmark    string `json:"bookmark"`
+	Done        bool   `json:"done"`
+	LastTxId    string `json:"lastTxId"`
+}
+
+type ReencryptSummary struct {
+	TxId        string           `json:"txId"`
+	Examined    int              `json:"examined"`
+	Reencrypted int              `json:"reencrypted"`
+	Keys        []string         `json:"keys"`
+	Progress    RotationProgress `json:"progress"`
+}
+
+type KeyIDs struct {
+	Key    string   `json:"key"`
+	KeyIDs []string `json:"keyIds"`
+}
+
+// rekey moves one sealed value from the old to the new key, values under
+// other keys are left untouched
+func rekey(stub shim.ChaincodeStubInterface, oldKey, newKey []byte, stateKey, label string,
+	sealed []byte) ([]byte, bool, error) {
+
+	envelope, err := decodeCipherEnvelope(sealed)
+	if err != nil {
+		return nil, false, err
+	}
+	if envelope.KeyID != keyID(oldKey) {
+		return nil, false, nil
+	}
+	clearText, err := openValue(oldKey, stateKey, sealed)
+	if err != nil {
+		return nil, false, err
+	}
+	resealed, err := sealValue(stub, newKey, stateKey, label, clearText)
+	if err != nil {
+		return nil, false, err
+	}
+	return resealed, true, nil
+}
+
+// reencryptNode re-encrypts the cipher envelopes and encrypted fields of a
+// JSON document. Legacy fields are only moved if legacy is set.
+func (s *SmartContract) reencryptNode(stub shim.ChaincodeStubInterface, oldKey, newKey, IV []byte, legacy bool,
+	stateKey, path string, node interface{}) (interface{}, bool, error) {
+
+	changed := false
+	switch value := node.(type) {
+	case map[string]interface{}:
+		for name, child := range value {
+			result, childChanged, err := s.reencryptNode(stub, oldKey, newKey, IV, legacy, stateKey,
+				strings.TrimPrefix(path+"."+name, "."), child)
+			if err != nil {
+				return nil, false, err
+			}
+			value[name] = result
+			changed = changed || childChanged
+		}
+	case []interface{}:
+		for i, child := range value {
+			result, childChanged, err := s.reencryptNode(stub, oldKey, newKey, IV, legacy, stateKey,
+				strings.TrimPrefix(path+"."+strconv.Itoa(i), "."), child)
+			if err != nil {
+				return nil, false, err
+			}
+			value[i] = result
+			changed = changed || childChanged
+		}
+	case string:
+		if isCipherEnvelope([]byte(value)) {
+			resealed, changed, err := rekey(stub, oldKey, newKey, stateKey, path, []byte(value))
+			if err != nil || !changed {
+				return node, false, err
+			}
+			return string(resealed), true, nil
+		}
+		if !isEncryptedField(value) {
+			return node, false, nil
+		}
+		parts := strings.SplitN(strings.TrimPrefix(value, fieldCipherPrefix), ":", 2)
+		if len(parts) != 2 {
+			return nil, false, errors.New("invalid encrypted field " + path)
+		}
+		var resealed []byte
+		switch parts[0] {
+		case CipherAlgAES256GCM:
+			sealed, err := base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				return nil, false, err
+			}
+			resealed, changed, err = rekey(stub, oldKey, newKey, stateKey, path, sealed)
+			if err != nil || !changed {
+				return node, false, err
+			}
+		case FieldAlgAES256CBC:
+			// legacy fields carry no key ID, they are only moved if named
+			if !legacy {
+				return node, false, nil
+			}
+			clear, err := s.decryptField(stub, oldKey, IV, stateKey, value)
+			if err != nil {
+				return nil, false, errors.New("decrypt field " + path + " failed: " + err.Error())
+			}
+			clearText, err := json.Marshal(clear)
+			if err != nil {
+				return nil, false, err
+			}
+			resealed, err = sealValue(stub, newKey, stateKey, path, clearText)
+			if err != nil {
+				return nil, false, err
+			}
+		default:
+			return nil, false, errors.New("unsupported field encryption algorithm: " + parts[0])
+		}
+		return fieldCipherPrefix + CipherAlgAES256GCM + ":" + base64.StdEncoding.EncodeToString(resealed),
+			true, nil
+	}
+	return node, changed, nil
+}
+
+// reencryptValue returns the value re-encrypted under the new key and whether
+// anything was under the old key. Legacy values carry no key ID, a wrong key
+// may even pass the padding check, so they are only moved if legacy is set
+// and then must decrypt.
+func (s *SmartContract) reencryptValue(stub shim.ChaincodeStubInterface, oldKey, newKey, IV []byte, legacy bool,
+	stateKey string, value []byte) ([]byte, bool, error) {
+
+	if isCipherEnvelope(value) {
+		return rekey(stub, oldKey, newKey, stateKey, "", value)
+	}
+	if json.Valid(value) {
+		doc, err := decodeJSON(value)
+		if err != nil {
+			return nil, false, err
+		}
+		doc, changed, err := s.reencryptNode(stub, oldKey, newKey, IV, legacy, stateKey, "", doc)
+		if err != nil || !changed {
+			return nil, false, err
+		}
+		docAsBytes, err := json.Marshal(doc)
+		return docAsBytes, true, err
+	}
+
+	// legacy entities cipher text cannot be told apart from other binary
+	// values
+	if !legacy {
+		return nil, false, nil
+	}
+	clearText, err := s.openAny(stub, oldKey, IV, stateKey, value)
+	if err != nil {
+		return nil, false, errors.New("decrypt legacy value failed: " + err.Error())
+	}
+	resealed, err := sealValue(stub, newKey, stateKey, "", clearText)
+	return resealed, err == nil, err
+}
+
+// collectKeyIDs adds the key IDs of all cipher envelopes and encrypted fields
+// of a JSON document
+func collectKeyIDs(node interface{}, keyIDs map[string]bool) {
+	switch value := node.(type) {
+	case map[string]interface{}:
+		for _, child := range value {
+			collectKeyIDs(child, keyIDs)
+		}
+	case []interface{}:
+		for _, child := range value {
+			collectKeyIDs(child, keyIDs)
+		}
+	case string:
+		sealed := []byte(value)
+		if isEncryptedField(value) {
+			parts := strings.SplitN(strings.TrimPrefix(value, fieldCipherPrefix), ":", 2)
+			if len(parts) != 2 || parts[0] != CipherAlgAES256GCM {
+				keyIDs[legacyKeyID] = true
+				return
+			}
+			sealed, _ = base64.StdEncoding.DecodeString(parts[1])
+		}
+		if isCipherEnvelope(sealed) {
+			if envelope, err := decodeCipherEnvelope(sealed); err == nil {
+				keyIDs[envelope.KeyID] = true
+			}
+		}
+	}
+}
+
+func (s *SmartContract) readRotation(stub shim.ChaincodeStubInterface, oldKeyID,
+	newKeyID string) (string, *RotationProgress, error) {
+
+	rotationKey, err := stub.CreateCompositeKey(rotationIndex, []string{oldKeyID, newKeyID})
+	if err != nil {
+		return "", nil, err
+	}
+	progressAsBytes, err := stub.GetState(rotationKey)
+	if err != nil {
+		return "", nil, err
+	}
+	if progressAsBytes == nil {
+		return rotationKey, nil, nil
+	}
+	var progress RotationProgress
+	err = json.Unmarshal(progressAsBytes, &progress)
+	if err != nil {
+		return "", nil, err
+	}
+	return rotationKey, &progress, nil
+}
+
+// reencrypt moves one page of a key range from the old to the new key. Pass
+// the returned bookmark to the next call until the rotation is done. Values of
+// the legacy entities encrypter are only moved if their state keys are listed
+// and the IV is given.
+func (s *SmartContract) reencrypt(APIstub shim.ChaincodeStubInterface, args []string,
+	oldKey, newKey, IV []byte) sc.Response {
+
+	if len(args) < 2 || len(args) > 5 {
+		return s.returnError("Wrong number of parameters, need start key, end key, optional page size, " +
+			"bookmark & legacy keys (JSON array)")
+	}
+	if len(newKey) != 32 {
+		return s.returnError("Need 256 bit new key")
+	}
+	if keyID(oldKey) == keyID(newKey) {
+		return s.returnError("Old and new key are the same")
+	}
+
+	startKey, endKey := args[0], args[1]
+	pageSize := defaultReencryptPageSize
+	if len(args) > 2 && args[2] != "" {
+		size, err := strconv.Atoi(args[2])
+		if err != nil || size <= 0 {
+			return s.returnError("Invalid page size: " + args[2])
+		}
+		pageSize = size
+	}
+	bookmark := ""
+	if len(args) > 3 {
+		bookmark = args[3]
+	}
+	legacyKeys := map[string]bool{}
+	if len(args) > 4 && args[4] != "" {
+		var keys []string
+		err := json.Unmarshal([]byte(args[4]), &keys)
+		if err != nil {
+			return s.returnError("Legacy keys format error: " + err.Error())
+		}
+		if IV == nil {
+			return s.returnError("Need IV to move legacy values")
+		}
+		for _, key := range keys {
+			legacyKeys[key] = true
+		}
+	}
+
+	rotationKey, progress, err := s.readRotation(APIstub, keyID(oldKey), keyID(newKey))
+	if err != nil {
+		return s.returnError("Query rotation failed: " + err.Error())
+	}
+	if progress == nil || bookmark == "" {
+		progress = &RotationProgress{OldKeyID: keyID(oldKey), NewKeyID: keyID(newKey),
+			StartKey: startKey, EndKey: endKey}
+	} else if progress.StartKey != startKey || progress.EndKey != endKey {
+		return s.returnError("Key range differs from the rotation in progress")
+	}
+
+	logger.Debugf("Reencrypt: [old key] %s, [new key] %s, [range] %s - %s, [page size] %d, [bookmark] %s",
+		progress.OldKeyID, progress.NewKeyID, startKey, endKey, pageSize, bookmark)
+
+	// paginated queries are not allowed in update transactions, so continue
+	// right after the bookmark in a normal range query
+	from := startKey
+	if bookmark != "" {
+		from = bookmark + "\x00"
+	}
+	resultsIterator, err := APIstub.GetStateByRange(from, endKey)
+	if err != nil {
+		return s.returnError("Query failed: " + err.Error())
+	}
+	defer resultsIterator.Close()
+
+	summary := ReencryptSummary{TxId: APIstub.GetTxID(), Keys: []string{}}
+	more := false
+	lastKey := ""
+	for resultsIterator.HasNext() {
+		item, err := resultsIterator.Next()
+		if err != nil {
+			return s.returnError("Fetch next result failed: " + err.Error())
+		}
+		if summary.Examined == pageSize {
+			more = true
+			break
+		}
+		summary.Examined++
+		lastKey = item.Key
+
+		envelope, value := decodeEnvelope(item.Value)
+		resealed, changed, err := s.reencryptValue(APIstub, oldKey, newKey, IV, legacyKeys[item.Key], item.Key, value)
+		if err != nil {
+			return s.returnError("Reencrypt " + item.Key + " failed: " + err.Error())
+		}
+		if !changed {
+			continue
+		}
+
+		stored := resealed
+		if envelope.Version > 0 {
+			envelope.Value, envelope.Data = nil, nil
+			if json.Valid(resealed) {
+				envelope.Value = json.RawMessage(resealed)
+			} else {
+				envelope.Data = resealed
+			}
+			stored, err = json.Marshal(envelope)
+			if err != nil {
+				return s.returnError("Marshal envelope failed: " + err.Error())
+			}
+		}
+		err = APIstub.PutState(item.Key, stored)
+		if err != nil {
+			return s.returnError("Data write to chain failed: " + err.Error())
+		}
+		summary.Reencrypted++
+		summary.Keys = append(summary.Keys, item.Key)
+	}
+
+	progress.Examined += summary.Examined
+	progress.Reencrypted += summary.Reencrypted
+	progress.Done = !more
+	progress.Bookmark = ""
+	if more {
+		progress.Bookmark = lastKey
+	}
+	progress.LastTxId = summary.TxId
+	summary.Progress = *progress
+
+	progressAsBytes, err := json.Marshal(progress)
+	if err != nil {
+		return s.returnError("Marshal rotation progress failed: " + err.Error())
+	}
+	err = APIstub.PutState(rotationKey, progressAsBytes)
+	if err != nil {
+		return s.returnError("Data write to chain failed: " + err.Error())
+	}
+
+	summaryAsBytes, err := json.Marshal(summary)
+	if err != nil {
+		return s.returnError("Marshal reencrypt summary failed: " + err.Error())
+	}
+	err = APIstub.SetEvent("reencrypt", summaryAsBytes)
+	if err != nil {
+		return s.returnError("Set event failed: " + err.Error())
+	}
+	return shim.Success(summaryAsBytes)
+}
+
+// queryRotation returns the progress of the rotation between two key IDs
+func (s *SmartContract) queryRotation(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 {
+		return s.returnError("Wrong number of parameters, need old key ID & new key ID")
+	}
+
+	_, progress, err := s.readRotation(APIstub, args[0], args[1])
+	if err != nil {
+		return s.returnError("Query rotation failed: " + err.Error())
+	}
+	if progress == nil {
+		return shim.Success(nil)
+	}
+	progressAsBytes, err := json.Marshal(progress)
+	if err != nil {
+		return s.returnError("Marshal rotation progress failed: " + err.Error())
+	}
+	return shim.Success(progressAsBytes)
+}
+
+// queryKeyIDs returns the IDs of the keys a value is encrypted with
+func (s *SmartContract) queryKeyIDs(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return s.returnError("Wrong number of parameters, need key")
+	}
+
+	value, err := s.getState(APIstub, args[0])
+	if err != nil {
+		return s.returnError("Query failed: " + err.Error())
+	}
+	if value == nil {
+		return shim.Success(nil)
+	}
+
+	found := map[string]bool{}
+	if isCipherEnvelope(value) {
+		collectKeyIDs(string(value), found)
+	} else if doc, err := decodeJSON(value); err == nil {
+		collectKeyIDs(doc, found)
+	} else {
+		found[legacyKeyID] = true
+	}
+
+	result := KeyIDs{Key: args[0], KeyIDs: []string{}}
+	for id := range found {
+		result.KeyIDs = append(result.KeyIDs, id)
+	}
+	sort.Strings(result.KeyIDs)
+	resultAsBytes, err := json.Marshal(result)
+	if err != nil {
+		return s.returnError("Marshal key IDs failed: " + err.Error())
+	}
+	return shim.Success(resultAsBytes)
+}
+
+// queryKeyID returns the ID of the key passed via transient
+func (s *SmartContract) queryKeyID(APIstub shim.ChaincodeStubInterface, key []byte) sc.Response {
+	return shim.Success([]byte(keyID(key)))
+}
@@ -0,0 +1,522 @@
+// Written by Xu Chen Hao
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
+	"github.com/hyperledger/fabric/protos/common"
+	"github.com/hyperledger/fabric/protos/msp"
+	sc "github.com/hyperledger/fabric/protos/peer"
+	"math/big"
+	"strconv"
+	"time"
+)
+
+// Sign-only mode keeps a document in clear text and stores the signatures of
+// the submitters next to it under signature~stateKey~mspID~certFingerprint, so
+// that every signer keeps its own signature. The signature is ECDSA over the
+// SHA-256 of the stored value, made with the key of the submitter certificate.
+// Certificate chains are checked against the root and intermediate
+// certificates and the CRLs of the signer MSP in the latest channel config,
+// which is read through qscc.
+const signatureIndex = "signature"
+
+type DocumentSignature struct {
+	Key           string `json:"key"`
+	DocType       string `json:"docType"`
+	ValueHash     string `json:"valueHash"`
+	Signature     []byte `json:"signature"`
+	CertChain     string `json:"certChain"`
+	SignerMSP     string `json:"signerMSP"`
+	SignerSubject string `json:"signerSubject"`
+	// hex SHA-256 of the signing certificate
+	CertFingerprint string `json:"certFingerprint"`
+	TxId            string `json:"txId"`
+	Timestamp       string `json:"timestamp"`
+}
+
+type SignatureVerification struct {
+	Key            string `json:"key"`
+	DocType        string `json:"docType"`
+	Valid          bool   `json:"valid"`
+	ValueUnchanged bool   `json:"valueUnchanged"`
+	SignatureValid bool   `json:"signatureValid"`
+	ChainValid     bool   `json:"chainValid"`
+	SignerMSP      string `json:"signerMSP"`
+	SignerSubject  string `json:"signerSubject"`
+	// hex SHA-256 of the signing certificate
+	CertFingerprint string `json:"certFingerprint"`
+	SignedAt        string `json:"signedAt"`
+	Reason          string `json:"reason,omitempty"`
+}
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+func parseCertChain(chainPEM []byte) ([]*x509.Certificate, error) {
+	var chain []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, chainPEM = pem.Decode(chainPEM)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("no PEM encoded certificate found")
+	}
+	return chain, nil
+}
+
+func verifyECDSA(cert *x509.Certificate, digest, signature []byte) error {
+	pub, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return errors.New("need ECDSA signing certificate")
+	}
+	var sig ecdsaSignature
+	rest, err := asn1.Unmarshal(signature, &sig)
+	if err != nil || len(rest) != 0 || sig.R == nil || sig.S == nil {
+		return errors.New("signature is not an ASN.1 ECDSA signature")
+	}
+	if !ecdsa.Verify(pub, digest, sig.R, sig.S) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// queryBlock calls qscc for a block of the current channel
+func queryBlock(stub shim.ChaincodeStubInterface, number uint64) (*common.Block, error) {
+	response := stub.InvokeChaincode("qscc", [][]byte{[]byte("GetBlockByNumber"),
+		[]byte(stub.GetChannelID()), []byte(strconv.FormatUint(number, 10))}, "")
+	if response.Status != shim.OK {
+		return nil, errors.New("qscc GetBlockByNumber failed: " + response.Message)
+	}
+	block := &common.Block{}
+	return block, proto.Unmarshal(response.Payload, block)
+}
+
+// channelConfig reads the latest config of the channel
+func channelConfig(stub shim.ChaincodeStubInterface) (*common.Config, error) {
+	response := stub.InvokeChaincode("qscc", [][]byte{[]byte("GetChainInfo"),
+		[]byte(stub.GetChannelID())}, "")
+	if response.Status != shim.OK {
+		return nil, errors.New("qscc GetChainInfo failed: " + response.Message)
+	}
+	info := &common.BlockchainInfo{}
+	err := proto.Unmarshal(response.Payload, info)
+	if err != nil {
+		return nil, err
+	}
+	if info.Height == 0 {
+		return nil, errors.New("empty channel")
+	}
+
+	block, err := queryBlock(stub, info.Height-1)
+	if err != nil {
+		return nil, err
+	}
+	if block.Metadata == nil || len(block.Metadata.Metadata) <= int(common.BlockMetadataIndex_LAST_CONFIG) {
+		return nil, errors.New("block has no last config metadata")
+	}
+	metadata := &common.Metadata{}
+	err = proto.Unmarshal(block.Metadata.Metadata[common.BlockMetadataIndex_LAST_CONFIG], metadata)
+	if err != nil {
+		return nil, err
+	}
+	lastConfig := &common.LastConfig{}
+	err = proto.Unmarshal(metadata.Value, lastConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err = queryBlock(stub, lastConfig.Index)
+	if err != nil {
+		return nil, err
+	}
+	if block.Data == nil || len(block.Data.Data) == 0 {
+		return nil, errors.New("config block is empty")
+	}
+	envelope := &common.Envelope{}
+	err = proto.Unmarshal(block.Data.Data[0], envelope)
+	if err != nil {
+		return nil, err
+	}
+	payload := &common.Payload{}
+	err = proto.Unmarshal(envelope.Payload, payload)
+	if err != nil {
+		return nil, err
+	}
+	configEnvelope := &common.ConfigEnvelope{}
+	err = proto.Unmarshal(payload.Data, configEnvelope)
+	if err != nil {
+		return nil, err
+	}
+	if configEnvelope.Config == nil || configEnvelope.Config.ChannelGroup == nil {
+		return nil, errors.New("config block holds no channel config")
+	}
+	return configEnvelope.Config, nil
+}
+
+// mspCertPools returns the root and intermediate certificates and the CRLs
+// of an MSP of the channel
+func mspCertPools(stub shim.ChaincodeStubInterface, mspID string) (*x509.CertPool, *x509.CertPool,
+	[]*pkix.CertificateList, error) {
+
+	config, err := channelConfig(stub)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for _, section := range []string{"Application", "Orderer"} {
+		group, in := config.ChannelGroup.Groups[section]
+		if !in {
+			continue
+		}
+		for _, org := range group.Groups {
+			value, in := org.Values["MSP"]
+			if !in {
+				continue
+			}
+			mspConfig := &msp.MSPConfig{}
+			err = proto.Unmarshal(value.Value, mspConfig)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			fabricConfig := &msp.FabricMSPConfig{}
+			err = proto.Unmarshal(mspConfig.Config, fabricConfig)
+			if err != nil || fabricConfig.Name != mspID {
+				continue
+			}
+
+			roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+			for _, certPEM := range fabricConfig.RootCerts {
+				roots.AppendCertsFromPEM(certPEM)
+			}
+			for _, certPEM := range fabricConfig.IntermediateCerts {
+				intermediates.AppendCertsFromPEM(certPEM)
+			}
+			var crls []*pkix.CertificateList
+			for _, crlPEM := range fabricConfig.RevocationList {
+				crl, err := x509.ParseCRL(crlPEM)
+				if err != nil {
+					return nil, nil, nil, errors.New("invalid CRL of MSP " + mspID + ": " + err.Error())
+				}
+				crls = append(crls, crl)
+			}
+			return roots, intermediates, crls, nil
+		}
+	}
+	return nil, nil, nil, errors.New("MSP " + mspID + " is not part of the channel")
+}
+
+// applicationOrgs returns the MSP IDs of the application orgs of the channel
+func applicationOrgs(stub shim.ChaincodeStubInterface) ([]string, error) {
+	config, err := channelConfig(stub)
+	if err != nil {
+		return nil, err
+	}
+	group, in := config.ChannelGroup.Groups["Application"]
+	if !in {
+		return nil, errors.New("channel has no application orgs")
+	}
+	mspIDs := []string{}
+	for _, org := range group.Groups {
+		value, in := org.Values["MSP"]
+		if !in {
+			continue
+		}
+		mspConfig := &msp.MSPConfig{}
+		err = proto.Unmarshal(value.Value, mspConfig)
+		if err != nil {
+			return nil, err
+		}
+		// type 1 is an idemix MSP
+		if mspConfig.Type == 1 {
+			idemixConfig := &msp.IdemixMSPConfig{}
+			err = proto.Unmarshal(mspConfig.Config, idemixConfig)
+			if err != nil {
+				return nil, err
+			}
+			mspIDs = append(mspIDs, idemixConfig.Name)
+			continue
+		}
+		fabricConfig := &msp.FabricMSPConfig{}
+		err = proto.Unmarshal(mspConfig.Config, fabricConfig)
+		if err != nil {
+			return nil, err
+		}
+		mspIDs = append(mspIDs, fabricConfig.Name)
+	}
+	return mspIDs, nil
+}
+
+// certRevoked tells whether a CRL signed by the issuer lists the certificate
+func certRevoked(cert, issuer *x509.Certificate, crls []*pkix.CertificateList) bool {
+	for _, crl := range crls {
+		if issuer.CheckCRLSignature(crl) != nil {
+			continue
+		}
+		for _, revoked := range crl.TBSCertList.RevokedCertificates {
+			if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifyCertChain checks that the first certificate of the chain is issued
+// by the MSP, at the given time so that all endorsers agree, and that no
+// certificate of the chain is revoked by the current CRLs of the MSP
+func verifyCertChain(stub shim.ChaincodeStubInterface, mspID string, chain []*x509.Certificate,
+	at time.Time) error {
+
+	roots, intermediates, crls, err := mspCertPools(stub, mspID)
+	if err != nil {
+		return err
+	}
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	verifiedChains, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   at,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return err
+	}
+	for _, verified := range verifiedChains {
+		for i := 0; i+1 < len(verified); i++ {
+			if certRevoked(verified[i], verified[i+1], crls) {
+				return errors.New("certificate " + verified[i].Subject.String() + " is revoked")
+			}
+		}
+	}
+	return nil
+}
+
+func certFingerprint(cert *x509.Certificate) string {
+	fingerprint := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(fingerprint[:])
+}
+
+// readSignatures returns all signatures of a document
+func (s *SmartContract) readSignatures(stub shim.ChaincodeStubInterface, stateKey string) ([]DocumentSignature,
+	error) {
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(signatureIndex, []string{stateKey})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	signatures := []DocumentSignature{}
+	for resultsIterator.HasNext() {
+		item, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var signature DocumentSignature
+		err = json.Unmarshal(item.Value, &signature)
+		if err != nil {
+			return nil, err
+		}
+		signatures = append(signatures, signature)
+	}
+	return signatures, nil
+}
+
+// signDocument stores the submitter's signature of a document next to the
+// signatures of other signers. The optional certificate chain starts with the
+// submitter certificate, followed by intermediates that are not part of the
+// MSP config.
+func (s *SmartContract) signDocument(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 3 && len(args) != 4 {
+		return s.returnError("Wrong number of parameters, need document type, key, signature (base64) " +
+			"& optional certificate chain (PEM)")
+	}
+
+	docType := args[0]
+	stateKey, err := s.stateKey(docType, args[1])
+	if err != nil {
+		return s.returnError(err.Error())
+	}
+	signatureBytes, err := base64.StdEncoding.DecodeString(args[2])
+	if err != nil {
+		return s.returnError("Signature is not base64 encoded: " + err.Error())
+	}
+
+	value, err := s.getState(APIstub, stateKey)
+	if err != nil {
+		return s.returnError("Query failed: " + err.Error())
+	}
+	if value == nil {
+		return s.returnError("Document " + stateKey + " does not exist")
+	}
+
+	submitter, err := cid.GetX509Certificate(APIstub)
+	if err != nil {
+		return s.returnError("Get submitter certificate failed: " + err.Error())
+	}
+	if submitter == nil {
+		return s.returnError("Signing needs an X.509 identity")
+	}
+	mspID, err := cid.GetMSPID(APIstub)
+	if err != nil {
+		return s.returnError("Get MSP ID failed: " + err.Error())
+	}
+	chain := []*x509.Certificate{submitter}
+	if len(args) == 4 && args[3] != "" {
+		chain, err = parseCertChain([]byte(args[3]))
+		if err != nil {
+			return s.returnError("Invalid certificate chain: " + err.Error())
+		}
+		if !bytes.Equal(chain[0].Raw, submitter.Raw) {
+			return s.returnError("Signing certificate is not the submitter certificate")
+		}
+	}
+
+	digest := sha256.Sum256(value)
+	err = verifyECDSA(submitter, digest[:], signatureBytes)
+	if err != nil {
+		return s.returnError("Signature verification failed: " + err.Error())
+	}
+	txTime, err := txTimestamp(APIstub)
+	if err != nil {
+		return s.returnError("Get transaction timestamp failed: " + err.Error())
+	}
+	err = verifyCertChain(APIstub, mspID, chain, txTime)
+	if err != nil {
+		return s.returnError("Certificate chain verification failed: " + err.Error())
+	}
+
+	logger.Debugf("Sign document: [key] %s, [signer] %s, %s", stateKey, mspID, submitter.Subject.String())
+
+	var chainPEM bytes.Buffer
+	for _, cert := range chain {
+		pem.Encode(&chainPEM, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	signature := DocumentSignature{
+		Key:             stateKey,
+		DocType:         docType,
+		ValueHash:       hex.EncodeToString(digest[:]),
+		Signature:       signatureBytes,
+		CertChain:       chainPEM.String(),
+		SignerMSP:       mspID,
+		SignerSubject:   submitter.Subject.String(),
+		CertFingerprint: certFingerprint(submitter),
+		TxId:            APIstub.GetTxID(),
+		Timestamp:       txTime.UTC().Format(time.RFC3339Nano),
+	}
+	signatureKey, err := APIstub.CreateCompositeKey(signatureIndex,
+		[]string{stateKey, mspID, signature.CertFingerprint})
+	if err != nil {
+		return s.returnError("Create composite key failed: " + err.Error())
+	}
+	signatureAsBytes, err := json.Marshal(signature)
+	if err != nil {
+		return s.returnError("Marshal signature failed: " + err.Error())
+	}
+	err = APIstub.PutState(signatureKey, signatureAsBytes)
+	if err != nil {
+		return s.returnError("Data write to chain failed: " + err.Error())
+	}
+	return shim.Success(signatureAsBytes)
+}
+
+// verifySignature checks a stored signature against the current document
+// value and the signer MSP
+func verifySignature(stub shim.ChaincodeStubInterface, signature DocumentSignature,
+	value []byte) SignatureVerification {
+
+	result := SignatureVerification{
+		Key:             signature.Key,
+		DocType:         signature.DocType,
+		SignerMSP:       signature.SignerMSP,
+		SignerSubject:   signature.SignerSubject,
+		CertFingerprint: signature.CertFingerprint,
+		SignedAt:        signature.Timestamp,
+	}
+	digest := sha256.Sum256(value)
+	result.ValueUnchanged = value != nil && hex.EncodeToString(digest[:]) == signature.ValueHash
+
+	chain, err := parseCertChain([]byte(signature.CertChain))
+	if err != nil {
+		result.Reason = "invalid certificate chain: " + err.Error()
+	} else if err = verifyECDSA(chain[0], digest[:], signature.Signature); err != nil {
+		result.Reason = "signature verification failed: " + err.Error()
+	} else {
+		result.SignatureValid = true
+		result.CertFingerprint = certFingerprint(chain[0])
+		// the chain is checked at signing time, the MSP may have changed since
+		signedAt, err := time.Parse(time.RFC3339Nano, signature.Timestamp)
+		if err == nil {
+			err = verifyCertChain(stub, signature.SignerMSP, chain, signedAt)
+		}
+		if err != nil {
+			result.Reason = "certificate chain verification failed: " + err.Error()
+		} else {
+			result.ChainValid = true
+		}
+	}
+	if !result.ValueUnchanged && result.Reason == "" {
+		result.Reason = "document changed after signing"
+	}
+	result.Valid = result.ValueUnchanged && result.SignatureValid && result.ChainValid
+	return result
+}
+
+// verifyDocumentSignature checks all stored signatures of a document against
+// the current document value and the signer MSPs, and reports who signed
+func (s *SmartContract) verifyDocumentSignature(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 {
+		return s.returnError("Wrong number of parameters, need document type & key")
+	}
+
+	stateKey, err := s.stateKey(args[0], args[1])
+	if err != nil {
+		return s.returnError(err.Error())
+	}
+	signatures, err := s.readSignatures(APIstub, stateKey)
+	if err != nil {
+		return s.returnError("Query signature failed: " + err.Error())
+	}
+	if len(signatures) == 0 {
+		return s.returnError("Document " + stateKey + " is not signed")
+	}
+	value, err := s.getState(APIstub, stateKey)
+	if err != nil {
+		return s.returnError("Query failed: " + err.Error())
+	}
+
+	results := []SignatureVerification{}
+	for _, signature := range signatures {
+		results = append(results, verifySignature(APIstub, signature, value))
+	}
+	resultsAsBytes, err := json.Marshal(results)
+	if err != nil {
+		return s.returnError("Marshal verification failed: " + err.Error())
+	}
+	return shim.Success(resultsAsBytes)
+}